@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Atomic load modes selected with -atomic.
+const (
+	atomicOff         = "off"         // rows are written straight to the target as they are read
+	atomicTransaction = "transaction" // all writes happen in one multi-document transaction
+	atomicSwap        = "swap"        // rows go to a staging collection that replaces the target
+	atomicMerge       = "merge"       // rows go to a staging collection that is $merged into the target
+)
+
+// maxTransactionFileSize is the input size above which -atomic transaction warns that
+// the load will likely exceed MongoDB's transaction size or time limits.
+const maxTransactionFileSize = 16 << 20
+
+// atomicLoad decides where a run writes and, at the end, whether its writes reach
+// the target. In transaction mode writes join a transaction that is committed or
+// aborted; in swap and merge mode they go to a staging collection that is renamed
+// over, or merged into, the target, or else dropped. In every mode the target is
+// left untouched if the load is aborted.
+type atomicLoad struct {
+	mode    string
+	client  *mongo.Client
+	db      *mongo.Database
+	target  *mongo.Collection
+	staging *mongo.Collection // swap and merge only
+	session mongo.Session     // transaction only
+	mergeOn []string          // fields identifying a document for $merge; _id if empty
+	done    bool
+}
+
+// validAtomicMode reports whether mode is a known -atomic value.
+func validAtomicMode(mode string) bool {
+	switch mode {
+	case atomicOff, atomicTransaction, atomicSwap, atomicMerge:
+		return true
+	}
+	return false
+}
+
+// beginAtomicLoad prepares a load into db.target. For swap and merge it creates the
+// run's staging collection; for transaction it starts a session and transaction.
+func beginAtomicLoad(ctx context.Context, client *mongo.Client, db *mongo.Database, target, mode, runID string, mergeOn []string) (*atomicLoad, error) {
+	a := &atomicLoad{mode: mode, client: client, db: db, target: db.Collection(target), mergeOn: mergeOn}
+	switch mode {
+	case atomicOff:
+	case atomicTransaction:
+		session, err := client.StartSession()
+		if err != nil {
+			return nil, fmt.Errorf("could not start session: %w", err)
+		}
+		if err := session.StartTransaction(); err != nil {
+			session.EndSession(ctx)
+			return nil, fmt.Errorf("could not start transaction: %w", err)
+		}
+		a.session = session
+	case atomicSwap, atomicMerge:
+		if mode == atomicMerge && len(mergeOn) > 0 {
+			if err := checkMergeIndex(ctx, a.target, mergeOn); err != nil {
+				return nil, err
+			}
+		}
+		name := stagingCollectionName(target, runID)
+		// Created up front so an empty file still yields a (empty) collection to swap in.
+		if err := db.CreateCollection(ctx, name); err != nil {
+			return nil, fmt.Errorf("could not create staging collection %s: %w", name, err)
+		}
+		a.staging = db.Collection(name)
+	default:
+		return nil, fmt.Errorf("invalid atomic mode %q (want off, transaction, swap or merge)", mode)
+	}
+	return a, nil
+}
+
+// checkMergeIndex makes sure target has the unique index $merge needs to match
+// documents on the fields on, so a load fails before it starts rather than at commit.
+func checkMergeIndex(ctx context.Context, target *mongo.Collection, on []string) error {
+	specs, err := target.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list indexes of %s: %w", target.Name(), err)
+	}
+	for _, spec := range specs {
+		if spec.Unique == nil || !*spec.Unique {
+			continue
+		}
+		elems, err := spec.KeysDocument.Elements()
+		if err != nil {
+			continue
+		}
+		keys := make([]string, len(elems))
+		for i, e := range elems {
+			keys[i] = e.Key()
+		}
+		// $merge accepts an index on the same fields in any order.
+		if len(keys) == len(on) && !slices.ContainsFunc(on, func(f string) bool { return !slices.Contains(keys, f) }) {
+			return nil
+		}
+	}
+	return fmt.Errorf("-atomic merge matches on %v, which needs a unique index on exactly those fields in %s; add one to the job config's indexes",
+		on, target.Name())
+}
+
+// stagingCollectionName names the collection a run stages its rows in.
+func stagingCollectionName(target, runID string) string {
+	return target + "_staging_" + runID
+}
+
+// collection returns the collection rows should be written to.
+func (a *atomicLoad) collection() *mongo.Collection {
+	if a.staging != nil {
+		return a.staging
+	}
+	return a.target
+}
+
+// context returns the context writes should use, which carries the transaction in transaction mode.
+func (a *atomicLoad) context(ctx context.Context) context.Context {
+	if a.session != nil {
+		return mongo.NewSessionContext(ctx, a.session)
+	}
+	return ctx
+}
+
+// commit makes the run's writes visible in the target.
+func (a *atomicLoad) commit(ctx context.Context) error {
+	if a.done {
+		return nil
+	}
+	a.done = true
+	switch a.mode {
+	case atomicTransaction:
+		defer a.session.EndSession(ctx)
+		if err := a.session.CommitTransaction(ctx); err != nil {
+			return fmt.Errorf("could not commit transaction: %w", err)
+		}
+	case atomicSwap:
+		dbName := a.db.Name()
+		cmd := bson.D{
+			{Key: "renameCollection", Value: dbName + "." + a.staging.Name()},
+			{Key: "to", Value: dbName + "." + a.target.Name()},
+			{Key: "dropTarget", Value: true},
+		}
+		if err := a.client.Database("admin").RunCommand(ctx, cmd).Err(); err != nil {
+			a.dropStaging(ctx)
+			return fmt.Errorf("could not swap %s into %s: %w", a.staging.Name(), a.target.Name(), err)
+		}
+	case atomicMerge:
+		on := a.mergeOn
+		if len(on) == 0 {
+			on = []string{"_id"}
+		}
+		var pipeline mongo.Pipeline
+		if !slices.Contains(on, "_id") {
+			// Staged documents have _ids of their own, which cannot replace those of the matched documents.
+			pipeline = append(pipeline, bson.D{{Key: "$unset", Value: "_id"}})
+		}
+		pipeline = append(pipeline, bson.D{{Key: "$merge", Value: bson.D{
+			{Key: "into", Value: a.target.Name()},
+			{Key: "on", Value: on},
+			{Key: "whenMatched", Value: "replace"},
+			{Key: "whenNotMatched", Value: "insert"},
+		}}})
+		cursor, err := a.staging.Aggregate(ctx, pipeline)
+		if err == nil {
+			err = cursor.Close(ctx)
+		}
+		a.dropStaging(ctx)
+		if err != nil {
+			return fmt.Errorf("could not merge %s into %s: %w", a.staging.Name(), a.target.Name(), err)
+		}
+	}
+	return nil
+}
+
+// abort discards the run's writes. It is safe to call after commit, when it does nothing.
+func (a *atomicLoad) abort(ctx context.Context) {
+	if a.done {
+		return
+	}
+	a.done = true
+	switch a.mode {
+	case atomicTransaction:
+		if err := a.session.AbortTransaction(ctx); err != nil {
+			slog.Warn("Could not abort transaction", "stage", "finalize", "error", err)
+		}
+		a.session.EndSession(ctx)
+	case atomicSwap, atomicMerge:
+		a.dropStaging(ctx)
+	}
+}
+
+func (a *atomicLoad) dropStaging(ctx context.Context) {
+	if err := a.staging.Drop(ctx); err != nil {
+		slog.Warn("Could not drop staging collection", "stage", "finalize", "collection", a.staging.Name(), "error", err)
+	}
+}
+
+// errorRate returns the fraction of rows read that were rejected.
+func errorRate(rows rowCounts) float64 {
+	if rows.Read == 0 {
+		return 0
+	}
+	return float64(rows.Rejected) / float64(rows.Read)
+}
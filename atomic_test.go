@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestValidAtomicMode(t *testing.T) {
+	for _, mode := range []string{atomicOff, atomicTransaction, atomicSwap, atomicMerge} {
+		if !validAtomicMode(mode) {
+			t.Errorf("Expected %q to be a valid atomic mode", mode)
+		}
+	}
+	if validAtomicMode("rename") {
+		t.Errorf("Expected rename to be an invalid atomic mode")
+	}
+}
+
+func TestStagingCollectionName(t *testing.T) {
+	if got := stagingCollectionName("processed_data", "665f1c2e9b1e8a0001a1b2c3"); got != "processed_data_staging_665f1c2e9b1e8a0001a1b2c3" {
+		t.Errorf("Unexpected staging collection name %q", got)
+	}
+}
+
+func TestErrorRate(t *testing.T) {
+	if got := errorRate(rowCounts{}); got != 0 {
+		t.Errorf("Expected 0 for no rows, got %v", got)
+	}
+	if got := errorRate(rowCounts{Read: 200, Inserted: 195, Rejected: 5}); got != 0.025 {
+		t.Errorf("Expected 0.025, got %v", got)
+	}
+}
+
+func TestAtomicLoad(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	newLoad := func(mt *mtest.T, mode string, mergeOn []string) *atomicLoad {
+		return &atomicLoad{mode: mode, client: mt.Client, db: mt.DB, target: mt.DB.Collection("orders"), staging: mt.Coll, mergeOn: mergeOn}
+	}
+	// pipeline returns the stage names of an aggregate command.
+	pipeline := func(cmd bson.Raw) []string {
+		values, _ := cmd.Lookup("pipeline").Array().Values()
+		var stages []string
+		for _, v := range values {
+			elems, _ := v.Document().Elements()
+			stages = append(stages, elems[0].Key())
+		}
+		return stages
+	}
+
+	mt.Run("CommitSwap", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		if err := newLoad(mt, atomicSwap, nil).commit(context.Background()); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		cmd := mt.GetStartedEvent().Command
+		if from := cmd.Lookup("renameCollection").StringValue(); from != mt.DB.Name()+"."+mt.Coll.Name() {
+			t.Errorf("Expected the staging collection to be renamed, got %s", from)
+		}
+		if to := cmd.Lookup("to").StringValue(); to != mt.DB.Name()+".orders" {
+			t.Errorf("Expected it to be renamed to orders, got %s", to)
+		}
+		if !cmd.Lookup("dropTarget").Boolean() {
+			t.Errorf("Expected the target to be dropped, got %s", cmd)
+		}
+	})
+
+	mt.Run("CommitMergeOnKeys", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.coll", mtest.FirstBatch), mtest.CreateSuccessResponse())
+		if err := newLoad(mt, atomicMerge, []string{"sku"}).commit(context.Background()); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		events := mt.GetAllStartedEvents()
+		if len(events) != 2 || events[0].CommandName != "aggregate" || events[1].CommandName != "drop" {
+			t.Fatalf("Expected an aggregate and a drop, got %d commands", len(events))
+		}
+		if stages := pipeline(events[0].Command); len(stages) != 2 || stages[0] != "$unset" || stages[1] != "$merge" {
+			t.Errorf("Expected $unset then $merge, got %v", stages)
+		}
+		merge := events[0].Command.Lookup("pipeline", "1", "$merge")
+		if into := merge.Document().Lookup("into").StringValue(); into != "orders" {
+			t.Errorf("Expected a merge into orders, got %s", into)
+		}
+		if on := merge.Document().Lookup("on", "0").StringValue(); on != "sku" {
+			t.Errorf("Expected a merge on sku, got %s", on)
+		}
+	})
+
+	mt.Run("CommitMergeOnID", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.coll", mtest.FirstBatch), mtest.CreateSuccessResponse())
+		if err := newLoad(mt, atomicMerge, nil).commit(context.Background()); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if stages := pipeline(mt.GetStartedEvent().Command); len(stages) != 1 || stages[0] != "$merge" {
+			t.Errorf("Expected only $merge, got %v", stages)
+		}
+	})
+
+	mt.Run("CommitMergeFails", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 51183, Message: "no unique index"}), mtest.CreateSuccessResponse())
+		if err := newLoad(mt, atomicMerge, []string{"sku"}).commit(context.Background()); err == nil {
+			t.Fatalf("Expected an error from a failed merge")
+		}
+		mt.GetStartedEvent()
+		if drop := mt.GetStartedEvent(); drop == nil || drop.CommandName != "drop" {
+			t.Errorf("Expected the staging collection to be dropped after a failed merge")
+		}
+	})
+
+	mt.Run("Abort", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		load := newLoad(mt, atomicSwap, nil)
+		load.abort(context.Background())
+		started := mt.GetStartedEvent()
+		if started == nil || started.CommandName != "drop" || started.Command.Lookup("drop").StringValue() != mt.Coll.Name() {
+			t.Fatalf("Expected the staging collection to be dropped, got %v", started)
+		}
+		if err := load.commit(context.Background()); err != nil || mt.GetStartedEvent() != nil {
+			t.Errorf("Expected commit after abort to do nothing, got %v", err)
+		}
+	})
+
+	mt.Run("BeginMergeWithUniqueIndex", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.orders", mtest.FirstBatch,
+			bson.D{{Key: "v", Value: 2}, {Key: "key", Value: bson.D{{Key: "_id", Value: 1}}}, {Key: "name", Value: "_id_"}},
+			bson.D{{Key: "v", Value: 2}, {Key: "key", Value: bson.D{{Key: "region", Value: 1}, {Key: "sku", Value: 1}}}, {Key: "name", Value: "region_1_sku_1"}, {Key: "unique", Value: true}},
+		), mtest.CreateSuccessResponse())
+		load, err := beginAtomicLoad(context.Background(), mt.Client, mt.DB, "orders", atomicMerge, "run1", []string{"sku", "region"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if name := load.staging.Name(); name != "orders_staging_run1" {
+			t.Errorf("Expected staging collection orders_staging_run1, got %s", name)
+		}
+	})
+
+	mt.Run("BeginMergeWithoutUniqueIndex", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.orders", mtest.FirstBatch,
+			bson.D{{Key: "v", Value: 2}, {Key: "key", Value: bson.D{{Key: "_id", Value: 1}}}, {Key: "name", Value: "_id_"}},
+			bson.D{{Key: "v", Value: 2}, {Key: "key", Value: bson.D{{Key: "sku", Value: 1}}}, {Key: "name", Value: "sku_1"}},
+		))
+		if _, err := beginAtomicLoad(context.Background(), mt.Client, mt.DB, "orders", atomicMerge, "run1", []string{"sku"}); err == nil {
+			t.Fatalf("Expected an error without a unique index on sku")
+		}
+		for _, started := range mt.GetAllStartedEvents() {
+			if started.CommandName == "create" {
+				t.Errorf("Expected no staging collection to be created")
+			}
+		}
+	})
+}
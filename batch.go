@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// batchWriteTimeout bounds a single bulk write call, retries excluded.
+const batchWriteTimeout = 30 * time.Second
+
+// pendingRow is a document waiting to be written, with the CSV line it came from.
+type pendingRow struct {
+	line int
+	doc  bson.M
+	// generatedID is set when the importer assigned the document's _id, so a duplicate
+	// _id after a retry means an earlier attempt did write the row.
+	generatedID bool
+	// watermark is the row's -watermarkColumn value, nil without one.
+	watermark any
+	// size is the row's length in the CSV file, as counted by -maxBytesPerSec.
+	size int
+}
+
+// recordSize returns the length of a CSV record with its separators, ignoring quotes.
+func recordSize(fields []string) int {
+	n := len(fields) // A comma after each field but the last, and a newline
+	for _, f := range fields {
+		n += len(f)
+	}
+	return n
+}
+
+// batchWriter writes rows to a collection with one bulk call per batch.
+type batchWriter struct {
+	coll       *mongo.Collection
+	keyColumns []string // rows are upserted by these columns; nil inserts them
+	ordered    bool
+	retry      retryPolicy
+}
+
+// write writes rows and returns, for each row, nil if it was written or the error
+// that rejected it, along with the number of retries made.
+//
+// An unordered write attempts every row. An ordered write applies rows in order and
+// stops at the first failing one, so the rows after it are written in a further call;
+// either way one bad row rejects only itself.
+func (w *batchWriter) write(ctx context.Context, rows []pendingRow) ([]error, int) {
+	results := make([]error, len(rows))
+	retries := 0
+	for start := 0; start < len(rows); {
+		batch := rows[start:]
+		n, err := w.retry.do(ctx, func() error { return w.bulkWrite(ctx, batch) })
+		retries += n
+		if err == nil {
+			break
+		}
+		var bulkErr mongo.BulkWriteException
+		if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+			// The call as a whole failed, e.g. the server stayed unreachable.
+			for i := range batch {
+				results[start+i] = err
+			}
+			break
+		}
+		last := 0
+		for _, we := range bulkErr.WriteErrors {
+			last = max(last, we.Index)
+			if retries > 0 && batch[we.Index].generatedID && isDuplicateID(we.WriteError) {
+				// Written by an attempt whose acknowledgement was lost; in an ordered write
+				// that may be an attempt of an earlier call, which also wrote the rows after
+				// the one that stopped it.
+				continue
+			}
+			results[start+we.Index] = fmt.Errorf("could not write to %s: %w", w.coll.Name(), we.WriteError)
+		}
+		if !w.ordered {
+			break
+		}
+		start += last + 1
+	}
+	return results, retries
+}
+
+// writeRound writes rows in up to writers bulk writes made at once, each first
+// waiting its turn with limiter if it is set. It returns what write returns, and the
+// time the slowest write took, waits excluded.
+func (w *batchWriter) writeRound(ctx context.Context, rows []pendingRow, writers int, limiter *writeLimiter) ([]error, int, time.Duration) {
+	results := make([]error, len(rows))
+	var mu sync.Mutex
+	var retries int
+	var latency time.Duration
+	var wg sync.WaitGroup
+	for _, group := range w.split(rows, writers) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch := make([]pendingRow, len(group))
+			size := 0
+			for i, r := range group {
+				batch[i] = rows[r]
+				size += rows[r].size
+			}
+			if limiter != nil {
+				if err := limiter.wait(ctx, len(batch), size); err != nil {
+					for _, r := range group {
+						results[r] = err
+					}
+					return
+				}
+			}
+			start := time.Now()
+			written, n := w.write(ctx, batch)
+			took := time.Since(start)
+			for i, r := range group {
+				results[r] = written[i] // Groups do not share rows, so no lock is needed
+			}
+			mu.Lock()
+			retries += n
+			latency = max(latency, took)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results, retries, latency
+}
+
+// split divides rows into at most parts groups of row indexes, each in file order.
+// Upserted rows are grouped by key, so the rows for one document are applied in
+// order and the last still wins.
+func (w *batchWriter) split(rows []pendingRow, parts int) [][]int {
+	parts = max(min(parts, len(rows)), 1)
+	groups := make([][]int, parts)
+	for i, row := range rows {
+		g := i * parts / len(rows)
+		if w.keyColumns != nil && parts > 1 {
+			key, _ := keyString(w.keyColumns, row.doc) // A key that cannot be encoded fails its write anyway
+			h := fnv.New32a()
+			h.Write([]byte(key))
+			g = int(h.Sum32() % uint32(parts))
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return slices.DeleteFunc(groups, func(g []int) bool { return len(g) == 0 })
+}
+
+// bulkWrite makes one InsertMany or BulkWrite call for rows.
+func (w *batchWriter) bulkWrite(ctx context.Context, rows []pendingRow) error {
+	ctx, cancel := context.WithTimeout(ctx, batchWriteTimeout)
+	defer cancel()
+
+	if w.keyColumns == nil {
+		docs := make([]interface{}, len(rows))
+		for i, row := range rows {
+			docs[i] = row.doc
+		}
+		_, err := w.coll.InsertMany(ctx, docs, options.InsertMany().SetOrdered(w.ordered))
+		return err
+	}
+	models := make([]mongo.WriteModel, len(rows))
+	for i, row := range rows {
+		models[i] = mongo.NewReplaceOneModel().SetFilter(keyFilter(w.keyColumns, row.doc)).SetReplacement(row.doc).SetUpsert(true)
+	}
+	_, err := w.coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(w.ordered))
+	return err
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func testRows(n int) []pendingRow {
+	rows := make([]pendingRow, n)
+	for i := range rows {
+		rows[i] = pendingRow{line: i + 2, doc: bson.M{"Name": i}}
+	}
+	return rows
+}
+
+func TestBatchWriter(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	dupName := mtest.WriteError{Index: 1, Code: 11000, Message: "E11000 duplicate key error collection: bulkcsv.processed_data index: Name_1 dup key: { Name: 1 }"}
+
+	mt.Run("AllWritten", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 3}))
+		w := &batchWriter{coll: mt.Coll, ordered: true}
+		results, retries := w.write(context.Background(), testRows(3))
+		for i, err := range results {
+			if err != nil {
+				t.Errorf("Expected row %d to be written, got %v", i, err)
+			}
+		}
+		if retries != 0 {
+			t.Errorf("Expected no retries, got %d", retries)
+		}
+	})
+
+	mt.Run("UnorderedRejectsOnlyFailedRow", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(dupName))
+		w := &batchWriter{coll: mt.Coll, ordered: false}
+		results, _ := w.write(context.Background(), testRows(3))
+		if results[0] != nil || results[1] == nil || results[2] != nil {
+			t.Errorf("Expected only row 1 to fail, got %v", results)
+		}
+		if got := classifyWriteError(results[1]); got != errorClassDuplicate {
+			t.Errorf("Expected a duplicate error, got %s", got)
+		}
+	})
+
+	mt.Run("OrderedResubmitsRowsAfterFailure", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateWriteErrorsResponse(dupName),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}),
+		)
+		w := &batchWriter{coll: mt.Coll, ordered: true}
+		results, _ := w.write(context.Background(), testRows(4))
+		if results[0] != nil || results[1] == nil || results[2] != nil || results[3] != nil {
+			t.Errorf("Expected only row 1 to fail, got %v", results)
+		}
+		started := mt.GetAllStartedEvents()
+		if len(started) != 2 {
+			t.Fatalf("Expected 2 insert commands, got %d", len(started))
+		}
+		if docs, _ := started[1].Command.Lookup("documents").Array().Values(); len(docs) != 2 {
+			t.Errorf("Expected the 2 rows after the failed one to be resubmitted, got %d", len(docs))
+		}
+	})
+
+	mt.Run("OrderedRetryAppliedUnacknowledged", func(mt *mtest.T) {
+		// The first attempt wrote every row but its acknowledgement was lost, so the
+		// retry stops at the first row's _id, and so does each resubmission after it.
+		dupID := mtest.WriteError{Index: 0, Code: 11000, Message: "E11000 duplicate key error collection: bulkcsv.processed_data index: _id_ dup key: { _id: ObjectId('665f1c2e9b1e8a0001a1b2c3') }"}
+		mt.AddMockResponses(
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 64, Message: "waiting for replication timed out"}),
+			mtest.CreateWriteErrorsResponse(dupID),
+			mtest.CreateWriteErrorsResponse(dupID),
+			mtest.CreateWriteErrorsResponse(dupID),
+		)
+		rows := testRows(3)
+		for i := range rows {
+			rows[i].generatedID = true
+		}
+		w := &batchWriter{coll: mt.Coll, ordered: true, retry: retryPolicy{maxRetries: 1}}
+		results, retries := w.write(context.Background(), rows)
+		for i, err := range results {
+			if err != nil {
+				t.Errorf("Expected row %d to count as written, got %v", i, err)
+			}
+		}
+		if retries != 1 {
+			t.Errorf("Expected 1 retry, got %d", retries)
+		}
+		if n := len(mt.GetAllStartedEvents()); n != 4 {
+			t.Errorf("Expected 4 insert commands, got %d", n)
+		}
+	})
+
+	mt.Run("Upsert", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}, bson.E{Key: "nModified", Value: 0}))
+		w := &batchWriter{coll: mt.Coll, keyColumns: []string{"Name"}, ordered: true}
+		results, _ := w.write(context.Background(), testRows(2))
+		if results[0] != nil || results[1] != nil {
+			t.Errorf("Expected both rows to be upserted, got %v", results)
+		}
+		if cmd := mt.GetStartedEvent(); cmd == nil || cmd.CommandName != "update" {
+			t.Errorf("Expected an update command, got %v", cmd)
+		}
+	})
+
+	mt.Run("WriteRound", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}))
+		w := &batchWriter{coll: mt.Coll, ordered: true}
+		results, _, latency := w.writeRound(context.Background(), testRows(4), 2, newWriteLimiter(1e6, 0))
+		if len(results) != 4 || results[0] != nil || results[3] != nil {
+			t.Errorf("Expected all 4 rows to be written, got %v", results)
+		}
+		if n := len(mt.GetAllStartedEvents()); n != 2 || latency <= 0 {
+			t.Errorf("Expected 2 insert commands and their latency, got %d commands in %s", n, latency)
+		}
+	})
+}
+
+func TestBatchWriterSplit(t *testing.T) {
+	t.Run("Insert", func(t *testing.T) {
+		groups := (&batchWriter{}).split(testRows(5), 2)
+		if len(groups) != 2 || len(groups[0])+len(groups[1]) != 5 || groups[0][0] != 0 || groups[1][0] != 3 {
+			t.Errorf("Expected two runs of consecutive rows, got %v", groups)
+		}
+	})
+
+	t.Run("UpsertKeepsKeysTogether", func(t *testing.T) {
+		rows := testRows(40)
+		for i := range rows {
+			rows[i].doc = bson.M{"Name": i % 7}
+		}
+		w := &batchWriter{keyColumns: []string{"Name"}}
+		groupOf := map[any]int{}
+		for g, group := range w.split(rows, 4) {
+			for i, r := range group {
+				if i > 0 && r < group[i-1] {
+					t.Errorf("Expected rows in file order, got %v", group)
+				}
+				key := rows[r].doc["Name"]
+				if seen, ok := groupOf[key]; ok && seen != g {
+					t.Errorf("Expected all rows for key %v in one group, got groups %d and %d", key, seen, g)
+				}
+				groupOf[key] = g
+			}
+		}
+	})
+
+	t.Run("FewerRowsThanWriters", func(t *testing.T) {
+		if groups := (&batchWriter{}).split(testRows(2), 8); len(groups) != 2 {
+			t.Errorf("Expected a group per row, got %v", groups)
+		}
+	})
+}
@@ -0,0 +1,29 @@
+package main
+
+import "fmt"
+
+// errorBudget is how many rejected rows a run tolerates before it is aborted.
+// A negative limit disables that check.
+type errorBudget struct {
+	maxErrors int64
+	maxRate   float64
+	// minRows is how many rows must be read before the rate is checked mid-run, so
+	// that a bad row at the very start does not count as a 100% failure rate.
+	minRows int64
+}
+
+// check returns an error describing the exceeded limit, or nil while rows are within
+// budget. final is true once the whole input has been read, when the rate is checked
+// however few rows there were.
+func (b errorBudget) check(rows rowCounts, final bool) error {
+	if b.maxErrors >= 0 && rows.Rejected > b.maxErrors {
+		return fmt.Errorf("error budget exceeded: %d rows rejected, above -maxErrors %d", rows.Rejected, b.maxErrors)
+	}
+	if b.maxRate >= 0 && (final || rows.Read >= b.minRows) {
+		if rate := errorRate(rows); rate > b.maxRate {
+			return fmt.Errorf("error budget exceeded: %d of %d rows rejected (%.2f%%), above -maxErrorRate %.2f%%",
+				rows.Rejected, rows.Read, 100*rate, 100*b.maxRate)
+		}
+	}
+	return nil
+}
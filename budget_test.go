@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestErrorBudget(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		b := errorBudget{maxErrors: -1, maxRate: -1, minRows: 100}
+		if err := b.check(rowCounts{Read: 10, Rejected: 10}, true); err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	})
+
+	t.Run("MaxErrors", func(t *testing.T) {
+		b := errorBudget{maxErrors: 2, maxRate: -1}
+		if err := b.check(rowCounts{Read: 5, Rejected: 2}, false); err != nil {
+			t.Errorf("Expected 2 rejected rows to be within budget, got %v", err)
+		}
+		if err := b.check(rowCounts{Read: 5, Rejected: 3}, false); err == nil {
+			t.Errorf("Expected 3 rejected rows to exceed -maxErrors 2")
+		}
+	})
+
+	t.Run("MaxErrorsZero", func(t *testing.T) {
+		b := errorBudget{maxErrors: 0, maxRate: -1}
+		if err := b.check(rowCounts{Read: 1, Rejected: 1}, false); err == nil {
+			t.Errorf("Expected the first rejected row to exceed -maxErrors 0")
+		}
+	})
+
+	t.Run("MaxRateWaitsForMinRows", func(t *testing.T) {
+		b := errorBudget{maxErrors: -1, maxRate: 0.1, minRows: 100}
+		rows := rowCounts{Read: 5, Rejected: 1}
+		if err := b.check(rows, false); err != nil {
+			t.Errorf("Expected rate not to be checked before minRows, got %v", err)
+		}
+		if err := b.check(rows, true); err == nil {
+			t.Errorf("Expected 20%% rejected to exceed -maxErrorRate at the end of the run")
+		}
+	})
+
+	t.Run("MaxRate", func(t *testing.T) {
+		b := errorBudget{maxErrors: -1, maxRate: 0.1, minRows: 100}
+		if err := b.check(rowCounts{Read: 100, Rejected: 10}, false); err != nil {
+			t.Errorf("Expected 10%% rejected to be within budget, got %v", err)
+		}
+		if err := b.check(rowCounts{Read: 100, Rejected: 11}, false); err == nil {
+			t.Errorf("Expected 11%% rejected to exceed -maxErrorRate 10%%")
+		}
+	})
+}
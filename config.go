@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// jobConfig is the job configuration file given with -config. It holds settings too
+// structured for flags; everything else stays a flag.
+type jobConfig struct {
+	Indexes    []indexSpec       `yaml:"indexes"`
+	Schema     *schemaConfig     `yaml:"schema"`
+	TimeSeries *timeSeriesConfig `yaml:"timeSeries"`
+}
+
+// loadJobConfig reads and validates the YAML job configuration at path. Unknown keys
+// are an error, so a misspelt option is not silently ignored.
+func loadJobConfig(path string) (*jobConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read job config: %w", err)
+	}
+	var cfg jobConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) { // An empty file is an empty config
+		return nil, fmt.Errorf("could not parse job config %s: %w", path, err)
+	}
+	for i := range cfg.Indexes {
+		if err := cfg.Indexes[i].validate(); err != nil {
+			return nil, fmt.Errorf("invalid index %d in job config %s: %w", i+1, path, err)
+		}
+	}
+	if cfg.Schema != nil {
+		if err := cfg.Schema.validate(); err != nil {
+			return nil, fmt.Errorf("invalid schema in job config %s: %w", path, err)
+		}
+	}
+	if cfg.TimeSeries != nil {
+		if err := cfg.TimeSeries.validate(); err != nil {
+			return nil, fmt.Errorf("invalid timeSeries in job config %s: %w", path, err)
+		}
+	}
+	return &cfg, nil
+}
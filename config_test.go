@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// writeTestConfig writes a job config to a temporary file and returns its path.
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "job.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write job config: %v", err)
+	}
+	return path
+}
+
+func TestLoadJobConfig(t *testing.T) {
+	t.Run("Indexes", func(t *testing.T) {
+		cfg, err := loadJobConfig(writeTestConfig(t, `
+indexes:
+  - keys: {region: 1, ts: -1}
+  - name: by_email
+    keys: {email: 1}
+    unique: true
+    collation: {locale: en, strength: 2}
+  - keys: {loadedAt: 1}
+    expireAfterSeconds: 86400
+    partialFilter: {status: {$eq: done}}
+    build: before
+`))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(cfg.Indexes) != 3 {
+			t.Fatalf("Expected 3 indexes, got %d", len(cfg.Indexes))
+		}
+		compound := cfg.Indexes[0]
+		if !reflect.DeepEqual(compound.Keys, indexKeys{{Key: "region", Value: 1}, {Key: "ts", Value: -1}}) {
+			t.Errorf("Expected keys in file order, got %v", compound.Keys)
+		}
+		if compound.name() != "region_1_ts_-1" || compound.build() != indexBuildAfter {
+			t.Errorf("Expected region_1_ts_-1 built after the load, got %s built %s", compound.name(), compound.build())
+		}
+		unique := cfg.Indexes[1]
+		if unique.name() != "by_email" || unique.build() != indexBuildBefore {
+			t.Errorf("Expected by_email built before the load, got %s built %s", unique.name(), unique.build())
+		}
+		if unique.Collation == nil || unique.Collation.Strength != 2 {
+			t.Errorf("Expected collation strength 2, got %+v", unique.Collation)
+		}
+		ttl := cfg.Indexes[2]
+		if *ttl.ExpireAfterSeconds != 86400 || ttl.build() != indexBuildBefore {
+			t.Errorf("Unexpected TTL index %+v", ttl)
+		}
+		if opts := ttl.model().Options; opts.PartialFilterExpression == nil || *opts.ExpireAfterSeconds != 86400 {
+			t.Errorf("Expected partial filter and TTL in the index options, got %+v", opts)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		if cfg, err := loadJobConfig(writeTestConfig(t, "")); err != nil || len(cfg.Indexes) != 0 {
+			t.Errorf("Expected an empty config, got %+v (%v)", cfg, err)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		tests := map[string]string{
+			"UnknownKey":      "indexes:\n  - keys: {a: 1}\n    uniqe: true\n",
+			"NoKeys":          "indexes:\n  - unique: true\n",
+			"BadDirection":    "indexes:\n  - keys: {a: 2}\n",
+			"BadIndexType":    "indexes:\n  - keys: {a: geo}\n",
+			"BadBuild":        "indexes:\n  - keys: {a: 1}\n    build: during\n",
+			"CompoundTTL":     "indexes:\n  - keys: {a: 1, b: 1}\n    expireAfterSeconds: 60\n",
+			"CollationLocale": "indexes:\n  - keys: {a: 1}\n    collation: {strength: 2}\n",
+		}
+		for name, content := range tests {
+			if _, err := loadJobConfig(writeTestConfig(t, content)); err == nil {
+				t.Errorf("%s: expected an error", name)
+			}
+		}
+		if _, err := loadJobConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+			t.Errorf("Expected an error for a missing file")
+		}
+	})
+}
+
+func TestEnsureIndexes(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	specs := []indexSpec{
+		{Keys: indexKeys{{Key: "email", Value: 1}}, Unique: true},
+		{Keys: indexKeys{{Key: "region", Value: 1}}},
+	}
+
+	mt.Run("BuildsOnlyThePhase", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		var results []indexResult
+		if err := ensureIndexes(context.Background(), mt.Coll, specs, indexBuildBefore, &results); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(results) != 1 || results[0].Name != "email_1" || results[0].Build != indexBuildBefore {
+			t.Errorf("Expected only email_1 to be built, got %+v", results)
+		}
+	})
+
+	mt.Run("DuplicateKeys", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{
+			Code: 11000, Name: "DuplicateKey", Message: "E11000 duplicate key error collection: bulkcsv.processed_data index: email_1 dup key: { email: \"a@example.com\" }",
+		}))
+		var results []indexResult
+		err := ensureIndexes(context.Background(), mt.Coll, specs, indexBuildBefore, &results)
+		if err == nil {
+			t.Fatalf("Expected the duplicate keys to fail the build")
+		}
+		if len(results) != 1 || results[0].Error == "" {
+			t.Errorf("Expected the failed build in the results, got %+v", results)
+		}
+		if started := mt.GetStartedEvent(); started == nil || started.CommandName != "createIndexes" {
+			t.Errorf("Expected a createIndexes command, got %v", started)
+		}
+	})
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// uriEnvVar is the environment variable the MongoDB URI is read from when neither
+// -mongoURI nor -mongoURIFile is given.
+const uriEnvVar = "MONGO_URI"
+
+// connFlags holds the MongoDB connection flags shared by every subcommand. Each one
+// overrides the matching URI option when given; otherwise the URI's value is kept,
+// falling back to the flag's default when the URI does not set it either.
+type connFlags struct {
+	fs                     *flag.FlagSet
+	uri                    *string
+	uriFile                *string
+	tlsCAFile              *string
+	tlsCertificateKeyFile  *string
+	tlsInsecure            *bool
+	authSource             *string
+	authMechanism          *string
+	appName                *string
+	maxPoolSize            *uint64
+	minPoolSize            *uint64
+	compressors            *string
+	connectTimeout         *time.Duration
+	serverSelectionTimeout *time.Duration
+	w                      *string
+	journal                *bool
+	wtimeout               *time.Duration
+	readPreference         *string
+
+	resolvedURI string // set by resolveURI
+}
+
+// registerConnFlags defines -mongoURI and the connection tuning flags on fs.
+func registerConnFlags(fs *flag.FlagSet) *connFlags {
+	return &connFlags{
+		fs:                     fs,
+		uri:                    fs.String("mongoURI", "mongodb://localhost:27017", "MongoDB connection URI. Prefer -mongoURIFile or $"+uriEnvVar+" for URIs with a password."),
+		uriFile:                fs.String("mongoURIFile", "", "File holding the MongoDB connection URI, e.g. a mounted secret."),
+		tlsCAFile:              fs.String("tlsCAFile", "", "PEM file of CA certificates to verify the server with. Enables TLS."),
+		tlsCertificateKeyFile:  fs.String("tlsCertificateKeyFile", "", "PEM file holding the client certificate and its private key. Enables TLS."),
+		tlsInsecure:            fs.Bool("tlsInsecure", false, "Skip verification of the server certificate and host name. For testing only. Enables TLS."),
+		authSource:             fs.String("authSource", "", "Database to authenticate against; $external for MONGODB-X509."),
+		authMechanism:          fs.String("authMechanism", "", "Authentication mechanism, e.g. SCRAM-SHA-256, SCRAM-SHA-1 or MONGODB-X509."),
+		appName:                fs.String("appName", instrumentationName, "Application name recorded in the server logs and profiler."),
+		maxPoolSize:            fs.Uint64("maxPoolSize", 100, "Maximum number of connections per server."),
+		minPoolSize:            fs.Uint64("minPoolSize", 0, "Minimum number of idle connections kept per server."),
+		compressors:            fs.String("compressors", "", "Comma-separated wire compressors in order of preference: snappy, zstd, zlib."),
+		connectTimeout:         fs.Duration("connectTimeout", 10*time.Second, "Timeout for establishing a connection."),
+		serverSelectionTimeout: fs.Duration("serverSelectionTimeout", 10*time.Second, "How long to wait for a suitable server before an operation fails."),
+		w:                      fs.String("w", "", "Write concern: number of members that must acknowledge a write, or majority."),
+		journal:                fs.Bool("journal", false, "Require writes to be written to the on-disk journal before they are acknowledged."),
+		wtimeout:               fs.Duration("wtimeout", 0, "How long a write waits for its write concern before failing; 0 waits forever."),
+		readPreference:         fs.String("readPreference", "", "Read preference: primary, primaryPreferred, secondary, secondaryPreferred or nearest."),
+	}
+}
+
+// args returns the connection flags given on the command line, to pass them on to
+// an import run in a child process.
+func (f *connFlags) args() []string {
+	conn := flag.NewFlagSet("", flag.ContinueOnError)
+	registerConnFlags(conn)
+	var args []string
+	f.fs.Visit(func(fl *flag.Flag) {
+		if conn.Lookup(fl.Name) != nil {
+			args = append(args, "-"+fl.Name+"="+fl.Value.String())
+		}
+	})
+	return args
+}
+
+// resolveURI settles which URI to connect to: -mongoURI if given, else the contents
+// of -mongoURIFile, else $MONGO_URI, else the -mongoURI default. The URI's credentials
+// are registered as secrets so they never appear in logs or reports.
+func (f *connFlags) resolveURI() (string, error) {
+	if f.resolvedURI != "" {
+		return f.resolvedURI, nil
+	}
+	set := map[string]bool{}
+	f.fs.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+
+	uri := *f.uri
+	switch {
+	case set["mongoURI"] && *f.uriFile != "":
+		return "", fmt.Errorf("-mongoURI and -mongoURIFile are mutually exclusive")
+	case set["mongoURI"]:
+	case *f.uriFile != "":
+		data, err := os.ReadFile(*f.uriFile)
+		if err != nil {
+			return "", fmt.Errorf("could not read MongoDB URI: %w", err)
+		}
+		uri = strings.TrimSpace(string(data))
+	case os.Getenv(uriEnvVar) != "":
+		uri = strings.TrimSpace(os.Getenv(uriEnvVar))
+	}
+	if uri == "" {
+		return "", fmt.Errorf("MongoDB URI is empty")
+	}
+	addURISecrets(uri)
+	f.resolvedURI = uri
+	return uri, nil
+}
+
+// redactedURI returns the resolved URI with its credentials replaced, for logging.
+func (f *connFlags) redactedURI() string {
+	return redactURI(f.resolvedURI)
+}
+
+// clientOptions builds the driver options from the URI and the connection flags.
+func (f *connFlags) clientOptions() (*options.ClientOptions, error) {
+	set := map[string]bool{}
+	f.fs.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+
+	uri, err := f.resolveURI()
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Client().ApplyURI(uri)
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid MongoDB URI: %w", err)
+	}
+
+	if set["appName"] || opts.AppName == nil {
+		opts.SetAppName(*f.appName)
+	}
+	if set["maxPoolSize"] || opts.MaxPoolSize == nil {
+		opts.SetMaxPoolSize(*f.maxPoolSize)
+	}
+	if set["minPoolSize"] || opts.MinPoolSize == nil {
+		opts.SetMinPoolSize(*f.minPoolSize)
+	}
+	if set["compressors"] {
+		var compressors []string
+		for _, c := range strings.Split(*f.compressors, ",") {
+			switch c = strings.TrimSpace(c); c {
+			case "":
+			case "snappy", "zstd", "zlib":
+				compressors = append(compressors, c)
+			default:
+				return nil, fmt.Errorf("invalid compressor %q (want snappy, zstd or zlib)", c)
+			}
+		}
+		opts.SetCompressors(compressors)
+	}
+	if set["connectTimeout"] || opts.ConnectTimeout == nil {
+		opts.SetConnectTimeout(*f.connectTimeout)
+	}
+	if set["serverSelectionTimeout"] || opts.ServerSelectionTimeout == nil {
+		opts.SetServerSelectionTimeout(*f.serverSelectionTimeout)
+	}
+
+	if set["w"] || set["journal"] || set["wtimeout"] {
+		// Start from the URI's concern so that, e.g., -journal keeps a w=majority from the URI.
+		wc := &writeconcern.WriteConcern{}
+		if opts.WriteConcern != nil {
+			copied := *opts.WriteConcern
+			wc = &copied
+		}
+		if set["w"] {
+			if *f.w == "" {
+				return nil, fmt.Errorf("-w must be a number of members or a tag set name such as majority")
+			}
+			if n, err := strconv.Atoi(*f.w); err == nil {
+				wc.W = n
+			} else {
+				wc.W = *f.w
+			}
+		}
+		if set["journal"] {
+			wc.Journal = f.journal
+		}
+		if set["wtimeout"] {
+			wc.WTimeout = *f.wtimeout
+		}
+		if !wc.IsValid() {
+			return nil, fmt.Errorf("invalid write concern %s", describeWriteConcern(wc))
+		}
+		opts.SetWriteConcern(wc)
+	}
+	if *f.readPreference != "" {
+		mode, err := readpref.ModeFromString(*f.readPreference)
+		if err != nil {
+			return nil, fmt.Errorf("invalid read preference %q: %w", *f.readPreference, err)
+		}
+		rp, err := readpref.New(mode)
+		if err != nil {
+			return nil, fmt.Errorf("invalid read preference %q: %w", *f.readPreference, err)
+		}
+		opts.SetReadPreference(rp)
+	}
+
+	if *f.authSource != "" || *f.authMechanism != "" {
+		// Keep any username and password from the URI; only the source and mechanism change.
+		cred := options.Credential{}
+		if opts.Auth != nil {
+			cred = *opts.Auth
+		}
+		if *f.authSource != "" {
+			cred.AuthSource = *f.authSource
+		}
+		if *f.authMechanism != "" {
+			cred.AuthMechanism = *f.authMechanism
+		}
+		opts.SetAuth(cred)
+	}
+
+	if *f.tlsCAFile != "" || *f.tlsCertificateKeyFile != "" || *f.tlsInsecure {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if opts.TLSConfig != nil {
+			tlsConfig = opts.TLSConfig.Clone()
+		}
+		if *f.tlsCAFile != "" {
+			pool, err := loadCAFile(*f.tlsCAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if *f.tlsCertificateKeyFile != "" {
+			pem, err := os.ReadFile(*f.tlsCertificateKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read client certificate: %w", err)
+			}
+			// The file holds both the certificate and the key; each parse skips the other's blocks.
+			cert, err := tls.X509KeyPair(pem, pem)
+			if err != nil {
+				return nil, fmt.Errorf("could not load client certificate from %s: %w", *f.tlsCertificateKeyFile, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		if *f.tlsInsecure {
+			tlsConfig.InsecureSkipVerify = true
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	return opts, nil
+}
+
+// describeWriteConcern formats a write concern for logs and reports, e.g.
+// "w=majority journal=true wtimeout=5s". Unset parts are left out; a nil or empty
+// concern is the server's default.
+func describeWriteConcern(wc *writeconcern.WriteConcern) string {
+	if wc == nil {
+		return "server default"
+	}
+	var parts []string
+	if wc.W != nil {
+		parts = append(parts, fmt.Sprintf("w=%v", wc.W))
+	}
+	if wc.Journal != nil {
+		parts = append(parts, fmt.Sprintf("journal=%t", *wc.Journal))
+	}
+	if wc.WTimeout > 0 {
+		parts = append(parts, "wtimeout="+wc.WTimeout.String())
+	}
+	if len(parts) == 0 {
+		return "server default"
+	}
+	return strings.Join(parts, " ")
+}
+
+// loadCAFile reads a PEM bundle of CA certificates.
+func loadCAFile(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How a CSV row or stored document compares.
+const (
+	diffNew       = "new"       // the row's key is not in the collection
+	diffChanged   = "changed"   // loading the row would change the stored document
+	diffUnchanged = "unchanged" // the stored document already matches the row
+	diffMissing   = "missing"   // the stored document's key is not in the file
+)
+
+// diffLookupBatch is how many CSV rows are looked up in the collection with one query.
+const diffLookupBatch = 500
+
+// fieldDiff is one field whose value would change. Before or After is nil when the
+// field is absent on that side.
+type fieldDiff struct {
+	Field  string  `json:"field"`
+	Before *string `json:"before"`
+	After  *string `json:"after"`
+}
+
+// rowDiff is one entry of the detailed diff.
+type rowDiff struct {
+	Status string            `json:"status"`
+	Line   int               `json:"line,omitempty"` // 0 for documents missing from the file
+	Key    map[string]string `json:"key"`
+	Fields []fieldDiff       `json:"fields,omitempty"`
+}
+
+// diffSummary counts rows and documents by how they compare.
+type diffSummary struct {
+	New       int64 `json:"new"`
+	Changed   int64 `json:"changed"`
+	Unchanged int64 `json:"unchanged"`
+	Missing   int64 `json:"missing"`
+	// Duplicate counts rows whose key an earlier row already had; they are not compared.
+	Duplicate int64 `json:"duplicate"`
+	// Rejected counts rows the importer would reject before writing them.
+	Rejected int64 `json:"rejected"`
+}
+
+// differ compares CSV rows with the documents of a collection by key.
+type differ struct {
+	coll       *mongo.Collection
+	keyColumns []string
+	headers    []string
+	ignore     []string // fields left out of the comparison, with their subfields
+	seen       map[string]bool
+	summary    diffSummary
+	emit       func(rowDiff) error // receives every difference; unchanged rows are only counted
+}
+
+// keyFields formats the key of doc for the detailed diff.
+func (d *differ) keyFields(doc bson.M) map[string]string {
+	key := make(map[string]string, len(d.keyColumns))
+	for _, c := range d.keyColumns {
+		key[c], _ = formatValue(fieldValue(doc, c))
+	}
+	return key
+}
+
+// ignored reports whether field is left out of the comparison. The lineage stamp and,
+// unless the file has an _id column, the _id are generated by the importer.
+func (d *differ) ignored(field string) bool {
+	for _, f := range d.ignore {
+		if field == f || strings.HasPrefix(field, f+".") {
+			return true
+		}
+	}
+	if field == "_id" {
+		return !slices.Contains(d.headers, "_id")
+	}
+	return field == lineageField || strings.HasPrefix(field, lineageField+".")
+}
+
+// compareRow returns what loading row over stored (a flattened document) would change.
+// A load replaces the whole document, so stored fields the file has no column for
+// would be removed.
+func (d *differ) compareRow(stored bson.D, row bson.M) []fieldDiff {
+	var diffs []fieldDiff
+	storedValues := make(map[string]any, len(stored))
+	for _, e := range stored {
+		storedValues[e.Key] = e.Value
+	}
+	for _, h := range d.headers {
+		if d.ignored(h) {
+			continue
+		}
+		after, inRow := row[h]
+		before, inStored := storedValues[h]
+		if inRow == inStored && (!inRow || valuesEqual(before, after)) {
+			continue
+		}
+		diffs = append(diffs, newFieldDiff(h, before, inStored, after, inRow))
+	}
+	for _, e := range stored {
+		if !slices.Contains(d.headers, e.Key) && !d.ignored(e.Key) {
+			diffs = append(diffs, newFieldDiff(e.Key, e.Value, true, nil, false))
+		}
+	}
+	return diffs
+}
+
+// newFieldDiff describes a changed field, formatting its values as the export does.
+func newFieldDiff(field string, before any, hasBefore bool, after any, hasAfter bool) fieldDiff {
+	diff := fieldDiff{Field: field}
+	if hasBefore {
+		s, _ := formatValue(before)
+		diff.Before = &s
+	}
+	if hasAfter {
+		s, _ := formatValue(after)
+		diff.After = &s
+	}
+	return diff
+}
+
+// valuesEqual reports whether a stored value equals a row value, type included.
+func valuesEqual(stored, row any) bool {
+	if dt, ok := stored.(primitive.DateTime); ok {
+		stored = dt.Time()
+	}
+	if t, ok := stored.(time.Time); ok {
+		rt, ok := row.(time.Time)
+		return ok && t.Equal(rt)
+	}
+	return reflect.DeepEqual(stored, row)
+}
+
+// compare looks rows up in the collection by key and classifies each of them.
+func (d *differ) compare(ctx context.Context, rows []pendingRow) error {
+	filters := make(bson.A, 0, len(rows))
+	for _, row := range rows {
+		filters = append(filters, keyFilter(d.keyColumns, row.doc))
+	}
+	cursor, err := d.coll.Find(ctx, bson.M{"$or": filters})
+	if err != nil {
+		return fmt.Errorf("could not look up rows in %s: %w", d.coll.Name(), err)
+	}
+	defer cursor.Close(ctx)
+	stored := map[string]bson.D{}
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err := cursor.Decode(&doc); err != nil {
+			return fmt.Errorf("could not decode document: %w", err)
+		}
+		flat := bson.D{}
+		flattenDocument("", doc, &flat)
+		key, err := keyString(d.keyColumns, flatMap(flat))
+		if err != nil {
+			return err
+		}
+		stored[key] = flat
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("could not look up rows in %s: %w", d.coll.Name(), err)
+	}
+
+	for _, row := range rows {
+		key, err := keyString(d.keyColumns, row.doc)
+		if err != nil {
+			return err
+		}
+		diff := rowDiff{Line: row.line, Key: d.keyFields(row.doc)}
+		if doc, ok := stored[key]; !ok {
+			diff.Status = diffNew
+			d.summary.New++
+		} else if diff.Fields = d.compareRow(doc, row.doc); len(diff.Fields) > 0 {
+			diff.Status = diffChanged
+			d.summary.Changed++
+		} else {
+			d.summary.Unchanged++
+			continue
+		}
+		if err := d.emit(diff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add queues row for comparison, unless an earlier row had the same key.
+func (d *differ) add(row pendingRow, pending *[]pendingRow) error {
+	key, err := keyString(d.keyColumns, row.doc)
+	if err != nil {
+		return err
+	}
+	if d.seen[key] {
+		d.summary.Duplicate++
+		slog.Warn("Row has the same key as an earlier row; only the first is compared",
+			"stage", "diff", "line", row.line, "key", d.keyFields(row.doc))
+		return nil
+	}
+	d.seen[key] = true
+	*pending = append(*pending, row)
+	return nil
+}
+
+// findMissing reports the documents whose key no row had.
+func (d *differ) findMissing(ctx context.Context) error {
+	projection := bson.M{}
+	for _, c := range d.keyColumns {
+		projection[c] = 1
+	}
+	cursor, err := d.coll.Find(ctx, bson.D{}, options.Find().SetProjection(projection))
+	if err != nil {
+		return fmt.Errorf("could not read keys of %s: %w", d.coll.Name(), err)
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err := cursor.Decode(&doc); err != nil {
+			return fmt.Errorf("could not decode document: %w", err)
+		}
+		flat := bson.D{}
+		flattenDocument("", doc, &flat)
+		m := flatMap(flat)
+		key, err := keyString(d.keyColumns, m)
+		if err != nil {
+			return err
+		}
+		if d.seen[key] {
+			continue
+		}
+		d.summary.Missing++
+		if err := d.emit(rowDiff{Status: diffMissing, Key: d.keyFields(m)}); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("could not read keys of %s: %w", d.coll.Name(), err)
+	}
+	return nil
+}
+
+// flatMap indexes a flattened document by field.
+func flatMap(flat bson.D) bson.M {
+	m := make(bson.M, len(flat))
+	for _, e := range flat {
+		m[e.Key] = e.Value
+	}
+	return m
+}
+
+// diffFile compares the CSV file at path with d's collection, building each row's
+// document as the importer would (with converter, if not nil).
+func diffFile(ctx context.Context, d *differ, path string, converter func([]string, []string) (bson.M, error)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open CSV file %s: %w", path, err)
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	headers, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("could not read header from CSV %s: %w", path, err)
+	}
+	if missing := missingColumns(headers, d.keyColumns); len(missing) > 0 {
+		return fmt.Errorf("key columns %v are not in the CSV header", missing)
+	}
+	d.headers = headers
+
+	var pending []pendingRow
+	for {
+		fields, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			d.summary.Rejected++
+			slog.Warn("Skipping unreadable CSV record", "stage", "read", "file", path, "line", parseErr.StartLine, "error", err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading CSV %s: %w", path, err)
+		}
+		line, _ := reader.FieldPos(0) // Only valid for a record that was read
+		if len(fields) != len(headers) {
+			d.summary.Rejected++
+			slog.Warn("Skipping record: number of fields does not match header count", "stage", "read", "file", path, "line", line)
+			continue
+		}
+		doc, err := converter(headers, fields)
+		if err != nil {
+			d.summary.Rejected++
+			slog.Warn("Skipping record: value does not match schema", "stage", "transform", "file", path, "line", line, "error", err)
+			continue
+		}
+		if err := d.add(pendingRow{line: line, doc: doc}, &pending); err != nil {
+			return err
+		}
+		if len(pending) >= diffLookupBatch {
+			if err := d.compare(ctx, pending); err != nil {
+				return err
+			}
+			pending = pending[:0]
+		}
+	}
+	if len(pending) > 0 {
+		if err := d.compare(ctx, pending); err != nil {
+			return err
+		}
+	}
+	return d.findMissing(ctx)
+}
+
+// newDiffEncoder returns a function writing differences to w, as CSV (one line per
+// changed field) if format is "csv" and as JSON lines otherwise.
+func newDiffEncoder(w io.Writer, format string, keyColumns []string) (emit func(rowDiff) error, flush func() error, err error) {
+	if format != "csv" {
+		enc := json.NewEncoder(w)
+		return func(r rowDiff) error { return enc.Encode(r) }, func() error { return nil }, nil
+	}
+	writer := csv.NewWriter(w)
+	header := append(append([]string{"status", "line"}, keyColumns...), "field", "before", "after")
+	if err := writer.Write(header); err != nil {
+		return nil, nil, fmt.Errorf("could not write diff header: %w", err)
+	}
+	str := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	emit = func(r rowDiff) error {
+		record := []string{r.Status, ""}
+		if r.Line > 0 {
+			record[1] = fmt.Sprint(r.Line)
+		}
+		for _, c := range keyColumns {
+			record = append(record, r.Key[c])
+		}
+		if len(r.Fields) == 0 {
+			return writer.Write(append(record, "", "", ""))
+		}
+		for _, f := range r.Fields {
+			if err := writer.Write(append(slices.Clone(record), f.Field, str(f.Before), str(f.After))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	flush = func() error {
+		writer.Flush()
+		return writer.Error()
+	}
+	return emit, flush, nil
+}
+
+// runDiff implements the diff subcommand and returns the process exit code.
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	connFlags := registerConnFlags(fs)
+	dbNamePtr := fs.String("dbName", "bulkcsv", "MongoDB database name.")
+	collectionNamePtr := fs.String("collectionName", "processed_data", "Collection to compare the file with.")
+	csvFilePtr := fs.String("csvFile", "input.csv", "Path to the CSV file to compare.")
+	keyColumnsPtr := fs.String("keyColumns", "", "Comma-separated columns identifying a document (required).")
+	configPtr := fs.String("config", "", "Job config whose schema section types the file's values, as for the import.")
+	ignoreFieldsPtr := fs.String("ignoreFields", "", "Comma-separated fields left out of the comparison, e.g. updatedAt.")
+	outPtr := fs.String("out", "", "Write every difference to this file: CSV if it ends in .csv, else JSON lines.")
+	logFlags := registerLogFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	keyColumns, err := parseWriteMode("upsert", *keyColumnsPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "diff: -keyColumns is required")
+		fs.Usage()
+		return 2
+	}
+	var ignore []string
+	for _, f := range strings.Split(*ignoreFieldsPtr, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			ignore = append(ignore, f)
+		}
+	}
+	if _, err := connFlags.clientOptions(); err != nil {
+		fmt.Fprintln(os.Stderr, redact(err.Error()))
+		return 2
+	}
+	logger, _, err := logFlags.newLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	slog.SetDefault(logger)
+
+	cfg := &jobConfig{}
+	if *configPtr != "" {
+		if cfg, err = loadJobConfig(*configPtr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	// Rows are built as the importer builds them, so only real changes show.
+	converter := func(headers, fields []string) (bson.M, error) {
+		doc := bson.M{}
+		for j, h := range headers {
+			doc[h] = fields[j]
+		}
+		return doc, nil
+	}
+	if cfg.Schema != nil {
+		var rc *rowConverter
+		converter = func(headers, fields []string) (bson.M, error) {
+			if rc == nil {
+				rc = newRowConverter(cfg.Schema, headers)
+			}
+			return rc.document(headers, fields)
+		}
+	}
+
+	ctx := context.Background()
+	client, err := connectToDB(ctx, connFlags)
+	if err != nil {
+		slog.Error("MongoDB connection error", "stage", "connect", "error", err)
+		return 1
+	}
+	defer func() {
+		if err := client.Disconnect(context.TODO()); err != nil {
+			slog.Error("Error disconnecting from MongoDB", "stage", "finalize", "error", err)
+		}
+	}()
+
+	d := &differ{
+		coll:       client.Database(*dbNamePtr).Collection(*collectionNamePtr),
+		keyColumns: keyColumns,
+		ignore:     ignore,
+		seen:       map[string]bool{},
+		emit:       func(rowDiff) error { return nil },
+	}
+	run := func() error { return diffFile(ctx, d, *csvFilePtr, converter) }
+	if *outPtr != "" {
+		format := "json"
+		if strings.EqualFold(filepath.Ext(*outPtr), ".csv") {
+			format = "csv"
+		}
+		run = func() error {
+			return createAtomically(*outPtr, func(w io.Writer) error {
+				emit, flush, err := newDiffEncoder(w, format, keyColumns)
+				if err != nil {
+					return err
+				}
+				d.emit = emit
+				if err := diffFile(ctx, d, *csvFilePtr, converter); err != nil {
+					return err
+				}
+				if err := flush(); err != nil {
+					return fmt.Errorf("could not write diff %s: %w", *outPtr, err)
+				}
+				return nil
+			})
+		}
+	}
+	if err := run(); err != nil {
+		slog.Error("Diff failed", "stage", "diff", "file", *csvFilePtr, "collection", *collectionNamePtr, "error", err)
+		return 1
+	}
+	s := d.summary
+	slog.Info("Diff summary", "stage", "finalize", "file", *csvFilePtr, "collection", *collectionNamePtr,
+		"new", s.New, "changed", s.Changed, "unchanged", s.Unchanged, "missing", s.Missing,
+		"duplicate", s.Duplicate, "rejected", s.Rejected, "out", *outPtr)
+	return 0
+}
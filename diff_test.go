@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestDiffFile(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	path := filepath.Join(t.TempDir(), "people.csv")
+	data := "id,name,score\n1,Ada,10\n2,Alan,12\n3,Grace,9\n2,Dup,1\n5,short\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	asStrings := func(headers, fields []string) (bson.M, error) {
+		doc := bson.M{}
+		for j, h := range headers {
+			doc[h] = fields[j]
+		}
+		return doc, nil
+	}
+
+	mt.Run("Summary", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "bulkcsv.people", mtest.FirstBatch,
+				bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "id", Value: "1"}, {Key: "name", Value: "Ada"}, {Key: "score", Value: "10"}},
+				bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "id", Value: "2"}, {Key: "name", Value: "Alan"}, {Key: "score", Value: "11"}, {Key: "email", Value: "alan@example.com"}},
+			),
+			mtest.CreateCursorResponse(0, "bulkcsv.people", mtest.FirstBatch,
+				bson.D{{Key: "id", Value: "1"}}, bson.D{{Key: "id", Value: "2"}}, bson.D{{Key: "id", Value: "4"}},
+			),
+		)
+		var out bytes.Buffer
+		emit, flush, err := newDiffEncoder(&out, "csv", []string{"id"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &differ{coll: mt.Coll, keyColumns: []string{"id"}, seen: map[string]bool{}, emit: emit}
+		if err := diffFile(context.Background(), d, path, asStrings); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if err := flush(); err != nil {
+			t.Fatal(err)
+		}
+		want := diffSummary{New: 1, Changed: 1, Unchanged: 1, Missing: 1, Duplicate: 1, Rejected: 1}
+		if d.summary != want {
+			t.Errorf("Expected %+v, got %+v", want, d.summary)
+		}
+		wantOut := strings.Join([]string{
+			"status,line,id,field,before,after",
+			"changed,3,2,score,11,12",
+			"changed,3,2,email,alan@example.com,", // a load would drop the field
+			"new,4,3,,,",
+			"missing,,4,,,",
+		}, "\n") + "\n"
+		if out.String() != wantOut {
+			t.Errorf("Expected %q, got %q", wantOut, out.String())
+		}
+	})
+
+	mt.Run("MalformedFirstField", func(mt *mtest.T) {
+		malformed := filepath.Join(t.TempDir(), "malformed.csv")
+		if err := os.WriteFile(malformed, []byte("id,name\n1,Ada\nx\"2,Alan\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "bulkcsv.people", mtest.FirstBatch,
+				bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "id", Value: "1"}, {Key: "name", Value: "Ada"}}),
+			mtest.CreateCursorResponse(0, "bulkcsv.people", mtest.FirstBatch, bson.D{{Key: "id", Value: "1"}}),
+		)
+		d := &differ{coll: mt.Coll, keyColumns: []string{"id"}, seen: map[string]bool{}, emit: func(rowDiff) error { return nil }}
+		if err := diffFile(context.Background(), d, malformed, asStrings); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if want := (diffSummary{Unchanged: 1, Rejected: 1}); d.summary != want {
+			t.Errorf("Expected %+v, got %+v", want, d.summary)
+		}
+	})
+
+	mt.Run("MissingKeyColumn", func(mt *mtest.T) {
+		d := &differ{coll: mt.Coll, keyColumns: []string{"email"}, seen: map[string]bool{}, emit: func(rowDiff) error { return nil }}
+		if err := diffFile(context.Background(), d, path, asStrings); err == nil {
+			t.Errorf("Expected an error for a key column not in the header")
+		}
+	})
+}
+
+func TestValuesEqual(t *testing.T) {
+	at := time.Date(2024, 3, 5, 14, 30, 0, 0, time.UTC)
+	if !valuesEqual(primitive.NewDateTimeFromTime(at), at) {
+		t.Errorf("Expected a stored date to equal the same parsed time")
+	}
+	if valuesEqual(int32(5), "5") {
+		t.Errorf("Expected values of different types to differ")
+	}
+	if !valuesEqual(int32(5), int32(5)) {
+		t.Errorf("Expected equal values to be equal")
+	}
+}
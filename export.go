@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/yaml.v3"
+)
+
+// exportDateLayout formats dates in an export: RFC 3339 in UTC to the millisecond,
+// the precision of a BSON date, which the importer's date type parses back.
+const exportDateLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// flattenDocument appends the fields of doc to out, naming the fields of nested
+// documents by their dotted path (address.city).
+func flattenDocument(prefix string, doc any, out *bson.D) {
+	switch d := doc.(type) {
+	case bson.D:
+		for _, e := range d {
+			flattenValue(prefix+e.Key, e.Value, out)
+		}
+	case bson.M:
+		keys := make([]string, 0, len(d))
+		for k := range d {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys) // A map has no field order of its own
+		for _, k := range keys {
+			flattenValue(prefix+k, d[k], out)
+		}
+	}
+}
+
+// flattenValue appends the field name with value to out, flattening it if it is a document.
+func flattenValue(name string, value any, out *bson.D) {
+	switch value.(type) {
+	case bson.D, bson.M:
+		flattenDocument(name+".", value, out)
+	default:
+		*out = append(*out, bson.E{Key: name, Value: value})
+	}
+}
+
+// formatValue renders a BSON value as a CSV field. Scalars are written the way the
+// importer's schema types parse them; anything else (arrays, binary data, ...) is
+// written as canonical extended JSON.
+func formatValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return "", nil
+	case string:
+		return v, nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case primitive.Decimal128:
+		return v.String(), nil
+	case primitive.ObjectID:
+		return v.Hex(), nil
+	case primitive.DateTime:
+		return v.Time().UTC().Format(exportDateLayout), nil
+	case time.Time:
+		return v.UTC().Format(exportDateLayout), nil
+	}
+	typ, data, err := bson.MarshalValue(value)
+	if err != nil {
+		return "", fmt.Errorf("could not encode %v: %w", value, err)
+	}
+	return bson.RawValue{Type: typ, Value: data}.String(), nil
+}
+
+// valueSchemaType returns the schema type that loads value back as the same BSON
+// type, or "" if none does (arrays and the other types written as extended JSON).
+func valueSchemaType(value any) string {
+	switch value.(type) {
+	case string:
+		return typeString
+	case int32:
+		return typeInt
+	case int64:
+		return typeLong
+	case float64:
+		return typeDouble
+	case bool:
+		return typeBool
+	case primitive.Decimal128:
+		return typeDecimal
+	case primitive.ObjectID:
+		return typeObjectID
+	case primitive.DateTime, time.Time:
+		return typeDate
+	}
+	return ""
+}
+
+// discoverColumns derives the export's columns from sampled (flattened) documents,
+// in the order fields are first seen, along with the schema that loads them back:
+// a column gets the type of its values if they all have the same one, else string.
+// Only scalars keep their type; arrays and mixed columns load back as text, and
+// null or missing fields as an empty string or no field, depending on the type.
+func discoverColumns(docs []bson.D) ([]string, *schemaConfig) {
+	var columns []string
+	types := map[string]string{}
+	for _, doc := range docs {
+		for _, e := range doc {
+			typ := valueSchemaType(e.Value)
+			if _, isNull := e.Value.(primitive.Null); e.Value == nil || isNull {
+				typ = "" // No evidence either way
+			}
+			prev, seen := types[e.Key]
+			switch {
+			case !seen:
+				columns = append(columns, e.Key)
+				types[e.Key] = typ
+			case prev == "":
+				types[e.Key] = typ
+			case typ != "" && typ != prev:
+				types[e.Key] = typeString
+			}
+		}
+	}
+	schema := &schemaConfig{}
+	for _, c := range columns {
+		typ := types[c]
+		if typ == "" {
+			typ = typeString
+		}
+		schema.Columns = append(schema.Columns, columnSpec{Name: c, Type: typ})
+	}
+	return columns, schema
+}
+
+// exportResult counts what an export wrote.
+type exportResult struct {
+	Rows int64
+	// Truncated counts documents with fields outside the columns, which were left out.
+	Truncated int64
+}
+
+// exportCSV streams the documents of cursor to w as CSV. With no columns, they are
+// discovered from the first sampleDocs documents, and the schema loading them back
+// is returned.
+func exportCSV(ctx context.Context, cursor *mongo.Cursor, w io.Writer, columns []string, sampleDocs int) (exportResult, *schemaConfig, error) {
+	var result exportResult
+	var sample []bson.D
+	// next returns the cursor's next document, flattened, or false at the end.
+	next := func() (bson.D, bool, error) {
+		if !cursor.Next(ctx) {
+			return nil, false, cursor.Err()
+		}
+		var doc bson.D
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, false, fmt.Errorf("could not decode document: %w", err)
+		}
+		flat := bson.D{}
+		flattenDocument("", doc, &flat)
+		return flat, true, nil
+	}
+
+	var schema *schemaConfig
+	if columns == nil {
+		for len(sample) < sampleDocs {
+			doc, ok, err := next()
+			if err != nil {
+				return result, nil, err
+			}
+			if !ok {
+				break
+			}
+			sample = append(sample, doc)
+		}
+		columns, schema = discoverColumns(sample)
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(columns); err != nil {
+		return result, nil, fmt.Errorf("could not write CSV header: %w", err)
+	}
+	index := make(map[string]int, len(columns))
+	for i, c := range columns {
+		index[c] = i
+	}
+	record := make([]string, len(columns))
+	write := func(doc bson.D) error {
+		clear(record)
+		truncated := false
+		for _, e := range doc {
+			i, ok := index[e.Key]
+			if !ok {
+				truncated = true
+				continue
+			}
+			field, err := formatValue(e.Value)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", e.Key, err)
+			}
+			record[i] = field
+		}
+		if truncated {
+			result.Truncated++
+		}
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("could not write CSV record: %w", err)
+		}
+		result.Rows++
+		return nil
+	}
+
+	for _, doc := range sample {
+		if err := write(doc); err != nil {
+			return result, nil, err
+		}
+	}
+	for {
+		doc, ok, err := next()
+		if err != nil {
+			return result, nil, err
+		}
+		if !ok {
+			break
+		}
+		if err := write(doc); err != nil {
+			return result, nil, err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return result, nil, fmt.Errorf("could not write CSV: %w", err)
+	}
+	return result, schema, nil
+}
+
+// parseExtJSONDocument parses a flag given as an extended JSON document, keeping its
+// field order, which matters for -sort.
+func parseExtJSONDocument(name, value string) (bson.D, error) {
+	var doc bson.D
+	if strings.TrimSpace(value) == "" {
+		return doc, nil
+	}
+	if err := bson.UnmarshalExtJSON([]byte(value), false, &doc); err != nil {
+		return nil, fmt.Errorf("invalid -%s: %w", name, err)
+	}
+	return doc, nil
+}
+
+// createAtomically calls write with a temporary file next to path and renames it to
+// path once write succeeds, so a failed export never leaves a partial file behind.
+func createAtomically(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("could not create %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+	buf := bufio.NewWriter(tmp)
+	if err := write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not write %s: %w", path, err)
+	}
+	return nil
+}
+
+// runExport implements the export subcommand and returns the process exit code.
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	connFlags := registerConnFlags(fs)
+	dbNamePtr := fs.String("dbName", "bulkcsv", "MongoDB database name.")
+	var collectionName string
+	fs.StringVar(&collectionName, "collectionName", "processed_data", "Collection to export.")
+	fs.StringVar(&collectionName, "collection", "processed_data", "Shorthand for -collectionName.")
+	queryPtr := fs.String("query", "{}", "Filter selecting the documents to export, as extended JSON.")
+	projectionPtr := fs.String("projection", "", "Projection applied to the exported documents, as extended JSON.")
+	sortPtr := fs.String("sort", "", "Sort order of the exported documents, as extended JSON, e.g. '{\"ts\": 1}'.")
+	limitPtr := fs.Int64("limit", 0, "Export at most this many documents. 0 exports all of them.")
+	outPtr := fs.String("out", "", "CSV file to write. Standard output if empty.")
+	configPtr := fs.String("config", "", "Job config whose schema section gives the columns, in order.")
+	sampleDocsPtr := fs.Int("sampleDocs", 1000, "Documents sampled to discover the columns when -config has no schema.")
+	schemaOutPtr := fs.String("schemaOut", "", "Write a job config whose schema loads the discovered scalar columns back with their types.")
+	logFlags := registerLogFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	filter, err := parseExtJSONDocument("query", *queryPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if filter == nil {
+		filter = bson.D{} // Everything
+	}
+	projection, err := parseExtJSONDocument("projection", *projectionPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	sort, err := parseExtJSONDocument("sort", *sortPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *sampleDocsPtr < 1 {
+		fmt.Fprintln(os.Stderr, "export: -sampleDocs must be at least 1")
+		return 2
+	}
+	if _, err := connFlags.clientOptions(); err != nil {
+		fmt.Fprintln(os.Stderr, redact(err.Error()))
+		return 2
+	}
+	logger, _, err := logFlags.newLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	slog.SetDefault(logger)
+
+	var columns []string
+	if *configPtr != "" {
+		cfg, err := loadJobConfig(*configPtr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if cfg.Schema != nil {
+			columns = cfg.Schema.columnNames()
+		}
+	}
+	if columns != nil && *schemaOutPtr != "" {
+		fmt.Fprintln(os.Stderr, "export: -schemaOut only applies to discovered columns, not a -config schema")
+		return 2
+	}
+
+	ctx := context.Background()
+	client, err := connectToDB(ctx, connFlags)
+	if err != nil {
+		slog.Error("MongoDB connection error", "stage", "connect", "error", err)
+		return 1
+	}
+	defer func() {
+		if err := client.Disconnect(context.TODO()); err != nil {
+			slog.Error("Error disconnecting from MongoDB", "stage", "finalize", "error", err)
+		}
+	}()
+
+	findOpts := options.Find().SetLimit(*limitPtr)
+	if projection != nil {
+		findOpts.SetProjection(projection)
+	}
+	if sort != nil {
+		findOpts.SetSort(sort)
+	}
+	coll := client.Database(*dbNamePtr).Collection(collectionName)
+	cursor, err := coll.Find(ctx, filter, findOpts)
+	if err != nil {
+		slog.Error("Could not query collection", "stage", "read", "collection", collectionName, "error", err)
+		return 1
+	}
+	defer cursor.Close(ctx)
+
+	var result exportResult
+	var schema *schemaConfig
+	export := func(w io.Writer) error {
+		var err error
+		result, schema, err = exportCSV(ctx, cursor, w, columns, *sampleDocsPtr)
+		return err
+	}
+	if *outPtr == "" {
+		out := bufio.NewWriter(os.Stdout)
+		err = export(out)
+		if flushErr := out.Flush(); err == nil && flushErr != nil {
+			err = fmt.Errorf("could not write to standard output: %w", flushErr)
+		}
+	} else {
+		err = createAtomically(*outPtr, export)
+	}
+	if err != nil {
+		slog.Error("Export failed", "stage", "write", "collection", collectionName, "rows", result.Rows, "error", err)
+		return 1
+	}
+	if result.Truncated > 0 {
+		slog.Warn("Documents had fields not among the columns; those fields were not exported. Raise -sampleDocs or list the columns in a schema",
+			"stage", "write", "documents", result.Truncated)
+	}
+	if *schemaOutPtr != "" {
+		data, err := yaml.Marshal(struct {
+			Schema *schemaConfig `yaml:"schema"`
+		}{schema})
+		if err == nil {
+			err = os.WriteFile(*schemaOutPtr, data, 0o644)
+		}
+		if err != nil {
+			slog.Error("Could not write schema", "stage", "finalize", "path", *schemaOutPtr, "error", err)
+			return 1
+		}
+	}
+	slog.Info("Export finished", "stage", "finalize", "db", *dbNamePtr, "collection", collectionName,
+		"rows", result.Rows, "out", *outPtr)
+	return 0
+}
+
+// checkDottedColumns checks that dotted column names can be nested by -unflatten:
+// no empty path segments, and no column that is also the parent of another.
+func checkDottedColumns(headers []string) error {
+	for _, h := range headers {
+		if slices.Contains(strings.Split(h, "."), "") {
+			return fmt.Errorf("column %q has an empty path segment", h)
+		}
+		for _, other := range headers {
+			if strings.HasPrefix(other, h+".") {
+				return fmt.Errorf("column %s is also the parent of column %s", h, other)
+			}
+		}
+	}
+	return nil
+}
+
+// unflattenDocument nests the fields of doc with dotted names (address.city) into
+// subdocuments, the reverse of an export's flattening.
+func unflattenDocument(doc bson.M) {
+	for key, value := range doc {
+		if !strings.Contains(key, ".") {
+			continue
+		}
+		delete(doc, key)
+		path := strings.Split(key, ".")
+		parent := doc
+		for _, p := range path[:len(path)-1] {
+			child, ok := parent[p].(bson.M)
+			if !ok {
+				child = bson.M{}
+				parent[p] = child
+			}
+			parent = child
+		}
+		parent[path[len(path)-1]] = value
+	}
+}
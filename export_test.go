@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestFlattenDocument(t *testing.T) {
+	var flat bson.D
+	flattenDocument("", bson.D{
+		{Key: "name", Value: "Ada"},
+		{Key: "address", Value: bson.D{{Key: "city", Value: "London"}, {Key: "geo", Value: bson.D{{Key: "lat", Value: 51.5}}}}},
+		{Key: "tags", Value: bson.A{"a", "b"}},
+	}, &flat)
+	want := bson.D{
+		{Key: "name", Value: "Ada"},
+		{Key: "address.city", Value: "London"},
+		{Key: "address.geo.lat", Value: 51.5},
+		{Key: "tags", Value: bson.A{"a", "b"}},
+	}
+	if !reflect.DeepEqual(flat, want) {
+		t.Errorf("Expected %v, got %v", want, flat)
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	id, _ := primitive.ObjectIDFromHex("65f1a2b3c4d5e6f708091a2b")
+	dec, _ := primitive.ParseDecimal128("12.50")
+	date := primitive.NewDateTimeFromTime(time.Date(2024, 3, 5, 14, 30, 0, 0, time.UTC))
+	cases := []struct {
+		value any
+		want  string
+	}{
+		{nil, ""},
+		{"text", "text"},
+		{int32(42), "42"},
+		{int64(1) << 40, "1099511627776"},
+		{0.1, "0.1"},
+		{true, "true"},
+		{dec, "12.50"},
+		{id, "65f1a2b3c4d5e6f708091a2b"},
+		{date, "2024-03-05T14:30:00.000Z"},
+		{bson.A{int32(1), "x"}, `[{"$numberInt":"1"},"x"]`},
+	}
+	for _, c := range cases {
+		if got, err := formatValue(c.value); err != nil || got != c.want {
+			t.Errorf("Expected %v to format as %q, got %q (%v)", c.value, c.want, got, err)
+		}
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		// What the export writes, the importer's schema types load back unchanged.
+		for value, typ := range map[any]string{int32(42): typeInt, 0.1: typeDouble, dec: typeDecimal, id: typeObjectID} {
+			field, _ := formatValue(value)
+			if back, err := convertValue(field, typ, ""); err != nil || back != value {
+				t.Errorf("Expected %v to load back as %s, got %v (%v)", value, typ, back, err)
+			}
+		}
+		field, _ := formatValue(date)
+		if back, err := convertValue(field, typeDate, ""); err != nil || !back.(time.Time).Equal(date.Time()) {
+			t.Errorf("Expected %s to load back as %v, got %v (%v)", field, date.Time(), back, err)
+		}
+	})
+}
+
+func TestDiscoverColumns(t *testing.T) {
+	columns, schema := discoverColumns([]bson.D{
+		{{Key: "_id", Value: int32(1)}, {Key: "score", Value: int32(3)}, {Key: "note", Value: nil}},
+		{{Key: "_id", Value: int32(2)}, {Key: "score", Value: "n/a"}, {Key: "note", Value: "late"}, {Key: "at", Value: primitive.DateTime(0)}},
+	})
+	if want := []string{"_id", "score", "note", "at"}; !reflect.DeepEqual(columns, want) {
+		t.Errorf("Expected columns %v, got %v", want, columns)
+	}
+	want := []columnSpec{
+		{Name: "_id", Type: typeInt},
+		{Name: "score", Type: typeString}, // mixed types
+		{Name: "note", Type: typeString},
+		{Name: "at", Type: typeDate},
+	}
+	if !reflect.DeepEqual(schema.Columns, want) {
+		t.Errorf("Expected schema %v, got %v", want, schema.Columns)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	docs := []bson.D{
+		{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "Ada, Countess"}, {Key: "address", Value: bson.D{{Key: "city", Value: "London"}}}},
+		{{Key: "_id", Value: int32(2)}, {Key: "name", Value: "Alan"}, {Key: "email", Value: "alan@example.com"}},
+	}
+
+	mt.Run("Discovered", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "bulkcsv.people", mtest.FirstBatch, docs...))
+		cursor, err := mt.Coll.Find(context.Background(), bson.D{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		var out bytes.Buffer
+		result, schema, err := exportCSV(context.Background(), cursor, &out, nil, 1)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		// Only the first document is sampled, so email is not a column.
+		want := "_id,name,address.city\n1,\"Ada, Countess\",London\n2,Alan,\n"
+		if out.String() != want {
+			t.Errorf("Expected %q, got %q", want, out.String())
+		}
+		if result.Rows != 2 || result.Truncated != 1 {
+			t.Errorf("Expected 2 rows with 1 truncated, got %+v", result)
+		}
+		if len(schema.Columns) != 3 || schema.Columns[0].Type != typeInt {
+			t.Errorf("Expected a schema of 3 columns with an int _id, got %v", schema.Columns)
+		}
+	})
+
+	mt.Run("Columns", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "bulkcsv.people", mtest.FirstBatch, docs...))
+		cursor, err := mt.Coll.Find(context.Background(), bson.D{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		var out bytes.Buffer
+		if _, _, err := exportCSV(context.Background(), cursor, &out, []string{"email", "_id"}, 1); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if want := "email,_id\n,1\nalan@example.com,2\n"; out.String() != want {
+			t.Errorf("Expected %q, got %q", want, out.String())
+		}
+	})
+}
+
+func TestUnflattenDocument(t *testing.T) {
+	doc := bson.M{"name": "Ada", "address.city": "London", "address.geo.lat": 51.5}
+	unflattenDocument(doc)
+	want := bson.M{"name": "Ada", "address": bson.M{"city": "London", "geo": bson.M{"lat": 51.5}}}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("Expected %v, got %v", want, doc)
+	}
+	if got := fieldValue(doc, "address.city"); got != "London" {
+		t.Errorf("Expected the nested key column value London, got %v", got)
+	}
+
+	if err := checkDottedColumns([]string{"name", "address.city", "address.zip"}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	for _, headers := range [][]string{{"address", "address.city"}, {"address..city"}, {".name"}} {
+		if err := checkDottedColumns(headers); err == nil {
+			t.Errorf("Expected an error for %v", headers)
+		}
+	}
+}
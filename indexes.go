@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/yaml.v3"
+)
+
+// When an index from the job config is built, relative to the load.
+const (
+	indexBuildBefore = "before" // so it is enforced while loading, e.g. a unique key for upserts
+	indexBuildAfter  = "after"  // so the load does not have to maintain it row by row
+)
+
+// indexSpec is an index in the job config's indexes section.
+type indexSpec struct {
+	Name               string         `yaml:"name"`
+	Keys               indexKeys      `yaml:"keys"`
+	Unique             bool           `yaml:"unique"`
+	Sparse             bool           `yaml:"sparse"`
+	PartialFilter      map[string]any `yaml:"partialFilter"`
+	ExpireAfterSeconds *int32         `yaml:"expireAfterSeconds"` // TTL index
+	Collation          *collationSpec `yaml:"collation"`
+	// Build is before or after; when empty, unique indexes are built before the load
+	// and all others after it.
+	Build string `yaml:"build"`
+}
+
+// collationSpec is the collation of an index.
+type collationSpec struct {
+	Locale          string `yaml:"locale"`
+	Strength        int    `yaml:"strength"`
+	CaseLevel       bool   `yaml:"caseLevel"`
+	NumericOrdering bool   `yaml:"numericOrdering"`
+}
+
+// indexKeys are the fields of an index in order, each with 1, -1 or an index type
+// such as "text", "hashed" or "2dsphere". In YAML they are a mapping, whose order is kept.
+type indexKeys bson.D
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (k *indexKeys) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: index keys must be a mapping of field to direction", node.Line)
+	}
+	keys := indexKeys{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		field, value := node.Content[i].Value, node.Content[i+1]
+		var direction int
+		if err := value.Decode(&direction); err == nil {
+			if direction != 1 && direction != -1 {
+				return fmt.Errorf("line %d: direction of %s must be 1 or -1", value.Line, field)
+			}
+			keys = append(keys, bson.E{Key: field, Value: direction})
+			continue
+		}
+		switch value.Value {
+		case "text", "hashed", "2d", "2dsphere":
+			keys = append(keys, bson.E{Key: field, Value: value.Value})
+		default:
+			return fmt.Errorf("line %d: unknown index type %q for %s", value.Line, value.Value, field)
+		}
+	}
+	*k = keys
+	return nil
+}
+
+// validate checks the parts of the spec the YAML decoding cannot.
+func (s *indexSpec) validate() error {
+	if len(s.Keys) == 0 {
+		return fmt.Errorf("keys are required")
+	}
+	switch s.Build {
+	case "", indexBuildBefore, indexBuildAfter:
+	default:
+		return fmt.Errorf("build must be before or after, not %q", s.Build)
+	}
+	if s.ExpireAfterSeconds != nil && (*s.ExpireAfterSeconds < 0 || len(s.Keys) != 1) {
+		return fmt.Errorf("expireAfterSeconds needs a single-field index and a non-negative value")
+	}
+	if s.Collation != nil && s.Collation.Locale == "" {
+		return fmt.Errorf("collation needs a locale")
+	}
+	return nil
+}
+
+// name returns the index name, defaulting to the server's own naming (field_direction joined by _).
+func (s *indexSpec) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	parts := make([]string, 0, 2*len(s.Keys))
+	for _, k := range s.Keys {
+		parts = append(parts, k.Key, fmt.Sprint(k.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+// build returns when the index is built.
+func (s *indexSpec) build() string {
+	switch {
+	case s.Build != "":
+		return s.Build
+	case s.Unique:
+		return indexBuildBefore
+	default:
+		return indexBuildAfter
+	}
+}
+
+// model converts the spec to the driver's index model.
+func (s *indexSpec) model() mongo.IndexModel {
+	opts := options.Index().SetName(s.name())
+	if s.Unique {
+		opts.SetUnique(true)
+	}
+	if s.Sparse {
+		opts.SetSparse(true)
+	}
+	if s.PartialFilter != nil {
+		opts.SetPartialFilterExpression(s.PartialFilter)
+	}
+	if s.ExpireAfterSeconds != nil {
+		opts.SetExpireAfterSeconds(*s.ExpireAfterSeconds)
+	}
+	if c := s.Collation; c != nil {
+		opts.SetCollation(&options.Collation{Locale: c.Locale, Strength: c.Strength, CaseLevel: c.CaseLevel, NumericOrdering: c.NumericOrdering})
+	}
+	return mongo.IndexModel{Keys: bson.D(s.Keys), Options: opts}
+}
+
+// indexBuildStage is the log stage of an index build phase.
+func indexBuildStage(build string) string {
+	if build == indexBuildBefore {
+		return "connect"
+	}
+	return "finalize"
+}
+
+// indexResult records one index build for the run report.
+type indexResult struct {
+	Name            string  `json:"name"`
+	Collection      string  `json:"collection"`
+	Build           string  `json:"build"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// ensureIndexes builds the specs that belong to the given build phase on coll,
+// appending a result for each to results. It stops at the first failure. A unique
+// index that cannot be built because the collection holds duplicate keys is reported
+// as such. Building an index that already exists with the same definition is a no-op.
+func ensureIndexes(ctx context.Context, coll *mongo.Collection, specs []indexSpec, build string, results *[]indexResult) error {
+	for i := range specs {
+		spec := &specs[i]
+		if spec.build() != build {
+			continue
+		}
+		start := time.Now()
+		_, err := coll.Indexes().CreateOne(ctx, spec.model())
+		result := indexResult{Name: spec.name(), Collection: coll.Name(), Build: build, DurationSeconds: time.Since(start).Seconds()}
+		if err != nil {
+			if spec.Unique && mongo.IsDuplicateKeyError(err) {
+				err = fmt.Errorf("unique index %s on %s found duplicate keys: %w", spec.name(), coll.Name(), err)
+			} else {
+				err = fmt.Errorf("could not build index %s on %s: %w", spec.name(), coll.Name(), err)
+			}
+			result.Error = err.Error()
+			*results = append(*results, result)
+			return err
+		}
+		*results = append(*results, result)
+		slog.Info("Index built", "stage", indexBuildStage(build), "collection", coll.Name(), "index", result.Name,
+			"build", build, "duration", time.Duration(result.DurationSeconds*float64(time.Second)).Round(time.Millisecond).String())
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// lineageField is the document field -lineage stamps with where the document came from.
+	lineageField = "_import"
+	// runsCollectionName is the collection -auditRuns records each run in, in the target database.
+	runsCollectionName = "_import_runs"
+	// auditInterval is how often a running import refreshes its run record.
+	auditInterval = 30 * time.Second
+	// statusRunning marks a run record whose import has not finished (or crashed).
+	statusRunning = "running"
+)
+
+// secretFlags are left out of the configuration stored in run records.
+var secretFlags = map[string]bool{"mongoURI": true}
+
+// lineageStamp is the value of the _import field on a stamped document.
+type lineageStamp struct {
+	RunID    string    `bson:"runId"`
+	File     string    `bson:"file"`
+	Line     int       `bson:"line"`
+	LoadedAt time.Time `bson:"loadedAt"`
+}
+
+// ensureLineageIndex indexes the stamped run ID so lineage queries and rollbacks
+// by run do not scan the whole collection.
+func ensureLineageIndex(ctx context.Context, coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: lineageField + ".runId", Value: 1}},
+		Options: options.Index().SetName(lineageField + "_runId"),
+	})
+	if err != nil {
+		return fmt.Errorf("could not create lineage index on %s: %w", coll.Name(), err)
+	}
+	return nil
+}
+
+// runConfig captures the flag settings of a run for its run record, minus secrets.
+func runConfig(fs *flag.FlagSet) bson.M {
+	config := bson.M{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if !secretFlags[f.Name] {
+			config[f.Name] = f.Value.String()
+		}
+	})
+	return config
+}
+
+// runAuditor maintains a run's record in the _import_runs collection.
+type runAuditor struct {
+	coll      *mongo.Collection
+	runID     string
+	startedAt time.Time
+}
+
+// startRunAudit inserts the run record for a run that is starting.
+func startRunAudit(ctx context.Context, db *mongo.Database, runID string, startedAt time.Time, target string, config bson.M) (*runAuditor, error) {
+	a := &runAuditor{coll: db.Collection(runsCollectionName), runID: runID, startedAt: startedAt}
+	_, err := a.coll.InsertOne(ctx, bson.M{
+		"_id":        runID,
+		"status":     statusRunning,
+		"collection": target,
+		"config":     config,
+		"startedAt":  startedAt,
+		"updatedAt":  startedAt,
+		"counts":     rowCounts{RejectedByReason: map[string]int64{}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not record run in %s: %w", runsCollectionName, err)
+	}
+	return a, nil
+}
+
+// update refreshes the record's counts while the run is in progress.
+func (a *runAuditor) update(ctx context.Context, counts rowCounts) error {
+	now := time.Now().UTC()
+	_, err := a.coll.UpdateByID(ctx, a.runID, bson.M{"$set": bson.M{
+		"counts":          counts,
+		"updatedAt":       now,
+		"durationSeconds": now.Sub(a.startedAt).Seconds(),
+	}})
+	if err != nil {
+		return fmt.Errorf("could not update run record %s: %w", a.runID, err)
+	}
+	return nil
+}
+
+// finish records the run's final status and counts.
+func (a *runAuditor) finish(ctx context.Context, status string, exitCode int, counts rowCounts, runErr error) error {
+	now := time.Now().UTC()
+	set := bson.M{
+		"status":          status,
+		"exitCode":        exitCode,
+		"counts":          counts,
+		"updatedAt":       now,
+		"finishedAt":      now,
+		"durationSeconds": now.Sub(a.startedAt).Seconds(),
+	}
+	if runErr != nil {
+		set["error"] = redact(runErr.Error())
+	}
+	if _, err := a.coll.UpdateByID(ctx, a.runID, bson.M{"$set": set}); err != nil {
+		return fmt.Errorf("could not finish run record %s: %w", a.runID, err)
+	}
+	return nil
+}
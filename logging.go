@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// logBurst is how many identical warning/error messages are logged before rate limiting kicks in.
+	logBurst = 10
+	// logInterval is how often a rate-limited message is let through once the burst is used up.
+	logInterval = 5 * time.Second
+)
+
+// logFlags holds the logging flags shared by every subcommand.
+type logFlags struct {
+	format *string
+	level  *string
+}
+
+// registerLogFlags defines -logFormat and -logLevel on fs.
+func registerLogFlags(fs *flag.FlagSet) *logFlags {
+	return &logFlags{
+		format: fs.String("logFormat", "text", "Log output format: text or json."),
+		level:  fs.String("logLevel", "info", "Minimum log level: debug, info, warn or error."),
+	}
+}
+
+// newLogger builds a logger from the parsed flags.
+func (f *logFlags) newLogger(w io.Writer) (*slog.Logger, *rateLimitHandler, error) {
+	return newLogger(w, *f.format, *f.level)
+}
+
+// newLogger builds the program's logger writing to w. format is "text" or "json" and
+// level is any level slog understands ("debug", "info", "warn", "error").
+// Repeated warnings and errors (typically per-row failures) are rate limited.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, *rateLimitHandler, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, nil, fmt.Errorf("invalid log format %q (want text or json)", format)
+	}
+
+	limiter := newRateLimitHandler(redactHandler{handler}, logBurst, logInterval)
+	return slog.New(limiter), limiter, nil
+}
+
+// redactHandler wraps a slog.Handler and replaces registered secrets (see secrets.go)
+// in the message and every attribute, so a credential that ends up in an error or a
+// URI is never written out.
+type redactHandler struct {
+	slog.Handler
+}
+
+// Handle implements slog.Handler.
+func (h redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	if secrets.empty() {
+		return h.Handler.Handle(ctx, r)
+	}
+	out := slog.NewRecord(r.Time, r.Level, redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, out)
+}
+
+// WithAttrs implements slog.Handler.
+func (h redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redactedAttrs[i] = redactAttr(a)
+	}
+	return redactHandler{h.Handler.WithAttrs(redactedAttrs)}
+}
+
+// WithGroup implements slog.Handler.
+func (h redactHandler) WithGroup(name string) slog.Handler {
+	return redactHandler{h.Handler.WithGroup(name)}
+}
+
+// redactAttr returns a with any secret in its value replaced. Values other than
+// strings and groups are only rewritten (as strings) if their text holds a secret.
+func redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redact(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		redactedGroup := make([]any, len(group))
+		for i, g := range group {
+			redactedGroup[i] = redactAttr(g)
+		}
+		return slog.Group(a.Key, redactedGroup...)
+	case slog.KindAny:
+		text := fmt.Sprint(v.Any())
+		if r := redact(text); r != text {
+			return slog.String(a.Key, r)
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// rateLimitHandler wraps a slog.Handler and limits how often the same warning or
+// error message is written. The first burst records of each message pass through;
+// after that one record per interval is written, carrying a "suppressed" count of
+// the records dropped since the previous one. Info and debug records are never limited.
+type rateLimitHandler struct {
+	slog.Handler
+	state *rateLimitState
+}
+
+// rateLimitState is shared between a rateLimitHandler and the handlers derived from it via WithAttrs/WithGroup.
+type rateLimitState struct {
+	mu       sync.Mutex
+	burst    int
+	interval time.Duration
+	now      func() time.Time
+	messages map[string]*rateLimitEntry
+}
+
+type rateLimitEntry struct {
+	count      int
+	suppressed int
+	lastLogged time.Time
+}
+
+// newRateLimitHandler wraps next with per-message rate limiting.
+func newRateLimitHandler(next slog.Handler, burst int, interval time.Duration) *rateLimitHandler {
+	return &rateLimitHandler{
+		Handler: next,
+		state: &rateLimitState{
+			burst:    burst,
+			interval: interval,
+			now:      time.Now,
+			messages: make(map[string]*rateLimitEntry),
+		},
+	}
+}
+
+// Handle implements slog.Handler.
+func (h *rateLimitHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.Handler.Handle(ctx, r)
+	}
+
+	s := h.state
+	s.mu.Lock()
+	entry, ok := s.messages[r.Message]
+	if !ok {
+		entry = &rateLimitEntry{}
+		s.messages[r.Message] = entry
+	}
+	entry.count++
+	now := s.now()
+	if entry.count > s.burst && now.Sub(entry.lastLogged) < s.interval {
+		entry.suppressed++
+		s.mu.Unlock()
+		return nil
+	}
+	suppressed := entry.suppressed
+	entry.suppressed = 0
+	entry.lastLogged = now
+	s.mu.Unlock()
+
+	if suppressed > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("suppressed", suppressed))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler.
+func (h *rateLimitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &rateLimitHandler{Handler: h.Handler.WithAttrs(attrs), state: h.state}
+}
+
+// WithGroup implements slog.Handler.
+func (h *rateLimitHandler) WithGroup(name string) slog.Handler {
+	return &rateLimitHandler{Handler: h.Handler.WithGroup(name), state: h.state}
+}
+
+// drainSuppressed returns, per message, how many records were dropped since that
+// message was last written, and resets the counts. Callers log this at the end of
+// a run so nothing disappears silently.
+func (h *rateLimitHandler) drainSuppressed() []suppressedMessage {
+	s := h.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []suppressedMessage
+	for msg, entry := range s.messages {
+		if entry.suppressed > 0 {
+			out = append(out, suppressedMessage{Message: msg, Count: entry.suppressed})
+			entry.suppressed = 0
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Message < out[j].Message })
+	return out
+}
+
+// suppressedMessage is a message and the number of times it was not logged.
+type suppressedMessage struct {
+	Message string
+	Count   int
+}
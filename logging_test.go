@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLogger(t *testing.T) {
+	t.Run("JSON", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, _, err := newLogger(&buf, "json", "info")
+		if err != nil {
+			t.Fatalf("newLogger failed: %v", err)
+		}
+		logger.With("run_id", "abc").Info("Received CSV headers", "stage", "read", "line", 7)
+		logger.Debug("Not shown at info level")
+
+		var entry map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("Expected exactly one JSON log line, got %q: %v", buf.String(), err)
+		}
+		if entry["msg"] != "Received CSV headers" || entry["run_id"] != "abc" || entry["stage"] != "read" || entry["line"] != float64(7) {
+			t.Errorf("Unexpected log entry: %v", entry)
+		}
+	})
+
+	t.Run("InvalidFormat", func(t *testing.T) {
+		if _, _, err := newLogger(&bytes.Buffer{}, "xml", "info"); err == nil {
+			t.Errorf("Expected an error for log format xml")
+		}
+	})
+
+	t.Run("InvalidLevel", func(t *testing.T) {
+		if _, _, err := newLogger(&bytes.Buffer{}, "text", "loud"); err == nil {
+			t.Errorf("Expected an error for log level loud")
+		}
+	})
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	var buf bytes.Buffer
+	handler := newRateLimitHandler(slog.NewTextHandler(&buf, nil), 3, time.Minute)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	handler.state.now = func() time.Time { return now }
+	logger := slog.New(handler).With("run_id", "abc")
+
+	for i := 0; i < 10; i++ {
+		logger.Warn("Skipping record", "line", i)
+		logger.Info("Progress", "line", i)
+	}
+	if got := strings.Count(buf.String(), "msg=\"Skipping record\""); got != 3 {
+		t.Errorf("Expected 3 warnings within the burst, got %d", got)
+	}
+	if got := strings.Count(buf.String(), "msg=Progress"); got != 10 {
+		t.Errorf("Expected info records not to be limited, got %d of 10", got)
+	}
+
+	// Once the interval passes, one record gets through carrying the suppressed count.
+	now = now.Add(time.Minute)
+	logger.Warn("Skipping record", "line", 10)
+	if !strings.Contains(buf.String(), "suppressed=7") {
+		t.Errorf("Expected suppressed=7 on the next warning, got %q", buf.String())
+	}
+
+	logger.Warn("Skipping record", "line", 11)
+	logger.Warn("Skipping record", "line", 12)
+	suppressed := handler.drainSuppressed()
+	if len(suppressed) != 1 || suppressed[0].Message != "Skipping record" || suppressed[0].Count != 2 {
+		t.Errorf("Expected 2 suppressed \"Skipping record\" messages, got %v", suppressed)
+	}
+	if again := handler.drainSuppressed(); len(again) != 0 {
+		t.Errorf("Expected drainSuppressed to reset counts, got %v", again)
+	}
+}
@@ -3,32 +3,61 @@ package main
 import (
 	"context"
 	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
 	"io" // Added for io.EOF
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
 	"sync" // Added for WaitGroup
+	"syscall"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const (
-	logInfoPrefix  = "INFO: "
-	logErrorPrefix = "ERROR: "
-)
+// csvRecord is a data row read from the CSV file along with the line it starts on.
+type csvRecord struct {
+	line   int
+	fields []string
+}
+
+// recordError describes a CSV record that could not be read. Reading continues past it.
+type recordError struct {
+	file string
+	line int
+	err  error
+}
+
+func (e *recordError) Error() string {
+	return fmt.Sprintf("error reading record at line %d from CSV %s: %v. Skipping row", e.line, e.file, e.err)
+}
+
+func (e *recordError) Unwrap() error { return e.err }
 
 // connectToDB establishes a connection to a MongoDB server.
-func connectToDB(uri string) (*mongo.Client, error) {
-	log.Println(logInfoPrefix, "Connecting to MongoDB at", uri)
-	clientOptions := options.Client().ApplyURI(uri)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+func connectToDB(ctx context.Context, conn *connFlags) (client *mongo.Client, err error) {
+	ctx, span := tracer.Start(ctx, "connect")
+	defer func() { endSpan(span, err) }()
 
-	client, err := mongo.Connect(ctx, clientOptions)
+	clientOptions, err := conn.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Connecting to MongoDB", "stage", "connect", "uri", conn.redactedURI())
+	clientOptions.SetMonitor(otelmongo.NewMonitor())
+	// Connecting and the ping below are bounded by -connectTimeout and -serverSelectionTimeout.
+
+	client, err = mongo.Connect(ctx, clientOptions)
 	if err != nil {
 		return nil, fmt.Errorf("could not connect to MongoDB: %w", err)
 	}
@@ -39,187 +68,1266 @@ func connectToDB(uri string) (*mongo.Client, error) {
 		}
 		return nil, fmt.Errorf("could not ping MongoDB: %w", err)
 	}
-	log.Println(logInfoPrefix, "Successfully connected to MongoDB!")
+	slog.Info("Successfully connected to MongoDB", "stage", "connect")
 	return client, nil
 }
 
-// insertData inserts data into a specified collection.
-func insertData(client *mongo.Client, dbName string, collectionName string, data interface{}) (*mongo.InsertOneResult, error) {
-	collection := client.Database(dbName).Collection(collectionName)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// upsertData replaces the document matching filter with doc, inserting it if there is none.
+// With returnBefore, the replaced document is returned (nil if doc was inserted).
+func upsertData(ctx context.Context, collection *mongo.Collection, filter bson.D, doc interface{}, returnBefore bool) (bson.Raw, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	result, err := collection.InsertOne(ctx, data)
+	if !returnBefore {
+		if _, err := collection.ReplaceOne(ctx, filter, doc, options.Replace().SetUpsert(true)); err != nil {
+			return nil, fmt.Errorf("could not upsert data into %s: %w", collection.Name(), err)
+		}
+		return nil, nil
+	}
+
+	opts := options.FindOneAndReplace().SetUpsert(true).SetReturnDocument(options.Before)
+	before, err := collection.FindOneAndReplace(ctx, filter, doc, opts).Raw()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil // Nothing matched, so doc was inserted
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not upsert data into %s: %w", collection.Name(), err)
+	}
+	return before, nil
+}
+
+// parseWriteMode validates -mode and -keyColumns. It returns the key columns for
+// upsert and sync mode and nil for insert mode.
+func parseWriteMode(mode, keyColumns string) ([]string, error) {
+	var columns []string
+	for _, c := range strings.Split(keyColumns, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			columns = append(columns, c)
+		}
+	}
+	switch mode {
+	case "insert":
+		if len(columns) > 0 {
+			return nil, fmt.Errorf("-keyColumns is only used with -mode upsert or sync")
+		}
+		return nil, nil
+	case "upsert", "sync":
+		if len(columns) == 0 {
+			return nil, fmt.Errorf("-mode %s requires -keyColumns", mode)
+		}
+		return columns, nil
+	}
+	return nil, fmt.Errorf("invalid mode %q (want insert, upsert or sync)", mode)
+}
+
+// missingColumns returns the columns that are not in header.
+func missingColumns(header, columns []string) []string {
+	var missing []string
+	for _, c := range columns {
+		if !slices.Contains(header, c) {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
+
+// keyFilter builds the filter selecting the document with the same key column values as doc.
+func keyFilter(keyColumns []string, doc bson.M) bson.D {
+	filter := make(bson.D, 0, len(keyColumns))
+	for _, c := range keyColumns {
+		filter = append(filter, bson.E{Key: c, Value: fieldValue(doc, c)})
+	}
+	return filter
+}
+
+// keyString encodes the key column values of doc, types included, so rows and
+// documents can be matched by key.
+func keyString(keyColumns []string, doc bson.M) (string, error) {
+	data, err := bson.Marshal(keyFilter(keyColumns, doc))
 	if err != nil {
-		return nil, fmt.Errorf("could not insert data into %s.%s: %w", dbName, collectionName, err)
+		return "", fmt.Errorf("could not encode key: %w", err)
 	}
-	return result, nil
+	return string(data), nil
+}
+
+// fieldValue returns the value of column c in doc, following its dotted path if
+// -unflatten nested it.
+func fieldValue(doc bson.M, c string) any {
+	if v, ok := doc[c]; ok {
+		return v
+	}
+	parent, path := doc, strings.Split(c, ".")
+	for _, p := range path[:len(path)-1] {
+		child, ok := parent[p].(bson.M)
+		if !ok {
+			return nil
+		}
+		parent = child
+	}
+	return parent[path[len(path)-1]]
 }
 
 // readCSV opens and reads a CSV file record by record, sending header and data over channels.
-func readCSV(filePath string, headerChan chan<- []string, dataChan chan<- []string, errChan chan<- error, wg *sync.WaitGroup) {
+// If progress is non-nil, the file size and the bytes and rows consumed are recorded in it.
+// Cancelling ctx stops reading early; the channels are closed as usual.
+func readCSV(ctx context.Context, filePath string, progress *progressTracker, headerChan chan<- []string, dataChan chan<- csvRecord, errChan chan<- error, wg *sync.WaitGroup) {
 	defer wg.Done() // Signal that this goroutine has finished
 	defer close(headerChan)
 	defer close(dataChan)
 	// Not closing errChan from here as main might still be listening or other goroutines could use it.
 	// However, for this specific setup, main stops on first readCSV error.
 
-	log.Printf("%sOpening CSV file: %s", logInfoPrefix, filePath)
-	file, err := os.Open(filePath)
+	slog.Info("Opening CSV file", "stage", "read", "file", filePath)
+	file := os.Stdin // "-" reads a streamed file, e.g. from the serve subcommand
+	if filePath != "-" {
+		var err error
+		if file, err = os.Open(filePath); err != nil {
+			errChan <- fmt.Errorf("error opening file %s: %w", filePath, err)
+			return
+		}
+		defer file.Close()
+	}
+
+	var input io.Reader = file
+	if progress != nil {
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+			progress.totalBytes.Store(info.Size())
+		}
+		input = &countingReader{r: file, progress: progress}
+	}
+
+	reader := csv.NewReader(input)
+	reader.FieldsPerRecord = -1 // Allow variable number of fields per record
+
+	header, err := readHeader(reader, filePath)
 	if err != nil {
-		errChan <- fmt.Errorf("%serror opening file %s: %w", logErrorPrefix, filePath, err)
+		errChan <- err
+		return
+	}
+	select {
+	case headerChan <- header:
+	case <-ctx.Done():
 		return
 	}
-	defer file.Close()
 
-	reader := csv.NewReader(file)
-	reader.FieldsPerRecord = -1 // Allow variable number of fields per record
+	if readRecords(ctx, reader, filePath, 0, progress, dataChan, errChan) {
+		slog.Info("Finished reading CSV file", "stage", "read", "file", filePath)
+	}
+}
 
-	// Read header
+// readHeader reads the header record of a CSV file.
+func readHeader(reader *csv.Reader, filePath string) ([]string, error) {
 	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("CSV file %s is empty or contains only a header", filePath)
+	}
 	if err != nil {
-		if err == io.EOF {
-			errChan <- fmt.Errorf("%sCSV file %s is empty or contains only a header", logErrorPrefix, filePath)
-		} else {
-			errChan <- fmt.Errorf("%serror reading header from CSV %s: %w", logErrorPrefix, filePath, err)
-		}
-		return
+		return nil, fmt.Errorf("error reading header from CSV %s: %w", filePath, err)
 	}
-	headerChan <- header
+	return header, nil
+}
 
-	// Read records
-	lineNumber := 1 // Header was line 1
+// readRecords sends the records of reader over dataChan until the end of its input,
+// numbering their lines from lineOffset+1. Bad records are reported on errChan and
+// skipped. It returns false if reading stopped early: ctx was cancelled, or the rest
+// of the input could not be read.
+func readRecords(ctx context.Context, reader *csv.Reader, filePath string, lineOffset int, progress *progressTracker, dataChan chan<- csvRecord, errChan chan<- error) bool {
 	for {
-		lineNumber++
 		record, err := reader.Read()
 		if err != nil {
 			if err == io.EOF {
-				log.Printf("%sFinished reading CSV file %s", logInfoPrefix, filePath)
-				break // End of file
+				return true
+			}
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				// Not a problem with one record (e.g. an I/O error); the rest of the file is unreadable.
+				errChan <- fmt.Errorf("error reading CSV %s: %w", filePath, err)
+				return false
 			}
+			shiftParseError(parseErr, lineOffset)
 			// Report error for this specific line and continue
-			errChan <- fmt.Errorf("%serror reading record at line %d from CSV %s: %w. Skipping row", logErrorPrefix, lineNumber, filePath, err)
-			continue
+			select {
+			case errChan <- &recordError{file: filePath, line: parseErr.StartLine, err: err}:
+				continue
+			case <-ctx.Done():
+				return false
+			}
+		}
+		// Quoted fields may span lines, so take the line from the reader rather than counting.
+		line, _ := reader.FieldPos(0)
+		line += lineOffset
+		if progress != nil {
+			progress.rows.Add(1)
+		}
+		select {
+		case dataChan <- csvRecord{line: line, fields: record}:
+		case <-ctx.Done():
+			slog.Info("Stopped reading CSV file", "stage", "read", "file", filePath, "line", line)
+			return false
 		}
-		dataChan <- record
 	}
 }
 
+// shiftParseError renumbers the lines of a parse error in input that starts after
+// lineOffset lines of the file, so its message names the line in the file.
+func shiftParseError(err *csv.ParseError, lineOffset int) {
+	err.StartLine += lineOffset
+	err.Line += lineOffset
+}
+
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lmsgprefix) // Use standard flags + allow prefix
-	log.Println(logInfoPrefix, "Program starting...")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rollback":
+			os.Exit(runRollback(os.Args[2:]))
+		case "validator":
+			os.Exit(runValidator(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "diff":
+			os.Exit(runDiff(os.Args[2:]))
+		case "watch":
+			os.Exit(runWatch(os.Args[2:]))
+		case "serve":
+			os.Exit(runServe(os.Args[2:]))
+		case "enqueue":
+			os.Exit(runEnqueue(os.Args[2:]))
+		case "worker":
+			os.Exit(runWorker(os.Args[2:]))
+		}
+	}
+	os.Exit(run())
+}
 
+// run executes the import and returns the process exit code. It is split from main
+// so deferred cleanup (disconnecting, flushing telemetry) runs before the process exits.
+func run() (exitCode int) {
 	// Define command-line flags
 	csvFilePtr := flag.String("csvFile", "input.csv", "Path to the CSV file to process.")
-	mongoURIPtr := flag.String("mongoURI", "mongodb://localhost:27017", "MongoDB connection URI.")
+	configPtr := flag.String("config", "", "YAML job configuration file (indexes, schema, timeSeries).")
 	dbNamePtr := flag.String("dbName", "bulkcsv", "MongoDB database name.")
-	collectionNamePtr := flag.String("collectionName", "processed_data", "MongoDB collection name.")
+	collectionNamePtr := flag.String("collectionName", "processed_data", "MongoDB collection name, or a template evaluated per row such as events_{{.region}}.")
+	connFlags := registerConnFlags(flag.CommandLine)
+	logFlags := registerLogFlags(flag.CommandLine)
+	progressPtr := flag.String("progress", "auto", "Progress reporting: auto (bar on a terminal, log lines otherwise), bar, log or off.")
+	progressIntervalPtr := flag.Duration("progressInterval", 10*time.Second, "How often a progress line is logged in log mode.")
+	reportPtr := flag.String("report", "", "Write a JSON run report to this path.")
+	reportSampleErrorsPtr := flag.Int("reportSampleErrors", 100, "Maximum number of rejected rows listed in the run report.")
+	lineagePtr := flag.Bool("lineage", false, "Stamp each document with an _import field recording the run ID, file, line and load time.")
+	unflattenPtr := flag.Bool("unflatten", false, "Nest columns with dotted names (address.city) into subdocuments, as the export subcommand flattens them.")
+	auditRunsPtr := flag.Bool("auditRuns", false, "Record each run (configuration, counts, status, duration) in the _import_runs collection.")
+	modePtr := flag.String("mode", "insert", "Write mode: insert, upsert to replace documents matching -keyColumns, or sync to also delete documents the file does not have.")
+	keyColumnsPtr := flag.String("keyColumns", "", "Comma-separated columns identifying a document in upsert and sync mode.")
+	syncScopePtr := flag.String("syncScope", "", "With -mode sync, only documents matching this extended JSON filter are deleted when the file does not have them.")
+	syncMaxDeletePercentPtr := flag.Float64("syncMaxDeletePercent", 10, "With -mode sync, refuse to delete more than this percentage of the documents in scope.")
+	syncMaxDeleteCountPtr := flag.Int64("syncMaxDeleteCount", 0, "With -mode sync, allow deleting up to this many documents even above -syncMaxDeletePercent, e.g. so small collections can shrink.")
+	watermarkColumnPtr := flag.String("watermarkColumn", "", "Incremental load: skip rows whose value in this ever-growing column (a timestamp or sequence) is at or below the highest one an earlier run loaded. Compared as text unless the config's schema types the column, so a sequence that is not zero-padded needs an int or long schema type (as text 10 is below 9).")
+	watermarkSourcePtr := flag.String("watermarkSource", "", "Name the watermark is stored under in _import_watermarks. Defaults to -collectionName.")
+	resetWatermarkPtr := flag.Bool("resetWatermark", false, "Ignore the stored watermark and load every row; the watermark is then saved afresh.")
+	atomicPtr := flag.String("atomic", atomicOff, "All-or-nothing load: off, transaction (small files), swap (staging collection renamed over the target) or merge (staging collection $merged into the target).")
+	atomicMaxErrorRatePtr := flag.Float64("atomicMaxErrorRate", 0, "Highest fraction of rejected rows (0-1) at which an atomic load is still committed. With -atomic transaction only rows rejected before they are written count: a failed write aborts the transaction.")
+	maxErrorsPtr := flag.Int64("maxErrors", -1, "Abort the run once more than this many rows are rejected. Negative disables the limit.")
+	maxErrorRatePtr := flag.Float64("maxErrorRate", -1, "Abort the run once the fraction of rejected rows (0-1) exceeds this. Negative disables the limit.")
+	maxErrorRateMinRowsPtr := flag.Int64("maxErrorRateMinRows", 100, "Rows to read before -maxErrorRate is checked mid-run; it is always checked at the end.")
+	maxRetriesPtr := flag.Int("maxRetries", 5, "Times a write failing with a transient error (network, election, write concern timeout) is retried. Ignored with -atomic transaction.")
+	retryBaseDelayPtr := flag.Duration("retryBaseDelay", 100*time.Millisecond, "Upper bound of the first retry delay; it doubles with every retry.")
+	retryMaxDelayPtr := flag.Duration("retryMaxDelay", 5*time.Second, "Cap on a single retry delay.")
+	batchSizePtr := flag.Int("batchSize", 1000, "Rows written per bulk write call.")
+	writersPtr := flag.Int("writers", 1, "Bulk writes of -batchSize rows made at once. Upserted rows for one key always go to the same write. With -adaptive, the most it goes up to.")
+	maxRowsPerSecPtr := flag.Float64("maxRowsPerSec", 0, "Cap on rows written per second; 0 means no cap.")
+	maxBytesPerSecPtr := flag.Float64("maxBytesPerSec", 0, "Cap on bytes of CSV data written per second; 0 means no cap.")
+	adaptivePtr := flag.Bool("adaptive", false, "Grow the batch size (up to 10x -batchSize), then the writers (up to -writers), while writes finish within half of -adaptiveLatency, and back off when they take longer or the server pushes back.")
+	adaptiveLatencyPtr := flag.Duration("adaptiveLatency", time.Second, "Bulk write latency -adaptive keeps under.")
+	readersPtr := flag.Int("readers", 1, "Goroutines parsing the CSV file. Above 1, a regular file is split into chunks at line boundaries that are parsed at once; rows are still processed in file order.")
+	orderedPtr := flag.Bool("ordered", true, "Apply each batch in file order. Unordered batches are faster and keep going past a failed row on the server.")
+	maxOpenCollectionsPtr := flag.Int("maxOpenCollections", 64, "With a templated -collectionName, collections holding a pending batch at once; the least recently used is written out to make room.")
+	rollbackOnAbortPtr := flag.Bool("rollbackOnAbort", false, "Roll back the run's writes when the error budget aborts it. Requires -lineage unless -atomic is used.")
 
 	flag.Parse()
 
-	mongoURI := *mongoURIPtr
 	dbName := *dbNamePtr
 	collectionName := *collectionNamePtr
 	csvFilePath := *csvFilePtr
 
-	log.Printf("%sConfiguration: CSVFile='%s', MongoURI='%s', DBName='%s', CollectionName='%s'",
-		logInfoPrefix, csvFilePath, mongoURI, dbName, collectionName)
+	logger, logLimiter, err := logFlags.newLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	clientOptions, err := connFlags.clientOptions()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, redact(err.Error()))
+		return 2
+	}
+	writeConcern := describeWriteConcern(clientOptions.WriteConcern)
+	progressMode, err := resolveProgressMode(*progressPtr, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	keyColumns, err := parseWriteMode(*modePtr, *keyColumnsPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if !validAtomicMode(*atomicPtr) {
+		fmt.Fprintf(os.Stderr, "invalid atomic mode %q (want off, transaction, swap or merge)\n", *atomicPtr)
+		return 2
+	}
+	cfg := &jobConfig{}
+	if *configPtr != "" {
+		if cfg, err = loadJobConfig(*configPtr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	if cfg.TimeSeries != nil && (keyColumns != nil || *atomicPtr != atomicOff) {
+		// Time-series collections cannot be replaced into, renamed, $merged into or written in a transaction.
+		fmt.Fprintln(os.Stderr, "a timeSeries target needs -mode insert and -atomic off")
+		return 2
+	}
+	var routes *collectionTemplate // Stays nil, and every row goes to collectionName, unless it is a template
+	if isCollectionTemplate(collectionName) {
+		if routes, err = parseCollectionTemplate(dbName, collectionName); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if *atomicPtr != atomicOff {
+			fmt.Fprintln(os.Stderr, "a templated -collectionName needs -atomic off")
+			return 2
+		}
+	}
+	var syncScope bson.D
+	if *modePtr == "sync" {
+		if syncScope, err = parseExtJSONDocument("syncScope", *syncScopePtr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if *atomicPtr == atomicSwap || *atomicPtr == atomicMerge {
+			// A swap already replaces the whole collection; a merge cannot delete.
+			fmt.Fprintln(os.Stderr, "-mode sync needs -atomic off or transaction")
+			return 2
+		}
+		if routes != nil {
+			fmt.Fprintln(os.Stderr, "-mode sync needs a fixed -collectionName")
+			return 2
+		}
+		if *syncMaxDeletePercentPtr < 0 || *syncMaxDeletePercentPtr > 100 {
+			fmt.Fprintln(os.Stderr, "-syncMaxDeletePercent must be between 0 and 100")
+			return 2
+		}
+		if *syncMaxDeleteCountPtr < 0 {
+			fmt.Fprintln(os.Stderr, "-syncMaxDeleteCount cannot be negative")
+			return 2
+		}
+	}
+	var wm *watermark // Stays nil, and every row is loaded, unless -watermarkColumn is set
+	watermarkSource := *watermarkSourcePtr
+	if *watermarkColumnPtr != "" {
+		if wm, err = newWatermark(*watermarkColumnPtr, cfg.Schema); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if *modePtr == "sync" || *atomicPtr == atomicSwap {
+			// Both would remove the documents of the rows the watermark skips.
+			fmt.Fprintln(os.Stderr, "-watermarkColumn cannot be used with -mode sync or -atomic swap")
+			return 2
+		}
+		if watermarkSource == "" {
+			watermarkSource = collectionName
+		}
+	}
+	if *maxOpenCollectionsPtr < 1 {
+		fmt.Fprintln(os.Stderr, "-maxOpenCollections must be at least 1")
+		return 2
+	}
+	if *batchSizePtr < 1 {
+		fmt.Fprintln(os.Stderr, "-batchSize must be at least 1")
+		return 2
+	}
+	if *writersPtr < 1 {
+		fmt.Fprintln(os.Stderr, "-writers must be at least 1")
+		return 2
+	}
+	if *writersPtr > 1 && *atomicPtr == atomicTransaction {
+		// The writes of a transaction share its session, which runs one operation at a time.
+		fmt.Fprintln(os.Stderr, "-writers above 1 cannot be used with -atomic transaction")
+		return 2
+	}
+	if *maxRowsPerSecPtr < 0 || *maxBytesPerSecPtr < 0 {
+		fmt.Fprintln(os.Stderr, "-maxRowsPerSec and -maxBytesPerSec cannot be negative")
+		return 2
+	}
+	if *adaptivePtr && *adaptiveLatencyPtr <= 0 {
+		fmt.Fprintln(os.Stderr, "-adaptiveLatency must be positive")
+		return 2
+	}
+	limiter := newWriteLimiter(*maxRowsPerSecPtr, *maxBytesPerSecPtr) // nil without a cap
+	batchSize, writers := *batchSizePtr, *writersPtr
+	var adaptive *adaptiveWrites // Stays nil, and the sizing fixed, unless -adaptive is set
+	if *adaptivePtr {
+		adaptive = newAdaptiveWrites(batchSize, writers, *adaptiveLatencyPtr)
+		writers = adaptive.writers
+	}
+	if *readersPtr < 1 {
+		fmt.Fprintln(os.Stderr, "-readers must be at least 1")
+		return 2
+	}
+	retry := retryPolicy{maxRetries: max(*maxRetriesPtr, 0), baseDelay: *retryBaseDelayPtr, maxDelay: *retryMaxDelayPtr}
+	if *atomicPtr == atomicTransaction {
+		retry.maxRetries = 0 // A failed write aborts the transaction, so there is nothing to retry into
+	}
+	budget := errorBudget{maxErrors: *maxErrorsPtr, maxRate: *maxErrorRatePtr, minRows: *maxErrorRateMinRowsPtr}
+	if *rollbackOnAbortPtr && !*lineagePtr && *atomicPtr == atomicOff {
+		fmt.Fprintln(os.Stderr, "-rollbackOnAbort needs -lineage (or -atomic) so the run's writes can be found")
+		return 2
+	}
+	if *lineagePtr && (*atomicPtr == atomicSwap || *atomicPtr == atomicMerge) {
+		// The documents a swap or merge replaces keep no before-image, so a rollback
+		// would delete them along with the run's inserts.
+		fmt.Fprintln(os.Stderr, "-lineage needs -atomic off or transaction, so the run can be rolled back")
+		return 2
+	}
+	runID := primitive.NewObjectID().Hex()
+	slog.SetDefault(logger.With("run_id", runID))
+	defer func() {
+		// Account for anything the rate limiter held back so the totals are never lost.
+		for _, m := range logLimiter.drainSuppressed() {
+			slog.Warn("Suppressed repetitive log messages", "message", m.Message, "suppressed", m.Count)
+		}
+	}()
 
-	client, err := connectToDB(mongoURI)
+	stats := newImportStats(*reportSampleErrorsPtr)
+	progress := newProgressTracker()
+	report := &runReport{
+		RunID:      runID,
+		StartedAt:  time.Now().UTC(),
+		Database:   dbName,
+		Collection: collectionName,
+		Write: writeSettings{Concern: writeConcern, Ordered: *orderedPtr, BatchSize: *batchSizePtr, Writers: *writersPtr,
+			MaxRowsPerSec: *maxRowsPerSecPtr, MaxBytesPerSec: *maxBytesPerSecPtr},
+	}
+	var runErr error
+	updateAudit := func() {}
+	if *reportPtr != "" {
+		progress.enableChecksum()
+		// Registered first so it runs last, once every other deferred step has settled the outcome.
+		defer func() {
+			report.FinishedAt = time.Now().UTC()
+			report.ExitCode = exitCode
+			report.Rows = stats.rows
+			if routes != nil {
+				report.Destinations = stats.destinationSummary()
+			}
+			if adaptive != nil {
+				report.Write.Adaptive = adaptive.summary()
+			}
+			report.Status = runStatus(exitCode, stats.rows)
+			if runErr != nil {
+				report.Error = redact(runErr.Error())
+			}
+			input := inputFile{Path: csvFilePath, SizeBytes: progress.totalBytes.Load(), SHA256: progress.checksum()}
+			if info, err := os.Stat(csvFilePath); err == nil {
+				input.SizeBytes = info.Size() // Also known when the run failed before reading
+			}
+			report.Inputs = []inputFile{input}
+			report.SampleErrors = stats.samples
+			report.SampleErrorsDropped = stats.droppedSample
+			report.Throughput = newThroughput(progress.snapshot(time.Now()))
+			if err := writeReport(*reportPtr, report); err != nil {
+				slog.Error("Error writing run report", "stage", "finalize", "error", err)
+				if exitCode == 0 {
+					exitCode = 1
+				}
+				return
+			}
+			slog.Info("Run report written", "stage", "finalize", "path", *reportPtr, "status", report.Status)
+		}()
+	}
+
+	slog.Info("Program starting...")
+	slog.Info("Configuration", "file", csvFilePath, "mongo_uri", connFlags.redactedURI(), "db", dbName, "collection", collectionName)
+
+	shutdownTelemetry, err := setupTelemetry(context.Background())
 	if err != nil {
-		log.Fatalf("%sMongoDB connection error: %s", logErrorPrefix, err)
+		runErr = err
+		slog.Error("Telemetry setup error", "error", err)
+		return 1
 	}
 	defer func() {
-		log.Println(logInfoPrefix, "Attempting to disconnect from MongoDB...")
+		// Give the exporters a bounded amount of time to flush the run's spans and metrics.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := shutdownTelemetry(ctx); err != nil {
+			slog.Error("Error flushing telemetry", "error", err)
+		}
+	}()
+	metrics, err := newImportMetrics()
+	if err != nil {
+		runErr = err
+		slog.Error("Telemetry setup error", "error", err)
+		return 1
+	}
+
+	ctx, runSpan := tracer.Start(context.Background(), "import", trace.WithAttributes(
+		attribute.String("import.run_id", runID),
+		attribute.String("csv.file", csvFilePath),
+		attribute.String("db.name", dbName),
+		attribute.String("db.collection.name", collectionName),
+	))
+	defer func() { endSpan(runSpan, runErr) }()
+
+	client, err := connectToDB(ctx, connFlags)
+	if err != nil {
+		runErr = err
+		slog.Error("MongoDB connection error", "stage", "connect", "error", err)
+		return 1
+	}
+	defer func() {
+		slog.Info("Attempting to disconnect from MongoDB...", "stage", "finalize")
 		if discErr := client.Disconnect(context.TODO()); discErr != nil {
-			log.Printf("%sError disconnecting from MongoDB: %s", logErrorPrefix, discErr)
+			slog.Error("Error disconnecting from MongoDB", "stage", "finalize", "error", discErr)
 		} else {
-			log.Println(logInfoPrefix, "Disconnected from MongoDB successfully.")
+			slog.Info("Disconnected from MongoDB successfully.", "stage", "finalize")
 		}
 	}()
 
+	if *atomicPtr == atomicTransaction {
+		if info, err := os.Stat(csvFilePath); err == nil && info.Size() > maxTransactionFileSize {
+			slog.Warn("File may be too large to load in one transaction; consider -atomic swap or merge",
+				"stage", "connect", "file", csvFilePath, "size_bytes", info.Size())
+		}
+	}
+	// A templated collection name is resolved per row, so its collections are prepared
+	// as rows are first routed to them (see prepareDestination) rather than here.
+	if cfg.TimeSeries != nil && routes == nil {
+		created, err := ensureTimeSeriesCollection(ctx, client.Database(dbName), collectionName, cfg.TimeSeries)
+		if err != nil {
+			runErr = err
+			slog.Error("Time-series setup error", "stage", "connect", "error", err)
+			return 1
+		}
+		slog.Info("Loading into time-series collection", "stage", "connect", "collection", collectionName, "created", created,
+			"time_field", cfg.TimeSeries.TimeField, "meta_field", cfg.TimeSeries.MetaField, "granularity", cfg.TimeSeries.Granularity)
+	}
+	// Indexes go where the data ends up: a swapped-in staging collection brings its
+	// indexes along, so they are built on it below; otherwise they are built on the
+	// target, before the load begins so a merge finds the unique index it matches on.
+	if routes == nil && *atomicPtr != atomicSwap {
+		if err := ensureIndexes(ctx, client.Database(dbName).Collection(collectionName), cfg.Indexes, indexBuildBefore, &report.Indexes); err != nil {
+			runErr = err
+			slog.Error("Index build error", "stage", "connect", "error", err)
+			return 1
+		}
+	}
+	load, err := beginAtomicLoad(ctx, client, client.Database(dbName), collectionName, *atomicPtr, runID, keyColumns)
+	if err != nil {
+		runErr = err
+		slog.Error("Atomic load setup error", "stage", "connect", "error", err)
+		return 1
+	}
+	// Discards the writes on any return before commit below; a no-op once committed.
+	defer load.abort(context.Background())
+	collection := load.collection()
+	writeBaseCtx := load.context(ctx)
+
+	if *lineagePtr && routes == nil {
+		if err := ensureLineageIndex(ctx, collection); err != nil {
+			runErr = err
+			slog.Error("Lineage setup error", "stage", "connect", "error", err)
+			return 1
+		}
+	}
+
+	// The indexes built after the load go where the ones above went.
+	indexed := load.target
+	if *atomicPtr == atomicSwap {
+		indexed = collection
+		if routes == nil {
+			if err := ensureIndexes(ctx, indexed, cfg.Indexes, indexBuildBefore, &report.Indexes); err != nil {
+				runErr = err
+				slog.Error("Index build error", "stage", "connect", "error", err)
+				return 1
+			}
+		}
+	}
+
+	// A stamped upsert run keeps the documents it replaces so it can be rolled back.
+	var beforeImages *beforeImageStore
+	if *lineagePtr && keyColumns != nil {
+		if beforeImages, err = newBeforeImageStore(ctx, client.Database(dbName), runID, collectionName); err != nil {
+			runErr = err
+			slog.Error("Lineage setup error", "stage", "connect", "error", err)
+			return 1
+		}
+	}
+
+	var syncDelete *syncDeletion // Stays nil unless -mode sync
+	if *modePtr == "sync" {
+		syncDelete = newSyncDeletion(collection, keyColumns, syncScope, *syncMaxDeletePercentPtr, *syncMaxDeleteCountPtr)
+	}
+
+	if wm != nil {
+		if *resetWatermarkPtr {
+			slog.Info("Watermark reset; loading every row", "stage", "connect", "source", watermarkSource, "column", wm.column)
+		} else if wm.current, err = loadWatermark(ctx, client.Database(dbName), watermarkSource, wm); err != nil {
+			runErr = err
+			slog.Error("Watermark error", "stage", "connect", "error", err)
+			return 1
+		} else {
+			slog.Info("Loaded watermark", "stage", "connect", "source", watermarkSource, "column", wm.column, "watermark", wm.current)
+		}
+		report.Watermark = &watermarkSummary{Source: watermarkSource, Column: wm.column}
+		if wm.current != nil {
+			report.Watermark.Previous = formatWatermark(wm.current)
+		}
+	}
+
+	var auditTick <-chan time.Time // Stays nil, and never fires, unless runs are audited
+	if *auditRunsPtr {
+		auditor, err := startRunAudit(ctx, client.Database(dbName), runID, report.StartedAt, collectionName, runConfig(flag.CommandLine))
+		if err != nil {
+			runErr = err
+			slog.Error("Run audit error", "stage", "connect", "error", err)
+			return 1
+		}
+		ticker := time.NewTicker(auditInterval)
+		defer ticker.Stop()
+		auditTick = ticker.C
+		defer func() {
+			// Runs before the disconnect above, once exitCode is final.
+			if err := auditor.finish(context.Background(), runStatus(exitCode, stats.rows), exitCode, stats.rows, runErr); err != nil {
+				slog.Error("Run audit error", "stage", "finalize", "error", err)
+			}
+		}()
+		// The audit-tick case in the main loop refreshes the record while the import runs.
+		updateAudit = func() {
+			if err := auditor.update(ctx, stats.rows); err != nil {
+				slog.Warn("Run audit error", "stage", "write", "error", err)
+			}
+		}
+	}
+
 	headerChan := make(chan []string)
-	dataChan := make(chan []string)
+	dataChan := make(chan csvRecord)
 	errChan := make(chan error, 10) // Buffered error channel
 
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	var progressDone sync.WaitGroup
+	progressDone.Add(1)
+	go func() {
+		defer progressDone.Done()
+		reportProgress(progressCtx, progress, progressMode, *progressIntervalPtr, os.Stderr)
+	}()
+	// Stops the reporter after its final update; also runs on early returns.
+	finishProgress := sync.OnceFunc(func() {
+		stopProgress()
+		progressDone.Wait()
+	})
+	defer finishProgress()
+
 	var wg sync.WaitGroup
 	wg.Add(1) // For the readCSV goroutine
-	go readCSV(csvFilePath, headerChan, dataChan, errChan, &wg)
+	readCtx, stopReading := context.WithCancel(ctx)
+	defer stopReading() // Unblocks readCSV if we return before it is done
+	if *readersPtr > 1 {
+		go readCSVParallel(readCtx, csvFilePath, *readersPtr, parallelChunkSize, progress, headerChan, dataChan, errChan, &wg)
+	} else {
+		go readCSV(readCtx, csvFilePath, progress, headerChan, dataChan, errChan, &wg)
+	}
 
 	var headers []string
-	var recordsProcessed, successfulInserts, failedInserts int
 
 	// Phase 1: Receive header or critical error from readCSV
+	_, headerSpan := tracer.Start(ctx, "read_header")
 	select {
 	case h, ok := <-headerChan:
 		if !ok {
-			log.Fatalf("%sFailed to receive header: header channel closed unexpectedly.", logErrorPrefix)
+			runErr = fmt.Errorf("header channel closed unexpectedly")
+			endSpan(headerSpan, runErr)
+			slog.Error("Failed to receive header", "stage", "read", "file", csvFilePath, "error", runErr)
+			return 1
 		}
 		headers = h
-		log.Printf("%sReceived CSV headers: %v", logInfoPrefix, headers)
+		if missing := missingColumns(headers, keyColumns); len(missing) > 0 {
+			runErr = fmt.Errorf("key columns %v are not in the CSV header", missing)
+			endSpan(headerSpan, runErr)
+			slog.Error("Invalid key columns", "stage", "read", "file", csvFilePath, "error", runErr)
+			return 1
+		}
+		if cfg.Schema != nil {
+			if missing := missingColumns(headers, cfg.Schema.columnNames()); len(missing) > 0 {
+				runErr = fmt.Errorf("schema columns %v are not in the CSV header", missing)
+				endSpan(headerSpan, runErr)
+				slog.Error("Invalid schema", "stage", "read", "file", csvFilePath, "error", runErr)
+				return 1
+			}
+		}
+		if *unflattenPtr {
+			if err := checkDottedColumns(headers); err != nil {
+				runErr = fmt.Errorf("cannot unflatten the CSV header: %w", err)
+				endSpan(headerSpan, runErr)
+				slog.Error("Invalid header for -unflatten", "stage", "read", "file", csvFilePath, "error", runErr)
+				return 1
+			}
+		}
+		if routes != nil {
+			if missing := missingColumns(headers, routes.columns()); len(missing) > 0 {
+				runErr = fmt.Errorf("collection name template columns %v are not in the CSV header", missing)
+				endSpan(headerSpan, runErr)
+				slog.Error("Invalid collection name template", "stage", "read", "file", csvFilePath, "error", runErr)
+				return 1
+			}
+		}
+		if wm != nil && !slices.Contains(headers, wm.column) {
+			runErr = fmt.Errorf("watermark column %s is not in the CSV header", wm.column)
+			endSpan(headerSpan, runErr)
+			slog.Error("Invalid watermark column", "stage", "read", "file", csvFilePath, "error", runErr)
+			return 1
+		}
+		if cfg.TimeSeries != nil {
+			if missing := missingColumns(headers, cfg.TimeSeries.columns()); len(missing) > 0 {
+				runErr = fmt.Errorf("time-series columns %v are not in the CSV header", missing)
+				endSpan(headerSpan, runErr)
+				slog.Error("Invalid time-series config", "stage", "read", "file", csvFilePath, "error", runErr)
+				return 1
+			}
+		}
+		report.Header = headers
+		headerSpan.SetAttributes(attribute.StringSlice("csv.header", headers))
+		endSpan(headerSpan, nil)
+		slog.Info("Received CSV headers", "stage", "read", "file", csvFilePath, "headers", headers)
 	case err := <-errChan:
-		log.Fatalf("%sCritical error during CSV reading setup: %s", logErrorPrefix, err)
+		runErr = err
+		endSpan(headerSpan, err)
+		slog.Error("Critical error during CSV reading setup", "stage", "read", "file", csvFilePath, "error", err)
+		return 1
 	case <-time.After(10 * time.Second): // Timeout for header reading
-		log.Fatalf("%sTimeout waiting for CSV header.", logErrorPrefix)
+		runErr = fmt.Errorf("timeout waiting for CSV header")
+		endSpan(headerSpan, runErr)
+		slog.Error("Timeout waiting for CSV header", "stage", "read", "file", csvFilePath)
+		return 1
+	}
+
+	// rejectRow counts a rejected row and stops reading once the error budget is spent.
+	var budgetErr error
+	rejectRow := func(line int, reason string, err error) {
+		stats.reject(line, reason, err)
+		metrics.recordRow(ctx, "rejected")
+		if budgetErr == nil {
+			if budgetErr = budget.check(stats.rows, false); budgetErr != nil {
+				slog.Error("Aborting import", "stage", "write", "file", csvFilePath, "line", line, "error", budgetErr)
+				stopReading()
+			}
+		}
+	}
+
+	// handleReadError records a problem reported by readCSV. A bad record is a rejected
+	// row; anything else means the rest of the file could not be read, which fails the run.
+	handleReadError := func(err error) {
+		var recErr *recordError
+		if errors.As(err, &recErr) {
+			slog.Warn("Skipping unreadable CSV record", "stage", "read", "file", recErr.file, "line", recErr.line, "error", recErr.err)
+			stats.rows.Read++
+			rejectRow(recErr.line, reasonParseError, recErr.err)
+			return
+		}
+		slog.Error("Error during CSV processing", "stage", "read", "file", csvFilePath, "error", err)
+		runErr = err
+	}
+
+	var converter *rowConverter // Stays nil, and every value a string, without a schema
+	if cfg.Schema != nil {
+		converter = newRowConverter(cfg.Schema, headers)
+	}
+	// upsertWithBeforeImages writes d's batch one row at a time, since a bulk write
+	// cannot return the documents it replaced. It also returns the slowest row's latency.
+	upsertWithBeforeImages := func(ctx context.Context, d *destination) ([]error, int, time.Duration) {
+		results := make([]error, len(d.batch))
+		total := 0
+		var latency time.Duration
+		for i, row := range d.batch {
+			if limiter != nil {
+				if err := limiter.wait(ctx, 1, row.size); err != nil {
+					results[i] = err
+					continue
+				}
+			}
+			var before bson.Raw
+			start := time.Now()
+			retries, err := retry.do(ctx, func() error {
+				var err error
+				before, err = upsertData(ctx, d.writer.coll, keyFilter(keyColumns, row.doc), row.doc, true)
+				return err
+			})
+			latency = max(latency, time.Since(start))
+			total += retries
+			results[i] = err
+			if err == nil && before != nil {
+				if err := d.beforeImages.save(ctx, before); err != nil {
+					// The row is written, but the run can no longer be fully rolled back.
+					slog.Error("Error saving before-image", "stage", "write", "file", csvFilePath, "line", row.line, "error", err)
+					runErr = err
+				}
+			}
+		}
+		return results, total, latency
+	}
+
+	// flush writes d's pending batch and accounts for every row in it.
+	flush := func(d *destination) {
+		if len(d.batch) == 0 {
+			return
+		}
+		// Each batch gets its own span so the driver's command spans nest under it.
+		writeCtx, writeSpan := tracer.Start(writeBaseCtx, "write", trace.WithAttributes(
+			attribute.String("db.collection.name", d.writer.coll.Name()),
+			attribute.Int("csv.first_line", d.batch[0].line),
+			attribute.Int("import.batch.rows", len(d.batch)),
+		))
+		var results []error
+		var retries int
+		var latency time.Duration
+		if d.beforeImages != nil {
+			results, retries, latency = upsertWithBeforeImages(writeCtx, d)
+		} else {
+			results, retries, latency = d.writer.writeRound(writeCtx, d.batch, writers, limiter)
+		}
+		metrics.writeDuration.Record(writeCtx, latency.Seconds())
+		if retries > 0 {
+			stats.rows.Retries += int64(retries)
+			metrics.writeRetries.Add(writeCtx, int64(retries))
+			writeSpan.SetAttributes(attribute.Int("mongo.write.retries", retries))
+		}
+		var failed int
+		var batchErr error
+		backpressure := retries > 0 // Transient errors are what an overloaded server returns
+		for i, row := range d.batch {
+			if writeErr := results[i]; writeErr != nil {
+				failed++
+				batchErr = writeErr
+				backpressure = backpressure || classifyWriteError(writeErr) == errorClassTransient
+				slog.Error("Error writing record to MongoDB",
+					"stage", "write", "file", csvFilePath, "line", row.line, "record", row.doc,
+					"error_class", classifyWriteError(writeErr), "error", writeErr)
+				reason := reasonWriteError
+				if classifyWriteError(writeErr) == errorClassValidation {
+					reason = reasonValidationError // Document failed the collection's validator (code 121)
+				}
+				d.counts.Rejected++
+				rejectRow(row.line, reason, writeErr)
+				if wm != nil {
+					wm.reject(row.watermark)
+				}
+				continue
+			}
+			if wm != nil {
+				wm.wrote(row.watermark)
+			}
+			if keyColumns != nil {
+				stats.rows.Upserted++
+				d.counts.Upserted++
+				metrics.recordRow(ctx, "upserted")
+			} else {
+				stats.rows.Inserted++
+				d.counts.Inserted++
+				metrics.recordRow(ctx, "inserted")
+			}
+		}
+		if failed > 0 {
+			writeSpan.SetAttributes(attribute.Int("import.batch.failed", failed))
+		}
+		endSpan(writeSpan, batchErr)
+		d.batch = d.batch[:0]
+		if adaptive != nil && adaptive.observe(latency, backpressure) {
+			batchSize, writers = adaptive.batchSize, adaptive.writers
+			slog.Debug("Adjusted write sizing", "stage", "write", "batch_size", batchSize, "writers", writers,
+				"latency", latency.Round(time.Millisecond).String(), "backpressure", backpressure)
+		}
+	}
+
+	// prepareDestination readies a collection the first time a row is routed to it,
+	// as the setup above does for a fixed -collectionName.
+	prepareDestination := func(coll *mongo.Collection) error {
+		if cfg.TimeSeries != nil {
+			if _, err := ensureTimeSeriesCollection(ctx, coll.Database(), coll.Name(), cfg.TimeSeries); err != nil {
+				return err
+			}
+		}
+		if *lineagePtr {
+			if err := ensureLineageIndex(ctx, coll); err != nil {
+				return err
+			}
+		}
+		return ensureIndexes(ctx, coll, cfg.Indexes, indexBuildBefore, &report.Indexes)
+	}
+
+	// openDestination returns the destination for collection name. Routed rows can go
+	// to any number of collections, so only the most recently used keep a pending
+	// batch; the one displaced to make room is written out.
+	destinations := newDestinationCache(*maxOpenCollectionsPtr)
+	openDestination := func(name string) *destination {
+		if d := destinations.get(name); d != nil {
+			return d
+		}
+		counts, seen := stats.destination(name)
+		coll := collection
+		if routes != nil {
+			coll = client.Database(dbName).Collection(name)
+			if !seen {
+				if err := prepareDestination(coll); err != nil {
+					counts.Error = redact(err.Error())
+					runErr = err
+					slog.Error("Destination setup error", "stage", "write", "collection", name, "error", err)
+				} else {
+					slog.Info("Routing rows to collection", "stage", "write", "collection", name)
+				}
+			}
+		}
+		d := &destination{writer: &batchWriter{coll: coll, keyColumns: keyColumns, ordered: *orderedPtr, retry: retry}, counts: counts}
+		if beforeImages != nil {
+			d.beforeImages = beforeImages.forCollection(name)
+		}
+		if counts.Error != "" {
+			d.err = errors.New(counts.Error)
+		}
+		if evicted := destinations.add(d); evicted != nil {
+			flush(evicted)
+		}
+		return d
+	}
+	flushAll := func() {
+		for _, d := range destinations.all() {
+			flush(d)
+		}
+	}
+	// routedCollections returns the collections rows were routed to and could be written to.
+	routedCollections := func() []*mongo.Collection {
+		var colls []*mongo.Collection
+		for _, counts := range stats.destinationSummary() {
+			if counts.Error == "" {
+				colls = append(colls, client.Database(dbName).Collection(counts.Collection))
+			}
+		}
+		return colls
 	}
 
 	// Phase 2: Process data records and non-critical errors
-	log.Printf("%sStarting data insertion into MongoDB: %s.%s", logInfoPrefix, dbName, collectionName)
+	slog.Info("Starting data insertion into MongoDB", "stage", "write", "db", dbName, "collection", collectionName,
+		"batch_size", *batchSizePtr, "writers", *writersPtr, "adaptive", *adaptivePtr, "ordered", *orderedPtr, "write_concern", writeConcern)
+	// An interrupt stops reading and fails the run, so the deferred cleanup (aborting an
+	// atomic load, the run report) still happens.
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+	var interrupted bool
 	running := true
-	for running {
+	for running && budgetErr == nil {
 		select {
 		case record, ok := <-dataChan:
 			if !ok { // dataChan closed by readCSV, means reading is done
 				running = false // Exit loop after this select block finishes
 				break
 			}
-			recordsProcessed++
-			if len(record) != len(headers) {
-				log.Printf("%sSkipping record %d (line approx %d): number of fields (%d) does not match header count (%d). Record: %v", logErrorPrefix, recordsProcessed, recordsProcessed+1, len(record), len(headers), record)
-				failedInserts++
+			stats.rows.Read++
+			if len(record.fields) != len(headers) {
+				slog.Warn("Skipping record: number of fields does not match header count",
+					"stage", "transform", "file", csvFilePath, "line", record.line,
+					"fields", len(record.fields), "headers", len(headers), "record", record.fields)
+				rejectRow(record.line, reasonFieldMismatch,
+					fmt.Errorf("number of fields (%d) does not match header count (%d)", len(record.fields), len(headers)))
 				continue
 			}
-
-			doc := bson.M{}
-			for j, header := range headers {
-				doc[header] = record[j]
+			var mark any
+			if wm != nil {
+				var err error
+				if mark, err = wm.value(record.fields[slices.Index(headers, wm.column)]); err != nil {
+					slog.Warn("Skipping record: invalid watermark",
+						"stage", "transform", "file", csvFilePath, "line", record.line, "error", err)
+					rejectRow(record.line, reasonTypeError, err)
+					continue
+				}
+				if wm.skip(mark) {
+					stats.rows.Filtered++
+					metrics.recordRow(ctx, "filtered")
+					continue
+				}
 			}
 
-			_, insertErr := insertData(client, dbName, collectionName, doc)
-			if insertErr != nil {
-				log.Printf("%sError inserting record %d (line approx %d, data %v) into MongoDB: %s", logErrorPrefix, recordsProcessed, recordsProcessed+1, doc, insertErr)
-				failedInserts++
+			var doc bson.M
+			if converter != nil {
+				var err error
+				if doc, err = converter.document(headers, record.fields); err != nil {
+					slog.Warn("Skipping record: value does not match schema",
+						"stage", "transform", "file", csvFilePath, "line", record.line, "error", err)
+					if wm != nil {
+						wm.reject(mark)
+					}
+					rejectRow(record.line, reasonTypeError, err)
+					continue
+				}
 			} else {
-				successfulInserts++
+				doc = bson.M{}
+				for j, header := range headers {
+					doc[header] = record.fields[j]
+				}
+			}
+			name := collectionName
+			if routes != nil {
+				var err error
+				if name, err = routes.render(doc); err != nil {
+					slog.Warn("Skipping record: cannot route row",
+						"stage", "transform", "file", csvFilePath, "line", record.line, "error", err)
+					if wm != nil {
+						wm.reject(mark)
+					}
+					rejectRow(record.line, reasonRoutingError, err)
+					continue
+				}
+			}
+			d := openDestination(name)
+			if d.err != nil {
+				d.counts.Rejected++
+				if wm != nil {
+					wm.reject(mark)
+				}
+				rejectRow(record.line, reasonWriteError, d.err)
+				continue
+			}
+			if cfg.TimeSeries != nil {
+				if err := cfg.TimeSeries.apply(doc); err != nil {
+					slog.Warn("Skipping record: invalid timestamp",
+						"stage", "transform", "file", csvFilePath, "line", record.line, "error", err)
+					d.counts.Rejected++
+					if wm != nil {
+						wm.reject(mark)
+					}
+					rejectRow(record.line, reasonTypeError, err)
+					continue
+				}
+			}
+			if syncDelete != nil {
+				if err := syncDelete.see(doc); err != nil {
+					d.counts.Rejected++
+					if wm != nil {
+						wm.reject(mark)
+					}
+					rejectRow(record.line, reasonWriteError, err)
+					continue
+				}
+			}
+			if *unflattenPtr {
+				unflattenDocument(doc)
+			}
+			if *lineagePtr {
+				doc[lineageField] = lineageStamp{RunID: runID, File: csvFilePath, Line: record.line, LoadedAt: time.Now().UTC()}
+			}
+			row := pendingRow{line: record.line, doc: doc, watermark: mark, size: recordSize(record.fields)}
+			if _, hasID := doc["_id"]; keyColumns == nil && !hasID && retry.maxRetries > 0 {
+				// A fixed _id makes a retried insert idempotent when an earlier attempt was applied after all.
+				doc["_id"] = primitive.NewObjectID()
+				row.generatedID = true
+			}
+			if d.batch = append(d.batch, row); len(d.batch) >= batchSize*writers {
+				flush(d)
 			}
 		case err := <-errChan: // Non-critical errors from readCSV (e.g., a single bad row)
-			log.Printf("%sNon-critical error during CSV processing: %s", logErrorPrefix, err)
-			// Depending on the error type, you might increment failedInserts or handle differently
+			handleReadError(err)
+		case sig := <-interrupts:
+			runErr = fmt.Errorf("import interrupted by %s", sig)
+			slog.Error("Import interrupted; stopping", "stage", "write", "file", csvFilePath, "signal", sig.String())
+			interrupted = true
+			running = false
+			stopReading()
+		case <-auditTick:
+			updateAudit()
 		case <-time.After(30 * time.Second): // Overall timeout if no activity
-		    if recordsProcessed == 0 && successfulInserts == 0 && failedInserts == 0 {
+		    if stats.rows.Read == 0 && stats.rows.Rejected == 0 {
 				// Only timeout if absolutely nothing is happening.
 				// If data is flowing, this timeout won't (and shouldn't) trigger.
-				log.Printf("%sTimeout waiting for data or completion. Assuming CSV processing is stalled or finished.", logErrorPrefix)
+				slog.Error("Timeout waiting for data or completion. Assuming CSV processing is stalled or finished.", "stage", "read", "file", csvFilePath)
 				running = false
 			} else {
 				// If we are processing, reset a conceptual activity timer
 				// This simple timeout isn't perfect for long-running jobs, but good for now.
-				log.Println(logInfoPrefix, "Activity detected, extending processing window.")
+				slog.Info("Activity detected, extending processing window.", "stage", "write")
+				flushAll() // Don't hold partial batches back while input is slow
 			}
 
 		}
 	}
+	if !interrupted && runErr == nil && budgetErr == nil {
+		// An interrupt sent as the input ended still fails the run: the server interrupts
+		// an import whose upload broke off before closing its input.
+		select {
+		case sig := <-interrupts:
+			runErr = fmt.Errorf("import interrupted by %s", sig)
+			slog.Error("Import interrupted; stopping", "stage", "write", "file", csvFilePath, "signal", sig.String())
+			interrupted = true
+		default:
+		}
+	}
+	if budgetErr != nil || interrupted {
+		// The run is aborting: rows still waiting in a batch are not written, and not counted as read.
+		for _, d := range destinations.all() {
+			stats.rows.Read -= int64(len(d.batch))
+			d.batch = nil
+		}
+	}
+	flushAll()
+
+	_, finalizeSpan := tracer.Start(ctx, "finalize")
+	defer finalizeSpan.End()
 
 	wg.Wait() // Wait for readCSV goroutine to fully complete (e.g. close files)
+	finishProgress()
 	close(errChan) // Close errChan now that producer (readCSV) and consumer loops are done
 
 	// Drain any remaining errors from errChan, just in case
 	for err := range errChan {
-		log.Printf("%sPost-loop error from CSV processing: %s", logErrorPrefix, err)
+		handleReadError(err)
 	}
 
-
-	log.Printf("%sCSV processing finished. Records processed: %d", logInfoPrefix, recordsProcessed)
-	log.Printf("%sData insertion summary: %d successful, %d failed.", logInfoPrefix, successfulInserts, failedInserts)
-	log.Println(logInfoPrefix, "Program finished.")
+	slog.Info("CSV processing finished", "stage", "finalize", "file", csvFilePath, "records_read", stats.rows.Read)
+	slog.Info("Data insertion summary", "stage", "finalize", "inserted", stats.rows.Inserted, "upserted", stats.rows.Upserted, "failed", stats.rows.Rejected, "retries", stats.rows.Retries,
+		"write_concern", writeConcern, "ordered", *orderedPtr)
+	if adaptive != nil {
+		a := adaptive.summary()
+		slog.Info("Adaptive write sizing", "stage", "finalize", "batch_size", a.BatchSize, "writers", a.Writers,
+			"peak_batch_size", a.PeakBatchSize, "peak_writers", a.PeakWriters, "slowdowns", a.Slowdowns)
+	}
+	if routes != nil {
+		for _, counts := range stats.destinationSummary() {
+			slog.Info("Destination summary", "stage", "finalize", "collection", counts.Collection,
+				"inserted", counts.Inserted, "upserted", counts.Upserted, "failed", counts.Rejected)
+		}
+	}
+	final := progress.snapshot(time.Now())
+	slog.Info("Throughput", "stage", "finalize", "elapsed", final.elapsed.Round(time.Millisecond).String(),
+		"bytes_read", final.bytesRead, "rows_per_sec", int64(final.rowsPerSec()), "mb_per_sec", fmt.Sprintf("%.1f", final.bytesPerSec()/1e6))
+	if budgetErr == nil {
+		// Small files may never reach -maxErrorRateMinRows, so the rate is checked once more at the end.
+		if budgetErr = budget.check(stats.rows, true); budgetErr != nil {
+			slog.Error("Aborting import", "stage", "finalize", "file", csvFilePath, "error", budgetErr)
+		}
+	}
+	if budgetErr != nil && runErr == nil {
+		runErr = budgetErr
+	}
+	if syncDelete != nil {
+		switch {
+		case runErr != nil:
+			slog.Warn("Sync deletion skipped because the run failed", "stage", "finalize")
+		case stats.rows.Rejected > 0:
+			// A rejected row's document would look absent from the file and be deleted.
+			runErr = fmt.Errorf("sync deletion skipped: %d rows were rejected", stats.rows.Rejected)
+			slog.Error("Sync deletion skipped", "stage", "finalize", "error", runErr)
+		default:
+			deleteCtx, deleteSpan := tracer.Start(writeBaseCtx, "sync_delete")
+			unseen, err := syncDelete.findUnseen(deleteCtx, beforeImages != nil)
+			if err == nil {
+				var saveImages func([]bson.Raw) error
+				if beforeImages != nil {
+					// Deleted documents are kept like replaced ones, so a rollback restores them.
+					saveImages = func(docs []bson.Raw) error {
+						for _, doc := range docs {
+							if err := beforeImages.save(deleteCtx, doc); err != nil {
+								return err
+							}
+						}
+						return nil
+					}
+				}
+				var retries int
+				stats.rows.Deleted, retries, err = syncDelete.deleteDocuments(deleteCtx, unseen, *batchSizePtr, retry, saveImages)
+				stats.rows.Retries += int64(retries)
+			}
+			deleteSpan.SetAttributes(attribute.Int64("import.deleted", stats.rows.Deleted))
+			endSpan(deleteSpan, err)
+			if err != nil {
+				runErr = err
+				slog.Error("Sync deletion failed", "stage", "finalize", "deleted", stats.rows.Deleted, "error", err)
+			} else {
+				slog.Info("Deleted documents absent from the file", "stage", "finalize", "collection", collectionName,
+					"deleted", stats.rows.Deleted, "scope", *syncScopePtr)
+			}
+		}
+	}
+	if runErr == nil {
+		// Built before an atomic load is committed, so a failed unique index still leaves the target untouched.
+		targets := []*mongo.Collection{indexed}
+		if routes != nil {
+			targets = routedCollections()
+		}
+		for _, c := range targets {
+			if err := ensureIndexes(ctx, c, cfg.Indexes, indexBuildAfter, &report.Indexes); err != nil {
+				runErr = err
+				slog.Error("Index build error", "stage", "finalize", "error", err)
+				break
+			}
+		}
+	}
+	if *atomicPtr != atomicOff {
+		if rate := errorRate(stats.rows); runErr == nil && rate > *atomicMaxErrorRatePtr {
+			runErr = fmt.Errorf("rejected %d of %d rows (%.2f%%), above -atomicMaxErrorRate %.2f%%; target %s left untouched",
+				stats.rows.Rejected, stats.rows.Read, 100*rate, 100**atomicMaxErrorRatePtr, collectionName)
+		}
+		if runErr != nil {
+			load.abort(ctx)
+			slog.Error("Atomic load aborted", "stage", "finalize", "mode", *atomicPtr, "error", runErr)
+		} else if err := load.commit(ctx); err != nil {
+			runErr = err
+			slog.Error("Atomic load commit failed", "stage", "finalize", "mode", *atomicPtr, "error", err)
+		} else {
+			slog.Info("Atomic load committed", "stage", "finalize", "mode", *atomicPtr, "collection", collectionName)
+		}
+	}
+	if wm != nil && runErr == nil {
+		// Saved once the rows are in the target for good, so a failed run loads them again.
+		if next := wm.next(); next != nil {
+			err := saveWatermark(ctx, client.Database(dbName), watermarkState{
+				Source: watermarkSource, Column: wm.column, Value: next, RunID: runID, File: csvFilePath, UpdatedAt: time.Now().UTC(),
+			})
+			if err != nil {
+				runErr = err
+				slog.Error("Watermark error", "stage", "finalize", "error", err)
+			} else {
+				report.Watermark.Current = formatWatermark(next)
+				slog.Info("Watermark advanced", "stage", "finalize", "source", watermarkSource, "watermark", next)
+			}
+		}
+		if wm.rejected > 0 {
+			slog.Warn("Watermark held below a rejected row; the next run loads the rows from there again", "stage", "finalize",
+				"source", watermarkSource, "rejected", wm.rejected, "lowest_rejected", wm.lowestRejected)
+		}
+	}
+	if budgetErr != nil && *rollbackOnAbortPtr && *atomicPtr == atomicOff {
+		// Atomic loads were already discarded above; a direct load is undone through its lineage stamps.
+		written := []*mongo.Collection{collection}
+		if routes != nil {
+			written = routedCollections()
+		}
+		for _, c := range written {
+			result, err := rollbackRun(ctx, client.Database(dbName), c, runID, false)
+			if err != nil {
+				slog.Error("Rollback after abort failed", "stage", "finalize", "collection", c.Name(), "restored", result.Restored, "deleted", result.Deleted, "error", err)
+			} else {
+				slog.Info("Rolled back aborted import", "stage", "finalize", "collection", c.Name(), "restored", result.Restored, "deleted", result.Deleted)
+			}
+		}
+	}
+	runSpan.SetAttributes(
+		attribute.Int64("csv.records_read", stats.rows.Read),
+		attribute.Int64("import.inserted", stats.rows.Inserted),
+		attribute.Int64("import.upserted", stats.rows.Upserted),
+		attribute.Int64("import.rejected", stats.rows.Rejected),
+		attribute.Int64("import.retries", stats.rows.Retries),
+		attribute.Int64("import.deleted", stats.rows.Deleted),
+	)
+	if runErr != nil {
+		slog.Error("Program finished with errors.", "error", runErr)
+		return 1
+	}
+	slog.Info("Program finished.")
+	return 0
 }
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
@@ -32,12 +33,12 @@ func TestReadCSV(t *testing.T) {
 		filePath := createTestCSVFile(t, csvContent)
 
 		headerChan := make(chan []string, 1)
-		dataChan := make(chan []string, 2)
+		dataChan := make(chan csvRecord, 2)
 		errChan := make(chan error, 1)
 		var wg sync.WaitGroup
 		wg.Add(1)
 
-		go readCSV(filePath, headerChan, dataChan, errChan, &wg)
+		go readCSV(context.Background(), filePath, nil, headerChan, dataChan, errChan, &wg)
 
 		expectedHeader := []string{"ID", "Name", "Value"}
 		select {
@@ -66,7 +67,7 @@ func TestReadCSV(t *testing.T) {
 					t.Errorf("Data channel closed prematurely after %d records", len(receivedData))
 					break dataLoop
 				}
-				receivedData = append(receivedData, data)
+				receivedData = append(receivedData, data.fields)
 			case err := <-errChan:
 				t.Errorf("Unexpected error during data reading: %v", err)
 				// Potentially break or return depending on whether errors here are fatal for the test
@@ -97,12 +98,12 @@ func TestReadCSV(t *testing.T) {
 		filePath := createTestCSVFile(t, "")
 
 		headerChan := make(chan []string, 1)
-		dataChan := make(chan []string, 1) // Small buffer, won't be used
+		dataChan := make(chan csvRecord, 1) // Small buffer, won't be used
 		errChan := make(chan error, 1)
 		var wg sync.WaitGroup
 		wg.Add(1)
 
-		go readCSV(filePath, headerChan, dataChan, errChan, &wg)
+		go readCSV(context.Background(), filePath, nil, headerChan, dataChan, errChan, &wg)
 
 		select {
 		case err := <-errChan:
@@ -128,12 +129,12 @@ func TestReadCSV(t *testing.T) {
 		filePath := createTestCSVFile(t, csvContent)
 
 		headerChan := make(chan []string, 1)
-		dataChan := make(chan []string, 1) // Expect no data
+		dataChan := make(chan csvRecord, 1) // Expect no data
 		errChan := make(chan error, 1)    // Expect no errors
 		var wg sync.WaitGroup
 		wg.Add(1)
 
-		go readCSV(filePath, headerChan, dataChan, errChan, &wg)
+		go readCSV(context.Background(), filePath, nil, headerChan, dataChan, errChan, &wg)
 
 		expectedHeader := []string{"ID", "Name"}
 		select {
@@ -175,12 +176,12 @@ func TestReadCSV(t *testing.T) {
 		filePath := createTestCSVFile(t, csvContent)
 
 		headerChan := make(chan []string, 1)
-		dataChan := make(chan []string, 1)
+		dataChan := make(chan csvRecord, 1)
 		errChan := make(chan error, 2) // Expect header then error
 		var wg sync.WaitGroup
 		wg.Add(1)
 
-		go readCSV(filePath, headerChan, dataChan, errChan, &wg)
+		go readCSV(context.Background(), filePath, nil, headerChan, dataChan, errChan, &wg)
 
 		expectedHeader := []string{"ID", "Name"}
 		select {
@@ -208,8 +209,13 @@ func TestReadCSV(t *testing.T) {
 				// "parse error on line 2, column 1: extraneous or missing \" in quoted-field" is typical.
 				t.Logf("Note: Received malformed CSV error: %v", err) // Log it for info
 			}
-		case data := <-dataChan:
-			t.Errorf("Expected no data for malformed CSV line, got %v", data)
+		case data, ok := <-dataChan:
+			if ok {
+				t.Errorf("Expected no data for malformed CSV line, got %v", data)
+			} else if len(errChan) == 0 {
+				// readCSV reports the error before closing dataChan, so it must be buffered by now.
+				t.Errorf("Expected error for malformed CSV line, data channel closed without one")
+			}
 		case <-time.After(1 * time.Second):
 			t.Fatal("Timeout waiting for error on malformed CSV line")
 		}
@@ -224,12 +230,12 @@ func TestReadCSV(t *testing.T) {
         filePath := createTestCSVFile(t, csvContent)
 
         headerChan := make(chan []string, 1)
-        dataChan := make(chan []string, 2)
+        dataChan := make(chan csvRecord, 2)
         errChan := make(chan error, 1) 
         var wg sync.WaitGroup
         wg.Add(1)
 
-        go readCSV(filePath, headerChan, dataChan, errChan, &wg)
+        go readCSV(context.Background(), filePath, nil, headerChan, dataChan, errChan, &wg)
 
         expectedHeader := []string{"Header1", "Header2"}
         select {
@@ -256,7 +262,7 @@ func TestReadCSV(t *testing.T) {
 				if !ok {
 					t.Fatalf("Data channel closed prematurely. Expected %d rows, got %d.", len(expectedDataRows), len(receivedData))
 				}
-				receivedData = append(receivedData, row)
+				receivedData = append(receivedData, row.fields)
 			case err := <-errChan:
 				// If FieldsPerRecord is positive, csv.Reader might send an error here.
 				// Since we use -1, we don't expect errors *from readCSV* for this.
@@ -280,6 +286,42 @@ func TestReadCSV(t *testing.T) {
             t.Errorf("Expected data rows %v, got %v", expectedDataRows, receivedData)
         }
     })
+
+	t.Run("LineNumbers", func(t *testing.T) {
+		// The quoted field spans two lines, so the record after it starts on line 4, not 3.
+		csvContent := "ID,Note\n1,\"two\nlines\"\n2,plain\n3,\"bad\"quote\n4,last"
+		filePath := createTestCSVFile(t, csvContent)
+
+		headerChan := make(chan []string, 1)
+		dataChan := make(chan csvRecord, 4)
+		errChan := make(chan error, 4)
+		var wg sync.WaitGroup
+		wg.Add(1)
+
+		go readCSV(context.Background(), filePath, nil, headerChan, dataChan, errChan, &wg)
+		wg.Wait()
+		close(errChan)
+
+		var lines []int
+		for record := range dataChan {
+			lines = append(lines, record.line)
+		}
+		if expected := []int{2, 4, 6}; !reflect.DeepEqual(lines, expected) {
+			t.Errorf("Expected record lines %v, got %v", expected, lines)
+		}
+
+		var errLines []int
+		for err := range errChan {
+			var recErr *recordError
+			if !errors.As(err, &recErr) {
+				t.Fatalf("Expected a *recordError, got %T: %v", err, err)
+			}
+			errLines = append(errLines, recErr.line)
+		}
+		if expected := []int{5}; !reflect.DeepEqual(errLines, expected) {
+			t.Errorf("Expected error lines %v, got %v", expected, errLines)
+		}
+	})
 }
 
 // TestTransformCSVRowToBSON tests the core logic of transforming a CSV row to a BSON document.
@@ -363,3 +405,50 @@ func TestTransformCSVRowToBSON(t *testing.T) {
         }
     })
 }
+
+func TestParseWriteMode(t *testing.T) {
+	t.Run("Insert", func(t *testing.T) {
+		keys, err := parseWriteMode("insert", "")
+		if err != nil || keys != nil {
+			t.Errorf("Expected insert mode without keys, got %v, %v", keys, err)
+		}
+	})
+
+	t.Run("Upsert", func(t *testing.T) {
+		keys, err := parseWriteMode("upsert", " Name, City ,")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if expected := []string{"Name", "City"}; !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expected keys %v, got %v", expected, keys)
+		}
+	})
+
+	t.Run("Sync", func(t *testing.T) {
+		keys, err := parseWriteMode("sync", "Code")
+		if err != nil || !reflect.DeepEqual(keys, []string{"Code"}) {
+			t.Errorf("Expected sync mode with key Code, got %v, %v", keys, err)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, tc := range [][2]string{{"upsert", ""}, {"sync", ""}, {"insert", "Name"}, {"merge", "Name"}} {
+			if _, err := parseWriteMode(tc[0], tc[1]); err == nil {
+				t.Errorf("Expected an error for -mode %q -keyColumns %q", tc[0], tc[1])
+			}
+		}
+	})
+}
+
+func TestKeyFilter(t *testing.T) {
+	header := []string{"Name", "Age", "City"}
+	if missing := missingColumns(header, []string{"City", "Country"}); !reflect.DeepEqual(missing, []string{"Country"}) {
+		t.Errorf("Expected missing column Country, got %v", missing)
+	}
+
+	doc := bson.M{"Name": "John Doe", "Age": "30", "City": "New York"}
+	expected := bson.D{{Key: "City", Value: "New York"}, {Key: "Name", Value: "John Doe"}}
+	if filter := keyFilter([]string{"City", "Name"}, doc); !reflect.DeepEqual(filter, expected) {
+		t.Errorf("Expected filter %v, got %v", expected, filter)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// parallelChunkSize is the size of the byte ranges a file is split into for
+// parallel reading; each chunk is extended to the end of the line it stops in.
+const parallelChunkSize = 4 << 20
+
+// fileChunk is a byte range of a CSV file that starts at the beginning of a line
+// and ends after one.
+type fileChunk struct {
+	start, end int64
+	parsed     chan parsedChunk // receives the chunk once a reader has parsed it
+}
+
+// parsedChunk is what a reader made of a fileChunk. Lines are counted from the
+// start of the chunk, since the lines before it are not known until the chunks
+// before it have been parsed.
+type parsedChunk struct {
+	data  []byte
+	rows  []chunkRow
+	lines int // newlines in the chunk
+	// multiline means a line in the chunk has an odd number of quotes, so a quoted
+	// field may span lines and the chunk cannot be parsed on its own.
+	multiline bool
+	err       error
+}
+
+// chunkRow is a record of a chunk, or the error it could not be parsed with.
+type chunkRow struct {
+	line   int
+	fields []string
+	err    *csv.ParseError
+}
+
+// lineStart returns the first offset at or after offset, which must be positive,
+// where a line starts in r, or size if no line starts after it.
+func lineStart(r io.ReaderAt, size, offset int64) (int64, error) {
+	buf := make([]byte, 64<<10)
+	// Start at the byte before offset, so an offset right after a newline is kept.
+	for pos := offset - 1; pos < size; pos += int64(len(buf)) {
+		n, err := r.ReadAt(buf, pos)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return pos + int64(i) + 1, nil
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// hasOpenQuote reports whether a line in data has an odd number of quotes. In CSV
+// without fields spanning lines every line has an even number, as quotes enclose
+// fields and are escaped by doubling.
+func hasOpenQuote(data []byte) bool {
+	if bytes.IndexByte(data, '"') < 0 {
+		return false
+	}
+	for len(data) > 0 {
+		var line []byte
+		line, data, _ = bytes.Cut(data, []byte{'\n'})
+		if bytes.Count(line, []byte{'"'})%2 != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// parseChunk reads and parses a chunk of r.
+func parseChunk(r io.ReaderAt, c fileChunk) parsedChunk {
+	data := make([]byte, c.end-c.start)
+	if n, err := r.ReadAt(data, c.start); n < len(data) {
+		return parsedChunk{err: err}
+	}
+	if hasOpenQuote(data) {
+		return parsedChunk{multiline: true}
+	}
+	p := parsedChunk{data: data, lines: bytes.Count(data, []byte{'\n'})}
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return p
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			p.rows = append(p.rows, chunkRow{line: parseErr.StartLine, err: parseErr})
+			continue
+		}
+		if err != nil {
+			return parsedChunk{err: err}
+		}
+		line, _ := reader.FieldPos(0)
+		p.rows = append(p.rows, chunkRow{line: line, fields: record})
+	}
+}
+
+// readCSVParallel reads a CSV file as readCSV does, with readers goroutines parsing
+// chunks of about chunkSize bytes at once. Records are still sent in file order
+// with their lines in the file. If a quoted field may span lines, the rest of the
+// file from the chunk it was found in is read sequentially. Input that is not a
+// regular file, such as standard input, is read sequentially throughout.
+func readCSVParallel(ctx context.Context, filePath string, readers int, chunkSize int64, progress *progressTracker, headerChan chan<- []string, dataChan chan<- csvRecord, errChan chan<- error, wg *sync.WaitGroup) {
+	if info, err := os.Stat(filePath); err != nil || !info.Mode().IsRegular() {
+		// readCSV also reports a file that cannot be opened.
+		readCSV(ctx, filePath, progress, headerChan, dataChan, errChan, wg)
+		return
+	}
+	defer wg.Done()
+	defer close(headerChan)
+	defer close(dataChan)
+
+	slog.Info("Opening CSV file", "stage", "read", "file", filePath, "readers", readers)
+	file, err := os.Open(filePath)
+	if err != nil {
+		errChan <- fmt.Errorf("error opening file %s: %w", filePath, err)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		errChan <- fmt.Errorf("error opening file %s: %w", filePath, err)
+		return
+	}
+	size := info.Size()
+	if progress != nil {
+		progress.totalBytes.Store(size)
+	}
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := readHeader(reader, filePath)
+	if err != nil {
+		errChan <- err
+		return
+	}
+	headerEnd := reader.InputOffset()
+	headerBytes := make([]byte, headerEnd)
+	if _, err := file.ReadAt(headerBytes, 0); err != nil {
+		errChan <- fmt.Errorf("error reading header from CSV %s: %w", filePath, err)
+		return
+	}
+	if progress != nil {
+		progress.bytesRead.Add(headerEnd)
+		if progress.digest != nil {
+			progress.digest.Write(headerBytes)
+		}
+	}
+	select {
+	case headerChan <- header:
+	case <-ctx.Done():
+		return
+	}
+
+	// The dispatcher splits the file into chunks and hands them to the readers in
+	// order; chunks are passed on to the loop below in the same order. At most
+	// 2*readers chunks are held at once, parsed or not.
+	chunkCtx, stopChunks := context.WithCancel(ctx)
+	var chunkers sync.WaitGroup
+	defer chunkers.Wait() // The readers use the file, so they must stop before it is closed
+	defer stopChunks()
+	window := 2 * readers
+	toParse := make(chan fileChunk)
+	inOrder := make(chan fileChunk, window)
+	splitErr := make(chan error, 1)
+	chunkers.Add(1)
+	go func() {
+		defer chunkers.Done()
+		defer close(toParse)
+		defer close(inOrder)
+		for start := headerEnd; start < size; {
+			end, err := lineStart(file, size, min(start+chunkSize, size))
+			if err != nil {
+				splitErr <- err
+				return
+			}
+			c := fileChunk{start: start, end: end, parsed: make(chan parsedChunk, 1)}
+			select {
+			case inOrder <- c: // Blocks while window chunks are waiting to be passed on
+			case <-chunkCtx.Done():
+				return
+			}
+			select {
+			case toParse <- c:
+			case <-chunkCtx.Done():
+				return
+			}
+			start = end
+		}
+	}()
+	for range readers {
+		chunkers.Add(1)
+		go func() {
+			defer chunkers.Done()
+			for c := range toParse {
+				c.parsed <- parseChunk(file, c)
+			}
+		}()
+	}
+
+	lines := bytes.Count(headerBytes, []byte{'\n'}) // Lines before the next chunk
+	chunks := 0
+	for c := range inOrder {
+		var p parsedChunk
+		select {
+		case p = <-c.parsed:
+		case <-ctx.Done():
+			return
+		}
+		if p.err != nil {
+			errChan <- fmt.Errorf("error reading CSV %s: %w", filePath, p.err)
+			return
+		}
+		if p.multiline {
+			stopChunks()
+			slog.Info("Quoted field may span lines; reading the rest of the file sequentially",
+				"stage", "read", "file", filePath, "line", lines+1)
+			var rest io.Reader = io.NewSectionReader(file, c.start, size-c.start)
+			if progress != nil {
+				rest = &countingReader{r: rest, progress: progress}
+			}
+			reader := csv.NewReader(rest)
+			reader.FieldsPerRecord = -1
+			if readRecords(ctx, reader, filePath, lines, progress, dataChan, errChan) {
+				slog.Info("Finished reading CSV file", "stage", "read", "file", filePath, "parallel_chunks", chunks)
+			}
+			return
+		}
+		for _, row := range p.rows {
+			if row.err != nil {
+				shiftParseError(row.err, lines)
+				select {
+				case errChan <- &recordError{file: filePath, line: row.err.StartLine, err: row.err}:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+			if progress != nil {
+				progress.rows.Add(1)
+			}
+			select {
+			case dataChan <- csvRecord{line: lines + row.line, fields: row.fields}:
+			case <-ctx.Done():
+				slog.Info("Stopped reading CSV file", "stage", "read", "file", filePath, "line", lines+row.line)
+				return
+			}
+		}
+		lines += p.lines
+		chunks++
+		if progress != nil {
+			progress.bytesRead.Add(int64(len(p.data)))
+			if progress.digest != nil {
+				progress.digest.Write(p.data)
+			}
+		}
+	}
+	select {
+	case err := <-splitErr:
+		errChan <- fmt.Errorf("error reading CSV %s: %w", filePath, err)
+		return
+	default:
+	}
+	if progress != nil {
+		progress.eof.Store(true)
+	}
+	slog.Info("Finished reading CSV file", "stage", "read", "file", filePath, "parallel_chunks", chunks)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// readAll runs read to the end and returns the records and errors it sent, and the
+// checksum of the input.
+func readAll(t *testing.T, read func(*progressTracker, chan<- []string, chan<- csvRecord, chan<- error, *sync.WaitGroup)) ([]csvRecord, []string, string) {
+	t.Helper()
+	progress := newProgressTracker()
+	progress.enableChecksum()
+	headerChan := make(chan []string, 1)
+	dataChan := make(chan csvRecord)
+	errChan := make(chan error)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go read(progress, headerChan, dataChan, errChan, &wg)
+	<-headerChan
+	var records []csvRecord
+	var errs []string
+	for dataChan != nil {
+		select {
+		case record, ok := <-dataChan:
+			if !ok {
+				dataChan = nil
+				continue
+			}
+			records = append(records, record)
+		case err := <-errChan:
+			errs = append(errs, err.Error())
+		}
+	}
+	wg.Wait()
+	return records, errs, progress.checksum()
+}
+
+func TestReadCSVParallel(t *testing.T) {
+	var plain strings.Builder
+	plain.WriteString("id,name\r\n")
+	for i := 1; i <= 200; i++ {
+		fmt.Fprintf(&plain, "%d,\"name, %d\"\r\n", i, i)
+		if i%50 == 0 {
+			plain.WriteString("\r\n") // Blank lines are skipped but still counted
+		}
+	}
+	tests := []struct {
+		name    string
+		content string
+		errors  int
+	}{
+		{"Plain", plain.String(), 0},
+		{"BadRecord", "id,name\n1,a\n2,\"b\"c\n3,d\n4,e\n5,f\n", 1},
+		{"QuotedNewline", "id,name\n1,a\n2,b\n3,c\n4,\"multi\nline\"\n5,e\n6,\"again\nhere\"\n7,f\n", 0},
+		{"NoTrailingNewline", "id,name\n1,a\n2,b\n3,c", 0},
+		{"MultilineHeader", "id,\"long\nname\"\n1,a\n2,b\n3,c\n", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := createTestCSVFile(t, tt.content)
+			wantRecords, wantErrs, wantSum := readAll(t, func(p *progressTracker, h chan<- []string, d chan<- csvRecord, e chan<- error, wg *sync.WaitGroup) {
+				readCSV(context.Background(), filePath, p, h, d, e, wg)
+			})
+			records, errs, sum := readAll(t, func(p *progressTracker, h chan<- []string, d chan<- csvRecord, e chan<- error, wg *sync.WaitGroup) {
+				readCSVParallel(context.Background(), filePath, 3, 8, p, h, d, e, wg)
+			})
+			if !reflect.DeepEqual(records, wantRecords) {
+				t.Errorf("Expected the records of a sequential read\n%v, got\n%v", wantRecords, records)
+			}
+			if len(wantErrs) != tt.errors {
+				t.Fatalf("Expected %d errors from a sequential read, got %v", tt.errors, wantErrs)
+			}
+			if !reflect.DeepEqual(errs, wantErrs) {
+				t.Errorf("Expected errors %v, got %v", wantErrs, errs)
+			}
+			if sum == "" || sum != wantSum {
+				t.Errorf("Expected checksum %s, got %s", wantSum, sum)
+			}
+		})
+	}
+}
+
+func TestHasOpenQuote(t *testing.T) {
+	tests := map[string]bool{
+		"1,a\n2,b\n":              false,
+		"1,\"a, \"\"b\"\"\"\n2,b": false,
+		"1,\"a\nb\"\n":            true,
+		"1,a\"b\n":                true,
+	}
+	for data, want := range tests {
+		if got := hasOpenQuote([]byte(data)); got != want {
+			t.Errorf("Expected %v for %q, got %v", want, data, got)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// progressBarWidth is the number of cells in the interactive progress bar.
+	progressBarWidth = 30
+	// progressBarRefresh is how often the interactive progress bar is redrawn.
+	progressBarRefresh = 250 * time.Millisecond
+	// progressMessage is the message of progress log lines, which the serve
+	// subcommand reads back from the imports it runs.
+	progressMessage = "Progress"
+)
+
+// progressTracker counts bytes and rows consumed from the input file. It is updated
+// by the reader goroutine and sampled by the progress reporter, so the counters are atomic.
+type progressTracker struct {
+	start      time.Time
+	totalBytes atomic.Int64
+	bytesRead  atomic.Int64
+	rows       atomic.Int64
+	eof        atomic.Bool // set once the input has been read to the end
+
+	// digest, if set by enableChecksum, hashes every byte read. Only the reader
+	// goroutine writes to it; read it via checksum once reading has finished.
+	digest hash.Hash
+}
+
+// newProgressTracker returns a tracker whose rates are measured from now.
+func newProgressTracker() *progressTracker {
+	return &progressTracker{start: time.Now()}
+}
+
+// enableChecksum makes the tracker compute the SHA-256 of the input as it is read.
+// It must be called before reading starts.
+func (p *progressTracker) enableChecksum() {
+	p.digest = sha256.New()
+}
+
+// checksum returns the hex SHA-256 of the input, or "" if checksums are off or the
+// input was not read to the end.
+func (p *progressTracker) checksum() string {
+	if p.digest == nil || !p.eof.Load() {
+		return ""
+	}
+	return hex.EncodeToString(p.digest.Sum(nil))
+}
+
+// progressSnapshot is a consistent-enough view of a progressTracker at one instant.
+type progressSnapshot struct {
+	bytesRead  int64
+	totalBytes int64 // 0 if the size of the input is unknown
+	rows       int64
+	elapsed    time.Duration
+}
+
+// snapshot samples the tracker's counters.
+func (p *progressTracker) snapshot(now time.Time) progressSnapshot {
+	return progressSnapshot{
+		bytesRead:  p.bytesRead.Load(),
+		totalBytes: p.totalBytes.Load(),
+		rows:       p.rows.Load(),
+		elapsed:    now.Sub(p.start),
+	}
+}
+
+// percent returns how much of the input has been consumed, or -1 if the size is unknown.
+func (s progressSnapshot) percent() float64 {
+	if s.totalBytes <= 0 {
+		return -1
+	}
+	return 100 * float64(min(s.bytesRead, s.totalBytes)) / float64(s.totalBytes)
+}
+
+func (s progressSnapshot) rowsPerSec() float64 {
+	if s.elapsed <= 0 {
+		return 0
+	}
+	return float64(s.rows) / s.elapsed.Seconds()
+}
+
+func (s progressSnapshot) bytesPerSec() float64 {
+	if s.elapsed <= 0 {
+		return 0
+	}
+	return float64(s.bytesRead) / s.elapsed.Seconds()
+}
+
+// eta estimates the time left at the average byte rate so far. ok is false when
+// there is not enough information yet (unknown size or nothing read).
+func (s progressSnapshot) eta() (remaining time.Duration, ok bool) {
+	rate := s.bytesPerSec()
+	if s.totalBytes <= 0 || rate <= 0 {
+		return 0, false
+	}
+	left := max(s.totalBytes-s.bytesRead, 0)
+	return time.Duration(float64(left) / rate * float64(time.Second)).Round(time.Second), true
+}
+
+// String renders the snapshot as a single human-readable status line.
+func (s progressSnapshot) String() string {
+	var b strings.Builder
+	if pct := s.percent(); pct >= 0 {
+		fmt.Fprintf(&b, "%5.1f%%  %s/%s", pct, formatBytes(s.bytesRead), formatBytes(s.totalBytes))
+	} else {
+		b.WriteString(formatBytes(s.bytesRead))
+	}
+	fmt.Fprintf(&b, "  %d rows  %.0f rows/s  %.1f MB/s", s.rows, s.rowsPerSec(), s.bytesPerSec()/1e6)
+	if eta, ok := s.eta(); ok {
+		fmt.Fprintf(&b, "  ETA %s", eta)
+	}
+	return b.String()
+}
+
+// bar renders the snapshot as a fixed-width progress bar followed by the status line.
+func (s progressSnapshot) bar() string {
+	filled := 0
+	if pct := s.percent(); pct >= 0 {
+		filled = int(pct / 100 * progressBarWidth)
+	}
+	cells := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		cells += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	return "[" + cells + "] " + s.String()
+}
+
+// formatBytes formats n using decimal units (kB, MB, GB) to match the MB/s rate.
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGT"[exp])
+}
+
+// countingReader passes reads through to r and adds the bytes read to a progressTracker.
+type countingReader struct {
+	r        io.Reader
+	progress *progressTracker
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.progress.bytesRead.Add(int64(n))
+	if c.progress.digest != nil {
+		c.progress.digest.Write(p[:n])
+	}
+	if err == io.EOF {
+		c.progress.eof.Store(true)
+	}
+	return n, err
+}
+
+// resolveProgressMode turns the -progress flag into "bar", "log" or "off".
+// "auto" draws a bar when out is a terminal and logs progress lines otherwise.
+func resolveProgressMode(mode string, out *os.File) (string, error) {
+	switch mode {
+	case "bar", "log", "off":
+		return mode, nil
+	case "auto":
+		if isTerminal(out) {
+			return "bar", nil
+		}
+		return "log", nil
+	}
+	return "", fmt.Errorf("invalid progress mode %q (want auto, bar, log or off)", mode)
+}
+
+// isTerminal reports whether f is a character device, i.e. an interactive terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// reportProgress reports p until ctx is cancelled. In "bar" mode it redraws a progress
+// bar on out; in "log" mode it logs a progress line every interval. The final state
+// is always reported once more when ctx is cancelled.
+func reportProgress(ctx context.Context, p *progressTracker, mode string, interval time.Duration, out io.Writer) {
+	if mode == "off" {
+		return
+	}
+	if mode == "bar" {
+		interval = progressBarRefresh
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	report := func() {
+		s := p.snapshot(time.Now())
+		if mode == "bar" {
+			// \r returns to the start of the line; \033[K clears what a longer previous line left behind.
+			fmt.Fprintf(out, "\r%s\033[K", s.bar())
+			return
+		}
+		attrs := []any{
+			"stage", "read",
+			"bytes_read", s.bytesRead,
+			"rows", s.rows,
+			"rows_per_sec", int64(s.rowsPerSec()),
+			"mb_per_sec", fmt.Sprintf("%.1f", s.bytesPerSec()/1e6),
+		}
+		if pct := s.percent(); pct >= 0 {
+			attrs = append(attrs, "total_bytes", s.totalBytes, "percent", fmt.Sprintf("%.1f", pct))
+		}
+		if eta, ok := s.eta(); ok {
+			attrs = append(attrs, "eta", eta.String())
+		}
+		slog.Info(progressMessage, attrs...)
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			report()
+		case <-ctx.Done():
+			report()
+			if mode == "bar" {
+				fmt.Fprintln(out)
+			}
+			return
+		}
+	}
+}
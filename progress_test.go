@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProgressSnapshot(t *testing.T) {
+	s := progressSnapshot{bytesRead: 250e6, totalBytes: 1e9, rows: 50000, elapsed: 10 * time.Second}
+
+	if got := s.percent(); got != 25 {
+		t.Errorf("Expected 25%%, got %v", got)
+	}
+	if got := s.rowsPerSec(); got != 5000 {
+		t.Errorf("Expected 5000 rows/s, got %v", got)
+	}
+	if got := s.bytesPerSec(); got != 25e6 {
+		t.Errorf("Expected 25e6 bytes/s, got %v", got)
+	}
+	if eta, ok := s.eta(); !ok || eta != 30*time.Second {
+		t.Errorf("Expected ETA 30s, got %v (ok=%v)", eta, ok)
+	}
+
+	line := s.String()
+	for _, want := range []string{"25.0%", "250.0 MB/1.0 GB", "5000 rows/s", "25.0 MB/s", "ETA 30s"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Expected %q in progress line %q", want, line)
+		}
+	}
+	if bar := s.bar(); !strings.HasPrefix(bar, "[=======>"+strings.Repeat(" ", 22)+"]") {
+		t.Errorf("Unexpected progress bar %q", bar)
+	}
+
+	unknown := progressSnapshot{bytesRead: 1500, rows: 3, elapsed: time.Second}
+	if got := unknown.percent(); got != -1 {
+		t.Errorf("Expected -1 percent for unknown size, got %v", got)
+	}
+	if _, ok := unknown.eta(); ok {
+		t.Errorf("Expected no ETA for unknown size")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[int64]string{
+		0:             "0 B",
+		999:           "999 B",
+		1500:          "1.5 kB",
+		5_000_000_000: "5.0 GB",
+	}
+	for n, want := range cases {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestReadCSVTracksProgress(t *testing.T) {
+	csvContent := "ID,Name\n1,First\n2,Second\n"
+	filePath := createTestCSVFile(t, csvContent)
+
+	progress := newProgressTracker()
+	progress.enableChecksum()
+	headerChan := make(chan []string, 1)
+	dataChan := make(chan csvRecord, 2)
+	errChan := make(chan error, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go readCSV(context.Background(), filePath, progress, headerChan, dataChan, errChan, &wg)
+	wg.Wait()
+
+	s := progress.snapshot(time.Now())
+	if s.totalBytes != int64(len(csvContent)) || s.bytesRead != int64(len(csvContent)) {
+		t.Errorf("Expected %d of %d bytes read, got %d of %d", len(csvContent), len(csvContent), s.bytesRead, s.totalBytes)
+	}
+	if s.rows != 2 {
+		t.Errorf("Expected 2 rows, got %d", s.rows)
+	}
+	if s.percent() != 100 {
+		t.Errorf("Expected 100%%, got %v", s.percent())
+	}
+	if got, want := progress.checksum(), fmt.Sprintf("%x", sha256.Sum256([]byte(csvContent))); got != want {
+		t.Errorf("Expected checksum %s, got %s", want, got)
+	}
+}
+
+func TestResolveProgressMode(t *testing.T) {
+	// A regular file is never a terminal, so auto falls back to log lines.
+	f, err := os.Open(createTestCSVFile(t, "ID\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if mode, err := resolveProgressMode("auto", f); err != nil || mode != "log" {
+		t.Errorf("Expected auto to resolve to log for a file, got %q, %v", mode, err)
+	}
+	if mode, err := resolveProgressMode("bar", f); err != nil || mode != "bar" {
+		t.Errorf("Expected bar to be kept, got %q, %v", mode, err)
+	}
+	if _, err := resolveProgressMode("loud", f); err == nil {
+		t.Errorf("Expected an error for an unknown progress mode")
+	}
+}
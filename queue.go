@@ -0,0 +1,608 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// jobsCollectionName is the queue of submitted imports, shared by every worker.
+	jobsCollectionName = "_import_jobs"
+	// jobFilesBucketName is the GridFS bucket holding the files of queued imports.
+	jobFilesBucketName = "_import_files"
+	// statusQueued marks a job waiting for a worker.
+	statusQueued = "queued"
+)
+
+var (
+	// errLeaseLost means a worker's lease on a job expired and another worker may
+	// have claimed it.
+	errLeaseLost = errors.New("lease on the job was lost")
+	// errNoSuchJob means there is no job with the given ID.
+	errNoSuchJob = errors.New("no such import")
+	// errJobFinished means a job can no longer be canceled.
+	errJobFinished = errors.New("the import has already finished")
+)
+
+// queuedJob is an import in the jobs collection.
+type queuedJob struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Status      string             `bson:"status" json:"status"` // queued, running, then the report's status or canceled
+	Options     map[string]string  `bson:"options" json:"options"`
+	FileID      primitive.ObjectID `bson:"fileId" json:"-"`
+	FileName    string             `bson:"fileName" json:"fileName"`
+	SubmittedAt time.Time          `bson:"submittedAt" json:"submittedAt"`
+	// Attempts counts the claims of the job; a worker that stops heartbeating loses
+	// its claim and the job is claimed again until MaxAttempts is reached.
+	Attempts        int        `bson:"attempts" json:"attempts"`
+	MaxAttempts     int        `bson:"maxAttempts" json:"maxAttempts"`
+	Worker          string     `bson:"worker,omitempty" json:"worker,omitempty"`
+	LeaseExpiresAt  *time.Time `bson:"leaseExpiresAt,omitempty" json:"leaseExpiresAt,omitempty"`
+	HeartbeatAt     *time.Time `bson:"heartbeatAt,omitempty" json:"heartbeatAt,omitempty"`
+	CancelRequested bool       `bson:"cancelRequested,omitempty" json:"cancelRequested,omitempty"`
+	StartedAt       *time.Time `bson:"startedAt,omitempty" json:"startedAt,omitempty"`
+	FinishedAt      *time.Time `bson:"finishedAt,omitempty" json:"finishedAt,omitempty"`
+	RunID           string     `bson:"runId,omitempty" json:"runId,omitempty"`
+	ExitCode        *int       `bson:"exitCode,omitempty" json:"exitCode,omitempty"`
+	Error           string     `bson:"error,omitempty" json:"error,omitempty"`
+	Rows            *rowCounts `bson:"rows,omitempty" json:"rows,omitempty"`
+}
+
+// jobQueue is the queue of imports stored in the jobs collection, with their files
+// in GridFS, so any replica can submit a job and any worker can run it.
+type jobQueue struct {
+	coll  *mongo.Collection
+	files *gridfs.Bucket
+	lease time.Duration // how long a claim lasts without a heartbeat
+}
+
+// newJobQueue returns the queue in db, making sure the jobs collection is indexed
+// for claiming.
+func newJobQueue(ctx context.Context, db *mongo.Database, lease time.Duration) (*jobQueue, error) {
+	coll := db.Collection(jobsCollectionName)
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "status", Value: 1}, {Key: "submittedAt", Value: 1}},
+		Options: options.Index().SetName("status_submittedAt"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create index on %s: %w", jobsCollectionName, err)
+	}
+	files, err := gridfs.NewBucket(db, options.GridFSBucket().SetName(jobFilesBucketName))
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %w", jobFilesBucketName, err)
+	}
+	return &jobQueue{coll: coll, files: files, lease: lease}, nil
+}
+
+// enqueue stores a file and queues its import with options. A job that cannot be
+// run again safely gets a single attempt, whatever maxAttempts asks for.
+func (q *jobQueue) enqueue(ctx context.Context, fileName string, file io.Reader, options map[string]string, maxAttempts int) (*queuedJob, error) {
+	if !rerunnable(options) {
+		maxAttempts = 1
+	}
+	fileID, err := q.files.UploadFromStream(fileName, file)
+	if err != nil {
+		return nil, fmt.Errorf("could not store %s: %w", fileName, err)
+	}
+	if options == nil {
+		options = map[string]string{}
+	}
+	job := &queuedJob{
+		ID:          primitive.NewObjectID(),
+		Status:      statusQueued,
+		Options:     options,
+		FileID:      fileID,
+		FileName:    fileName,
+		SubmittedAt: time.Now().UTC(),
+		MaxAttempts: maxAttempts,
+	}
+	if _, err := q.coll.InsertOne(ctx, job); err != nil {
+		q.deleteFile(ctx, fileID)
+		return nil, fmt.Errorf("could not queue %s: %w", fileName, err)
+	}
+	return job, nil
+}
+
+// rerunnable reports whether an import with options can be run again from the start
+// of its file after a worker stopped partway, without loading rows twice: it upserts,
+// or its writes only reach the target once it has finished.
+func rerunnable(options map[string]string) bool {
+	switch options["mode"] {
+	case "upsert", "sync":
+		return true
+	}
+	atomic, ok := options["atomic"]
+	return ok && atomic != atomicOff
+}
+
+// claim takes the oldest job that is queued, or whose worker's lease has expired,
+// for worker. It returns nil if there is none. The update is atomic, so each claim
+// goes to exactly one worker.
+func (q *jobQueue) claim(ctx context.Context, worker string) (*queuedJob, error) {
+	now := time.Now().UTC()
+	filter := bson.M{
+		"$or": bson.A{
+			bson.M{"status": statusQueued},
+			bson.M{"status": statusRunning, "leaseExpiresAt": bson.M{"$lt": now}},
+		},
+		"cancelRequested": bson.M{"$ne": true},
+		"$expr":           bson.M{"$lt": bson.A{"$attempts", "$maxAttempts"}},
+	}
+	update := bson.M{
+		"$set": bson.M{"status": statusRunning, "worker": worker, "leaseExpiresAt": now.Add(q.lease), "heartbeatAt": now, "startedAt": now},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "submittedAt", Value: 1}}).SetReturnDocument(options.After)
+	var job queuedJob
+	err := q.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not claim a job: %w", err)
+	}
+	return &job, nil
+}
+
+// heartbeat extends worker's lease on job. It reports whether the job's cancellation
+// was requested, and returns errLeaseLost if another worker has claimed it since.
+func (q *jobQueue) heartbeat(ctx context.Context, job *queuedJob, worker string) (bool, error) {
+	now := time.Now().UTC()
+	var current queuedJob
+	err := q.coll.FindOneAndUpdate(ctx,
+		bson.M{"_id": job.ID, "status": statusRunning, "worker": worker, "attempts": job.Attempts},
+		bson.M{"$set": bson.M{"leaseExpiresAt": now.Add(q.lease), "heartbeatAt": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&current)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, errLeaseLost
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not renew lease on job %s: %w", job.ID.Hex(), err)
+	}
+	return current.CancelRequested, nil
+}
+
+// finish records how worker's run of job ended and deletes its file.
+func (q *jobQueue) finish(ctx context.Context, job *queuedJob, worker string, result queuedJob) error {
+	now := time.Now().UTC()
+	set := bson.M{"status": result.Status, "finishedAt": now, "exitCode": result.ExitCode, "runId": result.RunID, "error": result.Error}
+	if result.Rows != nil {
+		set["rows"] = result.Rows
+	}
+	updated, err := q.coll.UpdateOne(ctx,
+		bson.M{"_id": job.ID, "status": statusRunning, "worker": worker, "attempts": job.Attempts},
+		bson.M{"$set": set, "$unset": bson.M{"leaseExpiresAt": ""}},
+	)
+	if err != nil {
+		return fmt.Errorf("could not record result of job %s: %w", job.ID.Hex(), err)
+	}
+	if updated.MatchedCount == 0 {
+		return errLeaseLost
+	}
+	q.deleteFile(ctx, job.FileID)
+	return nil
+}
+
+// expire ends the jobs whose worker's lease has expired and that must not be claimed
+// again: canceled ones, and those out of attempts. It returns how many it ended.
+func (q *jobQueue) expire(ctx context.Context) (int, error) {
+	expired := bson.M{"status": statusRunning, "leaseExpiresAt": bson.M{"$lt": time.Now().UTC()}}
+	ends := []struct {
+		filter  bson.M
+		status  string
+		message string
+	}{
+		{bson.M{"cancelRequested": true}, statusCanceled, "canceled by request"},
+		{bson.M{"$expr": bson.M{"$gte": bson.A{"$attempts", "$maxAttempts"}}}, statusFailed, "the workers running it stopped renewing their lease"},
+	}
+	var n int
+	for _, end := range ends {
+		filter := bson.M{"$and": bson.A{expired, end.filter}}
+		for {
+			var job queuedJob
+			err := q.coll.FindOneAndUpdate(ctx, filter, bson.M{
+				"$set":   bson.M{"status": end.status, "finishedAt": time.Now().UTC(), "error": end.message},
+				"$unset": bson.M{"leaseExpiresAt": ""},
+			}).Decode(&job)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				break
+			}
+			if err != nil {
+				return n, fmt.Errorf("could not end expired jobs: %w", err)
+			}
+			q.deleteFile(ctx, job.FileID)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// cancel cancels a job: a queued one at once, a running one by asking its worker,
+// which notices on its next heartbeat. It returns the job as it now stands.
+func (q *jobQueue) cancel(ctx context.Context, id primitive.ObjectID) (*queuedJob, error) {
+	after := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var job queuedJob
+	err := q.coll.FindOneAndUpdate(ctx, bson.M{"_id": id, "status": statusQueued},
+		bson.M{"$set": bson.M{"status": statusCanceled, "finishedAt": time.Now().UTC(), "error": "canceled by request"}}, after).Decode(&job)
+	if err == nil {
+		q.deleteFile(ctx, job.FileID)
+		return &job, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("could not cancel job %s: %w", id.Hex(), err)
+	}
+	err = q.coll.FindOneAndUpdate(ctx, bson.M{"_id": id, "status": statusRunning},
+		bson.M{"$set": bson.M{"cancelRequested": true}}, after).Decode(&job)
+	if err == nil {
+		return &job, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("could not cancel job %s: %w", id.Hex(), err)
+	}
+	current, err := q.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return current, errJobFinished
+}
+
+// get returns the job with id, or errNoSuchJob.
+func (q *jobQueue) get(ctx context.Context, id primitive.ObjectID) (*queuedJob, error) {
+	var job queuedJob
+	err := q.coll.FindOne(ctx, bson.M{"_id": id}).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errNoSuchJob
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read job %s: %w", id.Hex(), err)
+	}
+	return &job, nil
+}
+
+// list returns the most recently submitted jobs, newest first.
+func (q *jobQueue) list(ctx context.Context, limit int64) ([]queuedJob, error) {
+	cursor, err := q.coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "submittedAt", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		return nil, fmt.Errorf("could not list jobs: %w", err)
+	}
+	jobs := []queuedJob{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, fmt.Errorf("could not list jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// deleteFile removes a job's file once it is no longer needed. A failure only
+// leaves the file behind, so it is logged rather than returned.
+func (q *jobQueue) deleteFile(ctx context.Context, fileID primitive.ObjectID) {
+	if err := q.files.DeleteContext(ctx, fileID); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+		slog.Warn("Could not delete job file", "stage", "queue", "file_id", fileID.Hex(), "error", err)
+	}
+}
+
+// queueWorker runs the jobs it claims from a queue, one at a time, each in a child
+// process as the watch subcommand does, with the job's file streamed into it.
+type queueWorker struct {
+	queue     *jobQueue
+	id        string
+	exe       string
+	baseArgs  []string // the worker's import flags, after a job's options so they take precedence
+	heartbeat time.Duration
+	reportDir string
+}
+
+// run runs job and records its result.
+func (w *queueWorker) run(ctx context.Context, job *queuedJob) error {
+	file, err := w.queue.files.OpenDownloadStream(job.FileID)
+	if err != nil {
+		code := 1
+		return w.queue.finish(ctx, job, w.id, queuedJob{Status: statusFailed, ExitCode: &code, Error: "could not read the job's file: " + err.Error()})
+	}
+	defer file.Close()
+
+	reportPath := filepath.Join(w.reportDir, job.ID.Hex()+".json")
+	defer os.Remove(reportPath)
+	importCtx, interrupt := context.WithCancel(context.Background()) // Not ctx: a stopping worker lets the import finish
+	defer interrupt()
+	cmd := exec.CommandContext(importCtx, w.exe, importCommandArgs(job.Options, reportPath, w.baseArgs)...)
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = importCancelGrace
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = file, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not start import of job %s: %w", job.ID.Hex(), err)
+	}
+
+	var canceled, lost bool
+	exited, heartbeatDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		ticker := time.NewTicker(w.heartbeat)
+		defer ticker.Stop()
+		// Once the lease runs out another worker may claim the job, so the import must
+		// stop then even if the lease could not be renewed because the server is out of reach.
+		renewed := time.Now()
+		if job.HeartbeatAt != nil {
+			renewed = *job.HeartbeatAt // Set by the claim
+		}
+		expires := renewed.Add(w.queue.lease)
+		for {
+			leaseTimer := time.NewTimer(time.Until(expires))
+			var stop, expired bool
+			select {
+			case <-exited:
+				stop = true
+			case <-leaseTimer.C:
+				expired = true
+			case <-ticker.C:
+			}
+			leaseTimer.Stop()
+			if stop {
+				return
+			}
+			if expired {
+				slog.Error("Lease on job ran out without a heartbeat; interrupting import", "stage", "queue", "job_id", job.ID.Hex())
+				lost = true
+				interrupt()
+				return
+			}
+			attempted := time.Now()
+			heartbeatCtx, cancelHeartbeat := context.WithTimeout(context.Background(), min(w.heartbeat, time.Until(expires)))
+			cancel, err := w.queue.heartbeat(heartbeatCtx, job, w.id)
+			cancelHeartbeat()
+			switch {
+			case errors.Is(err, errLeaseLost):
+				// Another worker may be running the job already; this run's result would be discarded.
+				slog.Error("Lost lease on job; interrupting import", "stage", "queue", "job_id", job.ID.Hex())
+				lost = true
+				interrupt()
+				return
+			case err != nil:
+				slog.Warn("Heartbeat failed", "stage", "queue", "job_id", job.ID.Hex(), "lease_expires_at", expires, "error", err)
+				continue
+			case cancel:
+				slog.Info("Job canceled; interrupting import", "stage", "queue", "job_id", job.ID.Hex())
+				canceled = true
+				interrupt()
+				return
+			}
+			// Counted from before the heartbeat was sent, so it never ends after the stored lease.
+			expires = attempted.Add(w.queue.lease)
+		}
+	}()
+	cmd.Wait() // The exit code and report tell how it went
+	close(exited)
+	<-heartbeatDone
+	if lost {
+		return errLeaseLost
+	}
+
+	code := cmd.ProcessState.ExitCode()
+	result := queuedJob{Status: statusFailed, ExitCode: &code}
+	if report, err := readRunReport(reportPath); err == nil {
+		result.Status, result.RunID, result.Error, result.Rows = report.Status, report.RunID, report.Error, &report.Rows
+	}
+	switch {
+	case canceled:
+		result.Status, result.Error = statusCanceled, "canceled by request"
+	case result.Error == "" && code != 0:
+		result.Error = fmt.Sprintf("import exited with code %d", code)
+	}
+	if err := w.queue.finish(ctx, job, w.id, result); err != nil {
+		return err
+	}
+	slog.Info("Job finished", "stage", "queue", "job_id", job.ID.Hex(), "status", result.Status, "exit_code", code, "import_run_id", result.RunID)
+	return nil
+}
+
+// parseJobOptions parses name=value pairs given with -set into job options.
+func parseJobOptions(pairs []string) (map[string]string, error) {
+	options := map[string]string{}
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid option %q (want name=value)", pair)
+		}
+		if err := setOption(options, name, value); err != nil {
+			return nil, err
+		}
+	}
+	return options, nil
+}
+
+// runEnqueue implements the enqueue subcommand, which submits a file to the job
+// queue, and returns the process exit code. It prints the job's ID.
+func runEnqueue(args []string) int {
+	fs := flag.NewFlagSet("enqueue", flag.ContinueOnError)
+	connFlags := registerConnFlags(fs)
+	dbNamePtr := fs.String("dbName", "bulkcsv", "Database holding the job queue.")
+	csvFilePtr := fs.String("csvFile", "", "CSV file to import (required), or - for standard input.")
+	maxAttemptsPtr := fs.Int("maxAttempts", 3, "Times the job is claimed before it fails, when workers stop while running it. A job that would insert rows twice if run again gets one attempt.")
+	var pairs []string
+	fs.Func("set", "Import option as name=value, e.g. -set collectionName=orders; repeatable. Options are those of POST /imports.", func(s string) error {
+		pairs = append(pairs, s)
+		return nil
+	})
+	logFlags := registerLogFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *csvFilePtr == "" {
+		fmt.Fprintln(os.Stderr, "enqueue: -csvFile is required")
+		fs.Usage()
+		return 2
+	}
+	options, err := parseJobOptions(pairs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "enqueue:", err)
+		return 2
+	}
+	if *maxAttemptsPtr < 1 {
+		fmt.Fprintln(os.Stderr, "enqueue: -maxAttempts must be at least 1")
+		return 2
+	}
+	if _, err := connFlags.clientOptions(); err != nil {
+		fmt.Fprintln(os.Stderr, redact(err.Error()))
+		return 2
+	}
+	logger, _, err := logFlags.newLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	slog.SetDefault(logger)
+
+	file := os.Stdin
+	if *csvFilePtr != "-" {
+		if file, err = os.Open(*csvFilePtr); err != nil {
+			slog.Error("Cannot open file", "stage", "queue", "error", err)
+			return 1
+		}
+		defer file.Close()
+	}
+	ctx := context.Background()
+	client, err := connectToDB(ctx, connFlags)
+	if err != nil {
+		slog.Error("MongoDB connection error", "stage", "connect", "error", err)
+		return 1
+	}
+	defer func() {
+		if err := client.Disconnect(context.TODO()); err != nil {
+			slog.Error("Error disconnecting from MongoDB", "stage", "finalize", "error", err)
+		}
+	}()
+	queue, err := newJobQueue(ctx, client.Database(*dbNamePtr), 0)
+	if err != nil {
+		slog.Error("Job queue error", "stage", "queue", "error", err)
+		return 1
+	}
+	job, err := queue.enqueue(ctx, filepath.Base(*csvFilePtr), file, options, *maxAttemptsPtr)
+	if err != nil {
+		slog.Error("Could not queue import", "stage", "queue", "error", err)
+		return 1
+	}
+	slog.Info("Import queued", "stage", "queue", "job_id", job.ID.Hex(), "file", *csvFilePtr, "options", options)
+	fmt.Println(job.ID.Hex())
+	return 0
+}
+
+// runWorker implements the worker subcommand, which runs the imports in the job
+// queue until it is interrupted, and returns the process exit code. Flags after --
+// are passed to each import, along with the worker's connection flags.
+func runWorker(args []string) int {
+	fs := flag.NewFlagSet("worker", flag.ContinueOnError)
+	connFlags := registerConnFlags(fs)
+	dbNamePtr := fs.String("dbName", "bulkcsv", "Database holding the job queue.")
+	hostname, _ := os.Hostname()
+	workerIDPtr := fs.String("workerId", fmt.Sprintf("%s-%d", hostname, os.Getpid()), "Name recorded on the jobs this worker claims.")
+	pollIntervalPtr := fs.Duration("pollInterval", 5*time.Second, "How long to wait before looking again when the queue is empty.")
+	leaseDurationPtr := fs.Duration("leaseDuration", 2*time.Minute, "How long a claimed job stays with this worker without a heartbeat before others may claim it.")
+	heartbeatIntervalPtr := fs.Duration("heartbeatInterval", 30*time.Second, "How often the lease on a running job is renewed. Must be well below -leaseDuration.")
+	logFlags := registerLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: bulk-csv-processor worker [worker flags] [-- import flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := checkImportArgs(fs.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "worker:", err)
+		return 2
+	}
+	if *pollIntervalPtr <= 0 || *heartbeatIntervalPtr <= 0 || *heartbeatIntervalPtr >= *leaseDurationPtr {
+		fmt.Fprintln(os.Stderr, "worker: -pollInterval and -heartbeatInterval must be positive, and -heartbeatInterval below -leaseDuration")
+		return 2
+	}
+	if _, err := connFlags.clientOptions(); err != nil {
+		fmt.Fprintln(os.Stderr, redact(err.Error()))
+		return 2
+	}
+	logger, _, err := logFlags.newLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	slog.SetDefault(logger.With("worker", *workerIDPtr))
+	exe, err := os.Executable()
+	if err != nil {
+		slog.Error("Cannot find the importer executable", "stage", "queue", "error", err)
+		return 1
+	}
+	reportDir, err := os.MkdirTemp("", "bulk-csv-worker")
+	if err != nil {
+		slog.Error("Cannot create report directory", "stage", "queue", "error", err)
+		return 1
+	}
+	defer os.RemoveAll(reportDir)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	client, err := connectToDB(ctx, connFlags)
+	if err != nil {
+		slog.Error("MongoDB connection error", "stage", "connect", "error", err)
+		return 1
+	}
+	defer func() {
+		if err := client.Disconnect(context.TODO()); err != nil {
+			slog.Error("Error disconnecting from MongoDB", "stage", "finalize", "error", err)
+		}
+	}()
+	queue, err := newJobQueue(ctx, client.Database(*dbNamePtr), *leaseDurationPtr)
+	if err != nil {
+		slog.Error("Job queue error", "stage", "queue", "error", err)
+		return 1
+	}
+	w := &queueWorker{
+		queue:     queue,
+		id:        *workerIDPtr,
+		exe:       exe,
+		baseArgs:  append(connFlags.args(), fs.Args()...),
+		heartbeat: *heartbeatIntervalPtr,
+		reportDir: reportDir,
+	}
+	slog.Info("Worker started", "stage", "queue", "db", *dbNamePtr, "lease", leaseDurationPtr.String(), "import_args", fs.Args())
+
+	for ctx.Err() == nil {
+		if n, err := queue.expire(ctx); err != nil {
+			slog.Warn("Could not end expired jobs", "stage", "queue", "error", err)
+		} else if n > 0 {
+			slog.Warn("Ended jobs whose workers stopped", "stage", "queue", "jobs", n)
+		}
+		job, err := queue.claim(ctx, w.id)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Job queue error", "stage", "queue", "error", err)
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(*pollIntervalPtr):
+			}
+			continue
+		}
+		slog.Info("Claimed job", "stage", "queue", "job_id", job.ID.Hex(), "file", job.FileName, "attempt", job.Attempts, "options", job.Options)
+		// A job claimed before the interrupt still runs to the end, with a fresh context.
+		if err := w.run(context.Background(), job); err != nil {
+			slog.Error("Job error", "stage", "queue", "job_id", job.ID.Hex(), "error", err)
+		}
+	}
+	slog.Info("Worker stopped", "stage", "queue")
+	return 0
+}
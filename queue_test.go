@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestJobQueue(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	newQueue := func(mt *mtest.T) *jobQueue {
+		files, err := gridfs.NewBucket(mt.DB)
+		if err != nil {
+			mt.Fatal(err)
+		}
+		return &jobQueue{coll: mt.Coll, files: files, lease: 0}
+	}
+	found := func(doc bson.D) bson.D {
+		return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: doc})
+	}
+	none := mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil})
+	id := primitive.NewObjectID()
+
+	mt.Run("Claim", func(mt *mtest.T) {
+		mt.AddMockResponses(found(bson.D{{Key: "_id", Value: id}, {Key: "status", Value: statusRunning}, {Key: "attempts", Value: 1}}))
+		job, err := newQueue(mt).claim(context.Background(), "w1")
+		if err != nil || job == nil || job.ID != id || job.Attempts != 1 {
+			t.Fatalf("Expected job %s on its first attempt, got %+v (%v)", id.Hex(), job, err)
+		}
+		started := mt.GetStartedEvent()
+		if started.CommandName != "findAndModify" {
+			t.Fatalf("Expected findAndModify, got %s", started.CommandName)
+		}
+		if worker := started.Command.Lookup("update", "$set", "worker").StringValue(); worker != "w1" {
+			t.Errorf("Expected the job to be claimed for w1, got %s", worker)
+		}
+		if _, err := started.Command.LookupErr("query", "$expr"); err != nil {
+			t.Errorf("Expected jobs out of attempts to be left alone, got %s", started.Command)
+		}
+	})
+
+	mt.Run("ClaimExpiredLease", func(mt *mtest.T) {
+		mt.AddMockResponses(found(bson.D{{Key: "_id", Value: id}, {Key: "status", Value: statusRunning}, {Key: "worker", Value: "w2"}, {Key: "attempts", Value: 2}}))
+		job, err := newQueue(mt).claim(context.Background(), "w2")
+		if err != nil || job == nil || job.Attempts != 2 || job.Worker != "w2" {
+			t.Fatalf("Expected job %s on its second attempt for w2, got %+v (%v)", id.Hex(), job, err)
+		}
+		started := mt.GetStartedEvent()
+		expired, err := started.Command.LookupErr("query", "$or", "1")
+		if err != nil {
+			t.Fatalf("Expected running jobs to be claimable, got %s", started.Command)
+		}
+		if status := expired.Document().Lookup("status").StringValue(); status != statusRunning {
+			t.Errorf("Expected a running job to be claimed again, got status %s", status)
+		}
+		if _, err := expired.Document().LookupErr("leaseExpiresAt", "$lt"); err != nil {
+			t.Errorf("Expected only a running job whose lease has expired to be claimed, got %s", expired)
+		}
+		if inc := started.Command.Lookup("update", "$inc", "attempts").AsInt64(); inc != 1 {
+			t.Errorf("Expected the claim to count an attempt, got %d", inc)
+		}
+	})
+
+	mt.Run("ClaimEmpty", func(mt *mtest.T) {
+		mt.AddMockResponses(none)
+		if job, err := newQueue(mt).claim(context.Background(), "w1"); job != nil || err != nil {
+			t.Errorf("Expected no job and no error, got %+v (%v)", job, err)
+		}
+	})
+
+	mt.Run("Heartbeat", func(mt *mtest.T) {
+		mt.AddMockResponses(found(bson.D{{Key: "_id", Value: id}, {Key: "cancelRequested", Value: true}}))
+		cancel, err := newQueue(mt).heartbeat(context.Background(), &queuedJob{ID: id, Attempts: 2}, "w1")
+		if err != nil || !cancel {
+			t.Errorf("Expected the cancellation request to be reported, got %v (%v)", cancel, err)
+		}
+		if attempts := mt.GetStartedEvent().Command.Lookup("query", "attempts").AsInt64(); attempts != 2 {
+			t.Errorf("Expected the lease to be renewed only for attempt 2, got %d", attempts)
+		}
+	})
+
+	mt.Run("HeartbeatLeaseLost", func(mt *mtest.T) {
+		mt.AddMockResponses(none)
+		if _, err := newQueue(mt).heartbeat(context.Background(), &queuedJob{ID: id}, "w1"); !errors.Is(err, errLeaseLost) {
+			t.Errorf("Expected errLeaseLost, got %v", err)
+		}
+	})
+
+	mt.Run("FinishLeaseLost", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}))
+		err := newQueue(mt).finish(context.Background(), &queuedJob{ID: id}, "w1", queuedJob{Status: statusSucceeded})
+		if !errors.Is(err, errLeaseLost) {
+			t.Errorf("Expected errLeaseLost, got %v", err)
+		}
+	})
+
+	mt.Run("CancelRunning", func(mt *mtest.T) {
+		mt.AddMockResponses(none, found(bson.D{{Key: "_id", Value: id}, {Key: "status", Value: statusRunning}, {Key: "cancelRequested", Value: true}}))
+		job, err := newQueue(mt).cancel(context.Background(), id)
+		if err != nil || !job.CancelRequested {
+			t.Errorf("Expected the worker to be asked to cancel, got %+v (%v)", job, err)
+		}
+	})
+
+	mt.Run("CancelFinished", func(mt *mtest.T) {
+		mt.AddMockResponses(none, none, mtest.CreateCursorResponse(0, "db.coll", mtest.FirstBatch,
+			bson.D{{Key: "_id", Value: id}, {Key: "status", Value: statusSucceeded}}))
+		if _, err := newQueue(mt).cancel(context.Background(), id); !errors.Is(err, errJobFinished) {
+			t.Errorf("Expected errJobFinished, got %v", err)
+		}
+	})
+
+	mt.Run("CancelUnknown", func(mt *mtest.T) {
+		mt.AddMockResponses(none, none, mtest.CreateCursorResponse(0, "db.coll", mtest.FirstBatch))
+		if _, err := newQueue(mt).cancel(context.Background(), id); !errors.Is(err, errNoSuchJob) {
+			t.Errorf("Expected errNoSuchJob, got %v", err)
+		}
+	})
+}
+
+func TestRerunnable(t *testing.T) {
+	tests := []struct {
+		options map[string]string
+		want    bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{"mode": "insert"}, false},
+		{map[string]string{"mode": "insert", "atomic": atomicOff}, false},
+		{map[string]string{"mode": "upsert"}, true},
+		{map[string]string{"mode": "sync"}, true},
+		{map[string]string{"atomic": atomicSwap}, true},
+	}
+	for _, tt := range tests {
+		if got := rerunnable(tt.options); got != tt.want {
+			t.Errorf("Expected rerunnable(%v) = %v, got %v", tt.options, tt.want, got)
+		}
+	}
+}
+
+func TestParseJobOptions(t *testing.T) {
+	options, err := parseJobOptions([]string{"collectionName=orders", "mode=upsert"})
+	if err != nil || options["collectionName"] != "orders" || options["mode"] != "upsert" {
+		t.Errorf("Expected both options, got %v (%v)", options, err)
+	}
+	if _, err := parseJobOptions([]string{"collectionName"}); err == nil {
+		t.Errorf("Expected an error for an option without a value")
+	}
+	if _, err := parseJobOptions([]string{"mongoURI=mongodb://x"}); err == nil {
+		t.Errorf("Expected an error for an option a job cannot set")
+	}
+}
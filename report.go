@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Reasons a row can be rejected. They key rowCounts.RejectedByReason and label sample errors.
+const (
+	reasonParseError      = "parse_error"
+	reasonFieldMismatch   = "field_count_mismatch"
+	reasonTypeError       = "type_error"       // a value does not parse as its schema type, or a required one is empty
+	reasonValidationError = "validation_error" // the server's document validator rejected the row
+	reasonRoutingError    = "routing_error"    // the templated -collectionName could not be rendered for the row
+	reasonWriteError      = "write_error"
+)
+
+// Run statuses written to the report.
+const (
+	statusSucceeded           = "succeeded"
+	statusCompletedWithErrors = "completed_with_errors"
+	statusFailed              = "failed"
+)
+
+// rowCounts tallies data rows by outcome. Every row read ends up in exactly one of
+// the other counters, so Read = Inserted + Upserted + Filtered + Rejected.
+type rowCounts struct {
+	Read             int64            `json:"read" bson:"read"`
+	Inserted         int64            `json:"inserted" bson:"inserted"`
+	Upserted         int64            `json:"upserted" bson:"upserted"`
+	Filtered         int64            `json:"filtered" bson:"filtered"`
+	Rejected         int64            `json:"rejected" bson:"rejected"`
+	RejectedByReason map[string]int64 `json:"rejectedByReason" bson:"rejectedByReason"`
+	// Retries counts write attempts repeated after a transient error. It is not a row outcome.
+	Retries int64 `json:"retries" bson:"retries"`
+	// Deleted counts documents -mode sync deleted because the file did not have them.
+	// It is not a row outcome either.
+	Deleted int64 `json:"deleted" bson:"deleted"`
+}
+
+// destinationCounts tallies the rows a run routed to one collection.
+type destinationCounts struct {
+	Collection string `json:"collection"`
+	Inserted   int64  `json:"inserted"`
+	Upserted   int64  `json:"upserted"`
+	Rejected   int64  `json:"rejected"`
+	Error      string `json:"error,omitempty"` // why the collection could not be prepared
+}
+
+// sampleError is one rejected row kept for the report.
+type sampleError struct {
+	Line    int    `json:"line"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// importStats accumulates row outcomes during a run. It is only touched by the
+// goroutine driving the import, so it needs no locking.
+type importStats struct {
+	rows          rowCounts
+	samples       []sampleError
+	maxSamples    int
+	droppedSample int64
+	destinations  map[string]*destinationCounts
+}
+
+// newImportStats returns stats that keep at most maxSamples sample errors.
+func newImportStats(maxSamples int) *importStats {
+	return &importStats{
+		rows:         rowCounts{RejectedByReason: map[string]int64{}},
+		maxSamples:   maxSamples,
+		destinations: map[string]*destinationCounts{},
+	}
+}
+
+// destination returns the counts of rows routed to collection, and whether any
+// row was routed there before.
+func (s *importStats) destination(collection string) (*destinationCounts, bool) {
+	counts, ok := s.destinations[collection]
+	if !ok {
+		counts = &destinationCounts{Collection: collection}
+		s.destinations[collection] = counts
+	}
+	return counts, ok
+}
+
+// destinationSummary returns the counts of every destination, by collection name.
+func (s *importStats) destinationSummary() []destinationCounts {
+	summary := make([]destinationCounts, 0, len(s.destinations))
+	for _, counts := range s.destinations {
+		summary = append(summary, *counts)
+	}
+	slices.SortFunc(summary, func(a, b destinationCounts) int { return strings.Compare(a.Collection, b.Collection) })
+	return summary
+}
+
+// reject counts a rejected row and keeps it as a sample while there is room.
+// line is 0 when the row's position is unknown.
+func (s *importStats) reject(line int, reason string, err error) {
+	s.rows.Rejected++
+	s.rows.RejectedByReason[reason]++
+	if len(s.samples) < s.maxSamples {
+		s.samples = append(s.samples, sampleError{Line: line, Reason: reason, Message: redact(err.Error())})
+	} else {
+		s.droppedSample++
+	}
+}
+
+// inputFile describes one input file in the report.
+type inputFile struct {
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"sizeBytes"`
+	SHA256    string `json:"sha256,omitempty"` // empty if the file was not read to the end
+}
+
+// throughput summarises how fast the run went.
+type throughput struct {
+	ElapsedSeconds float64 `json:"elapsedSeconds"`
+	BytesRead      int64   `json:"bytesRead"`
+	RowsPerSecond  float64 `json:"rowsPerSecond"`
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+}
+
+// writeSettings records how rows were written.
+type writeSettings struct {
+	Concern   string `json:"concern"` // as configured, or "server default"
+	Ordered   bool   `json:"ordered"`
+	BatchSize int    `json:"batchSize"`
+	Writers   int    `json:"writers"`
+	// MaxRowsPerSec and MaxBytesPerSec are the caps on the write rate; 0 is none.
+	MaxRowsPerSec  float64 `json:"maxRowsPerSec,omitempty"`
+	MaxBytesPerSec float64 `json:"maxBytesPerSec,omitempty"`
+	// Adaptive records how -adaptive sized the writes.
+	Adaptive *adaptiveSummary `json:"adaptive,omitempty"`
+}
+
+// runReport is the machine-readable summary written by -report.
+type runReport struct {
+	RunID      string        `json:"runId"`
+	Status     string        `json:"status"`
+	ExitCode   int           `json:"exitCode"`
+	Error      string        `json:"error,omitempty"`
+	StartedAt  time.Time     `json:"startedAt"`
+	FinishedAt time.Time     `json:"finishedAt"`
+	Database   string        `json:"database"`
+	Collection string        `json:"collection"`
+	Write      writeSettings `json:"write"`
+	Inputs     []inputFile   `json:"inputs"`
+	Header     []string      `json:"header"`
+	Indexes    []indexResult `json:"indexes,omitempty"`
+	Rows       rowCounts     `json:"rows"`
+	// Destinations breaks the rows down by collection when -collectionName is a template.
+	Destinations []destinationCounts `json:"destinations,omitempty"`
+	// Watermark records where an incremental load started and ended.
+	Watermark    *watermarkSummary `json:"watermark,omitempty"`
+	SampleErrors []sampleError     `json:"sampleErrors"`
+	// SampleErrorsDropped counts rejected rows beyond the sample limit.
+	SampleErrorsDropped int64      `json:"sampleErrorsDropped"`
+	Throughput          throughput `json:"throughput"`
+}
+
+// readRunReport reads a report written by writeReport, e.g. by an import run in a
+// child process.
+func readRunReport(path string) (*runReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read report %s: %w", path, err)
+	}
+	var r runReport
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("could not decode report %s: %w", path, err)
+	}
+	return &r, nil
+}
+
+// runStatus derives the report status from the exit code and row counts.
+func runStatus(exitCode int, rows rowCounts) string {
+	switch {
+	case exitCode != 0:
+		return statusFailed
+	case rows.Rejected > 0:
+		return statusCompletedWithErrors
+	default:
+		return statusSucceeded
+	}
+}
+
+// newThroughput converts a progress snapshot into report form.
+func newThroughput(s progressSnapshot) throughput {
+	return throughput{
+		ElapsedSeconds: s.elapsed.Seconds(),
+		BytesRead:      s.bytesRead,
+		RowsPerSecond:  s.rowsPerSec(),
+		BytesPerSecond: s.bytesPerSec(),
+	}
+}
+
+// writeReport writes r as indented JSON to path. The file is written under a
+// temporary name and renamed, so readers never see a half-written report.
+func writeReport(path string, r *runReport) error {
+	if r.SampleErrors == nil {
+		r.SampleErrors = []sampleError{}
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode report: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("could not create report %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write report %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write report %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not write report %s: %w", path, err)
+	}
+	return nil
+}
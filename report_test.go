@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestImportStatsReject(t *testing.T) {
+	stats := newImportStats(2)
+	stats.reject(3, reasonFieldMismatch, errors.New("number of fields (1) does not match header count (2)"))
+	stats.reject(5, reasonParseError, errors.New(`bare " in non-quoted-field`))
+	stats.reject(9, reasonFieldMismatch, errors.New("number of fields (3) does not match header count (2)"))
+
+	if stats.rows.Rejected != 3 {
+		t.Errorf("Expected 3 rejected rows, got %d", stats.rows.Rejected)
+	}
+	expectedByReason := map[string]int64{reasonFieldMismatch: 2, reasonParseError: 1}
+	if !reflect.DeepEqual(stats.rows.RejectedByReason, expectedByReason) {
+		t.Errorf("Expected rejections by reason %v, got %v", expectedByReason, stats.rows.RejectedByReason)
+	}
+	if len(stats.samples) != 2 || stats.samples[0].Line != 3 || stats.samples[1].Line != 5 {
+		t.Errorf("Expected the first two rejections as samples, got %v", stats.samples)
+	}
+	if stats.droppedSample != 1 {
+		t.Errorf("Expected 1 dropped sample, got %d", stats.droppedSample)
+	}
+}
+
+func TestRunStatus(t *testing.T) {
+	if got := runStatus(0, rowCounts{Read: 2, Inserted: 2}); got != statusSucceeded {
+		t.Errorf("Expected %s, got %s", statusSucceeded, got)
+	}
+	if got := runStatus(0, rowCounts{Read: 2, Inserted: 1, Rejected: 1}); got != statusCompletedWithErrors {
+		t.Errorf("Expected %s, got %s", statusCompletedWithErrors, got)
+	}
+	if got := runStatus(1, rowCounts{}); got != statusFailed {
+		t.Errorf("Expected %s, got %s", statusFailed, got)
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	report := &runReport{
+		RunID:      "665f1c2e9b1e8a0001a1b2c3",
+		Status:     statusSucceeded,
+		StartedAt:  started,
+		FinishedAt: started.Add(time.Minute),
+		Database:   "bulkcsv",
+		Collection: "processed_data",
+		Inputs:     []inputFile{{Path: "input.csv", SizeBytes: 42, SHA256: "abc"}},
+		Header:     []string{"Name", "Age"},
+		Rows:       rowCounts{Read: 2, Inserted: 2, RejectedByReason: map[string]int64{}},
+	}
+	if err := writeReport(path, report); err != nil {
+		t.Fatalf("writeReport failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read report: %v", err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Report is not valid JSON: %v", err)
+	}
+	if decoded["runId"] != report.RunID || decoded["status"] != statusSucceeded {
+		t.Errorf("Unexpected report contents: %s", data)
+	}
+	if samples, ok := decoded["sampleErrors"].([]any); !ok || len(samples) != 0 {
+		t.Errorf("Expected sampleErrors to be an empty list, got %v", decoded["sampleErrors"])
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the report in its directory, found %d entries", len(entries))
+	}
+}
+
+func TestDestinationSummary(t *testing.T) {
+	stats := newImportStats(0)
+	if _, seen := stats.destination("events_us"); seen {
+		t.Errorf("Expected events_us to be new")
+	}
+	counts, seen := stats.destination("events_us")
+	if !seen {
+		t.Errorf("Expected events_us to have been seen")
+	}
+	counts.Inserted = 2
+	eu, _ := stats.destination("events_eu")
+	eu.Rejected = 1
+	want := []destinationCounts{{Collection: "events_eu", Rejected: 1}, {Collection: "events_us", Inserted: 2}}
+	if got := stats.destinationSummary(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
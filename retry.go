@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Classes of write errors, as reported in logs.
+const (
+	errorClassTransient  = "transient"  // worth retrying: the same write may succeed shortly
+	errorClassDuplicate  = "duplicate"  // a unique index already holds the row's key
+	errorClassValidation = "validation" // the document failed the collection's validator
+	errorClassPermanent  = "permanent"  // anything else; retrying will not help
+)
+
+// Server error codes that mean the write did not happen for reasons unrelated to the
+// document, typically an election or a node going away.
+var transientErrorCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	64:    true, // WriteConcernFailed
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	262:   true, // ExceededTimeLimit
+	365:   true, // TemporarilyUnavailable, from a server shedding load
+	9001:  true, // SocketException
+	10107: true, // NotWritablePrimary
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotPrimaryNoSecondaryOk
+	13436: true, // NotPrimaryOrSecondary
+}
+
+// documentValidationFailure is the server error code for a document rejected by a $jsonSchema or query validator.
+const documentValidationFailure = 121
+
+// classifyWriteError sorts a write error into one of the errorClass values.
+func classifyWriteError(err error) string {
+	switch {
+	case mongo.IsDuplicateKeyError(err):
+		return errorClassDuplicate
+	case mongo.IsNetworkError(err), mongo.IsTimeout(err):
+		return errorClassTransient
+	}
+
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return errorClassPermanent
+	}
+	if serverErr.HasErrorCode(documentValidationFailure) {
+		return errorClassValidation
+	}
+	if serverErr.HasErrorLabel("RetryableWriteError") {
+		return errorClassTransient
+	}
+	for code := range transientErrorCodes {
+		if serverErr.HasErrorCode(code) {
+			return errorClassTransient
+		}
+	}
+	// A write that was applied but not acknowledged by enough members in time.
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) && writeErr.WriteConcernError != nil && len(writeErr.WriteErrors) == 0 {
+		return errorClassTransient
+	}
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError != nil && len(bulkErr.WriteErrors) == 0 {
+		return errorClassTransient
+	}
+	return errorClassPermanent
+}
+
+// retryPolicy retries transient write errors with jittered exponential backoff.
+type retryPolicy struct {
+	maxRetries int           // retries after the first attempt; 0 disables retrying
+	baseDelay  time.Duration // upper bound of the first backoff
+	maxDelay   time.Duration // cap on any single backoff
+}
+
+// backoff returns how long to wait before the given retry (1 for the first). The delay
+// is drawn uniformly from [0, min(maxDelay, baseDelay*2^(retry-1))] ("full jitter"),
+// so that many writers failing together do not retry in lockstep.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	limit := p.maxDelay
+	if shift := retry - 1; shift < 32 && p.baseDelay<<shift > 0 && p.baseDelay<<shift < limit {
+		limit = p.baseDelay << shift
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(limit) + 1))
+}
+
+// do calls write until it succeeds, fails with an error that is not transient, the
+// retries are used up, or ctx is done. It returns the number of retries made and
+// the last error.
+func (p retryPolicy) do(ctx context.Context, write func() error) (int, error) {
+	retries := 0
+	for {
+		err := write()
+		if err == nil || retries >= p.maxRetries || classifyWriteError(err) != errorClassTransient {
+			return retries, err
+		}
+		retries++
+		select {
+		case <-time.After(p.backoff(retries)):
+		case <-ctx.Done():
+			return retries, errors.Join(err, ctx.Err())
+		}
+	}
+}
+
+// isDuplicateID reports whether err is a duplicate key error on the _id index.
+func isDuplicateID(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCodeWithMessage(11000, "index: _id_ ")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestClassifyWriteError(t *testing.T) {
+	dupID := mongo.WriteException{WriteErrors: []mongo.WriteError{{
+		Code:    11000,
+		Message: `E11000 duplicate key error collection: bulkcsv.processed_data index: _id_ dup key: { _id: 1 }`,
+	}}}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"NotWritablePrimary", mongo.CommandError{Code: 10107, Name: "NotWritablePrimary"}, errorClassTransient},
+		{"RetryableWriteLabel", mongo.CommandError{Code: 1, Labels: []string{"RetryableWriteError"}}, errorClassTransient},
+		{"WriteConcernTimeout", mongo.WriteException{WriteConcernError: &mongo.WriteConcernError{Code: 64, Name: "WriteConcernFailed"}}, errorClassTransient},
+		{"Timeout", fmt.Errorf("could not insert data: %w", context.DeadlineExceeded), errorClassTransient},
+		{"DuplicateKey", fmt.Errorf("could not insert data: %w", dupID), errorClassDuplicate},
+		{"Validation", mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 121, Message: "Document failed validation"}}}, errorClassValidation},
+		{"Other", errors.New("boom"), errorClassPermanent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyWriteError(tt.err); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	if !isDuplicateID(dupID) {
+		t.Errorf("Expected duplicate key on _id_ to be recognised")
+	}
+	other := mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000, Message: "E11000 duplicate key error collection: bulkcsv.processed_data index: Name_1 dup key: { Name: \"x\" }"}}}
+	if isDuplicateID(other) {
+		t.Errorf("Expected duplicate key on another index not to count as a duplicate _id")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	transient := mongo.CommandError{Code: 189, Name: "PrimarySteppedDown"}
+
+	t.Run("BackoffIsCapped", func(t *testing.T) {
+		p := retryPolicy{maxRetries: 10, baseDelay: 10 * time.Millisecond, maxDelay: 50 * time.Millisecond}
+		for retry := 1; retry <= 40; retry++ {
+			limit := min(p.maxDelay, p.baseDelay<<min(retry-1, 30))
+			if d := p.backoff(retry); d < 0 || d > limit {
+				t.Errorf("Retry %d: expected backoff in [0, %v], got %v", retry, limit, d)
+			}
+		}
+	})
+
+	t.Run("RetriesTransientErrors", func(t *testing.T) {
+		p := retryPolicy{maxRetries: 5, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+		calls := 0
+		retries, err := p.do(context.Background(), func() error {
+			if calls++; calls < 3 {
+				return transient
+			}
+			return nil
+		})
+		if err != nil || retries != 2 {
+			t.Errorf("Expected success after 2 retries, got %d retries and error %v", retries, err)
+		}
+	})
+
+	t.Run("GivesUp", func(t *testing.T) {
+		p := retryPolicy{maxRetries: 2, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+		retries, err := p.do(context.Background(), func() error { return transient })
+		var cmdErr mongo.CommandError
+		if !errors.As(err, &cmdErr) || cmdErr.Code != transient.Code || retries != 2 {
+			t.Errorf("Expected the transient error after 2 retries, got %d retries and error %v", retries, err)
+		}
+	})
+
+	t.Run("DoesNotRetryPermanentErrors", func(t *testing.T) {
+		p := retryPolicy{maxRetries: 5, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+		calls := 0
+		_, err := p.do(context.Background(), func() error {
+			calls++
+			return mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 121}}}
+		})
+		if err == nil || calls != 1 {
+			t.Errorf("Expected one attempt and an error, got %d attempts and error %v", calls, err)
+		}
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// beforeImagesCollectionName holds the prior version of every document an upsert
+	// replaced in a stamped run, so the run can be rolled back.
+	beforeImagesCollectionName = "_import_before_images"
+	// statusRolledBack marks a run record whose documents have been rolled back.
+	statusRolledBack = "rolled_back"
+)
+
+// beforeImage is a document as it was before a run replaced it.
+type beforeImage struct {
+	RunID      string    `bson:"runId"`
+	Collection string    `bson:"collection"`
+	DocID      any       `bson:"docId"`
+	Before     bson.Raw  `bson:"before"`
+	CapturedAt time.Time `bson:"capturedAt"`
+}
+
+// beforeImageStore records before-images for one run and collection.
+type beforeImageStore struct {
+	coll       *mongo.Collection
+	runID      string
+	collection string
+}
+
+// newBeforeImageStore returns a store for runID's writes to collection, making sure
+// the store is indexed so that only the first image of each document is kept.
+func newBeforeImageStore(ctx context.Context, db *mongo.Database, runID, collection string) (*beforeImageStore, error) {
+	coll := db.Collection(beforeImagesCollectionName)
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "runId", Value: 1}, {Key: "collection", Value: 1}, {Key: "docId", Value: 1}},
+		Options: options.Index().SetUnique(true).SetName("runId_collection_docId"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create index on %s: %w", beforeImagesCollectionName, err)
+	}
+	return &beforeImageStore{coll: coll, runID: runID, collection: collection}, nil
+}
+
+// forCollection returns a store for the same run's writes to another collection.
+func (s *beforeImageStore) forCollection(collection string) *beforeImageStore {
+	return &beforeImageStore{coll: s.coll, runID: s.runID, collection: collection}
+}
+
+// save stores before as the prior version of its document. If the run already
+// replaced the same document, the earlier (original) image is kept.
+func (s *beforeImageStore) save(ctx context.Context, before bson.Raw) error {
+	docID, err := before.LookupErr("_id")
+	if err != nil {
+		return fmt.Errorf("before-image has no _id: %w", err)
+	}
+	_, err = s.coll.InsertOne(ctx, beforeImage{
+		RunID:      s.runID,
+		Collection: s.collection,
+		DocID:      docID,
+		Before:     before,
+		CapturedAt: time.Now().UTC(),
+	})
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("could not save before-image: %w", err)
+	}
+	return nil
+}
+
+// rollbackResult counts what a rollback did, or would do in a dry run.
+type rollbackResult struct {
+	Stamped  int64 // documents in the collection stamped with the run ID
+	Restored int64 // documents restored from before-images
+	Deleted  int64 // documents the run inserted, deleted
+}
+
+// rollbackRun undoes runID's writes to coll: documents the run replaced are restored
+// from their before-images, then the documents still stamped with the run ID, which
+// are the ones it inserted, are deleted. With dryRun nothing is changed and the
+// result holds the number of documents that would be affected.
+func rollbackRun(ctx context.Context, db *mongo.Database, coll *mongo.Collection, runID string, dryRun bool) (rollbackResult, error) {
+	var result rollbackResult
+	stampFilter := bson.M{lineageField + ".runId": runID}
+	imageFilter := bson.M{"runId": runID, "collection": coll.Name()}
+	images := db.Collection(beforeImagesCollectionName)
+
+	stamped, err := coll.CountDocuments(ctx, stampFilter)
+	if err != nil {
+		return result, fmt.Errorf("could not count documents from run %s: %w", runID, err)
+	}
+	result.Stamped = stamped
+
+	if dryRun {
+		restorable, err := images.CountDocuments(ctx, imageFilter)
+		if err != nil {
+			return result, fmt.Errorf("could not count before-images of run %s: %w", runID, err)
+		}
+		result.Restored = restorable
+		// As below, a stamped document is deleted unless a before-image of it is restored.
+		cursor, err := coll.Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$match", Value: stampFilter}},
+			{{Key: "$lookup", Value: bson.D{
+				{Key: "from", Value: beforeImagesCollectionName},
+				{Key: "let", Value: bson.M{"id": "$_id"}},
+				{Key: "pipeline", Value: mongo.Pipeline{
+					{{Key: "$match", Value: bson.M{"runId": runID, "collection": coll.Name(), "$expr": bson.M{"$eq": bson.A{"$docId", "$$id"}}}}},
+					{{Key: "$limit", Value: 1}},
+				}},
+				{Key: "as", Value: "image"},
+			}}},
+			{{Key: "$match", Value: bson.M{"image": bson.M{"$size": 0}}}},
+			{{Key: "$count", Value: "n"}},
+		})
+		if err != nil {
+			return result, fmt.Errorf("could not count documents inserted by run %s: %w", runID, err)
+		}
+		var counts []struct {
+			N int64 `bson:"n"`
+		}
+		if err := cursor.All(ctx, &counts); err != nil {
+			return result, fmt.Errorf("could not count documents inserted by run %s: %w", runID, err)
+		}
+		if len(counts) > 0 {
+			result.Deleted = counts[0].N
+		}
+		return result, nil
+	}
+
+	cursor, err := images.Find(ctx, imageFilter)
+	if err != nil {
+		return result, fmt.Errorf("could not read before-images of run %s: %w", runID, err)
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var image beforeImage
+		if err := cursor.Decode(&image); err != nil {
+			return result, fmt.Errorf("could not decode before-image: %w", err)
+		}
+		_, err := coll.ReplaceOne(ctx, bson.M{"_id": image.DocID}, image.Before, options.Replace().SetUpsert(true))
+		if err != nil {
+			return result, fmt.Errorf("could not restore document %v: %w", image.DocID, err)
+		}
+		result.Restored++
+	}
+	if err := cursor.Err(); err != nil {
+		return result, fmt.Errorf("could not read before-images of run %s: %w", runID, err)
+	}
+
+	// Restored documents no longer carry the run's stamp, so this only removes inserts.
+	deleted, err := coll.DeleteMany(ctx, stampFilter)
+	if err != nil {
+		return result, fmt.Errorf("could not delete documents from run %s: %w", runID, err)
+	}
+	result.Deleted = deleted.DeletedCount
+
+	// The images have been applied; dropping them makes a repeated rollback a no-op.
+	if _, err := images.DeleteMany(ctx, imageFilter); err != nil {
+		return result, fmt.Errorf("could not remove before-images of run %s: %w", runID, err)
+	}
+	return result, nil
+}
+
+// runRollback implements the rollback subcommand and returns the process exit code.
+func runRollback(args []string) int {
+	fs := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	connFlags := registerConnFlags(fs)
+	dbNamePtr := fs.String("dbName", "bulkcsv", "MongoDB database name.")
+	collectionNamePtr := fs.String("collectionName", "processed_data", "Collection the run loaded into. Taken from the run's _import_runs record when not set.")
+	runIDPtr := fs.String("runId", "", "ID of the run to roll back (required).")
+	dryRunPtr := fs.Bool("dryRun", false, "Only report how many documents would be restored and deleted.")
+	logFlags := registerLogFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *runIDPtr == "" {
+		fmt.Fprintln(os.Stderr, "rollback: -runId is required")
+		fs.Usage()
+		return 2
+	}
+	if _, err := connFlags.clientOptions(); err != nil {
+		fmt.Fprintln(os.Stderr, redact(err.Error()))
+		return 2
+	}
+	logger, _, err := logFlags.newLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	slog.SetDefault(logger.With("run_id", *runIDPtr))
+
+	ctx := context.Background()
+	client, err := connectToDB(ctx, connFlags)
+	if err != nil {
+		slog.Error("MongoDB connection error", "stage", "connect", "error", err)
+		return 1
+	}
+	defer func() {
+		if err := client.Disconnect(context.TODO()); err != nil {
+			slog.Error("Error disconnecting from MongoDB", "stage", "finalize", "error", err)
+		}
+	}()
+	db := client.Database(*dbNamePtr)
+
+	collectionName := *collectionNamePtr
+	collectionSet := false
+	fs.Visit(func(f *flag.Flag) { collectionSet = collectionSet || f.Name == "collectionName" })
+	var record struct {
+		Collection string `bson:"collection"`
+	}
+	err = db.Collection(runsCollectionName).FindOne(ctx, bson.M{"_id": *runIDPtr}).Decode(&record)
+	switch {
+	case err == nil && !collectionSet && isCollectionTemplate(record.Collection):
+		slog.Error("Run routed rows to collections named by a template; give -collectionName for each of them",
+			"stage", "rollback", "template", record.Collection)
+		return 1
+	case err == nil && !collectionSet && record.Collection != "":
+		collectionName = record.Collection
+	case err != nil && !errors.Is(err, mongo.ErrNoDocuments):
+		slog.Warn("Could not read run record", "stage", "rollback", "error", err)
+	}
+
+	result, err := rollbackRun(ctx, db, db.Collection(collectionName), *runIDPtr, *dryRunPtr)
+	if err != nil {
+		slog.Error("Rollback failed", "stage", "rollback", "collection", collectionName,
+			"restored", result.Restored, "deleted", result.Deleted, "error", err)
+		return 1
+	}
+	if result.Stamped == 0 && result.Restored == 0 {
+		slog.Error("Nothing to roll back: no documents or before-images found for run. Was it loaded with -lineage?",
+			"stage", "rollback", "db", *dbNamePtr, "collection", collectionName)
+		return 1
+	}
+	if *dryRunPtr {
+		slog.Info("Rollback dry run", "stage", "rollback", "collection", collectionName,
+			"stamped", result.Stamped, "would_restore", result.Restored, "would_delete", result.Deleted)
+		return 0
+	}
+	slog.Info("Rollback finished", "stage", "rollback", "collection", collectionName,
+		"restored", result.Restored, "deleted", result.Deleted)
+
+	_, err = db.Collection(runsCollectionName).UpdateByID(ctx, *runIDPtr, bson.M{"$set": bson.M{
+		"status":       statusRolledBack,
+		"rolledBackAt": time.Now().UTC(),
+	}})
+	if err != nil {
+		slog.Warn("Could not mark run record as rolled back", "stage", "rollback", "error", err)
+	}
+	return 0
+}
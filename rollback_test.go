@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestBeforeImageStore(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	before, err := bson.Marshal(bson.D{{Key: "_id", Value: "A-1"}, {Key: "qty", Value: int32(3)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mt.Run("Save", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: int32(1)}))
+		s := &beforeImageStore{coll: mt.Coll, runID: "run1", collection: "orders"}
+		if err := s.save(context.Background(), before); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		image := mt.GetStartedEvent().Command.Lookup("documents", "0").Document()
+		if image.Lookup("runId").StringValue() != "run1" || image.Lookup("collection").StringValue() != "orders" || image.Lookup("docId").StringValue() != "A-1" {
+			t.Errorf("Expected the image of A-1 in orders for run1, got %s", image)
+		}
+		if qty := image.Lookup("before", "qty").AsInt64(); qty != 3 {
+			t.Errorf("Expected the document as it was, got %s", image.Lookup("before"))
+		}
+	})
+
+	mt.Run("KeepsFirstImage", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "E11000 duplicate key error"}))
+		s := &beforeImageStore{coll: mt.Coll, runID: "run1", collection: "orders"}
+		if err := s.save(context.Background(), before); err != nil {
+			t.Errorf("Expected a second image of a document to be ignored, got %v", err)
+		}
+	})
+
+	mt.Run("NoID", func(mt *mtest.T) {
+		noID, _ := bson.Marshal(bson.D{{Key: "qty", Value: int32(3)}})
+		s := &beforeImageStore{coll: mt.Coll, runID: "run1", collection: "orders"}
+		if err := s.save(context.Background(), noID); err == nil {
+			t.Errorf("Expected an error for a document without _id")
+		}
+	})
+}
+
+func TestRollbackRun(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	count := func(ns string, n int32) bson.D {
+		return mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{{Key: "n", Value: n}})
+	}
+	images := "bulkcsv." + beforeImagesCollectionName
+
+	mt.Run("DryRun", func(mt *mtest.T) {
+		// 5 stamped documents, 2 images, one of them of a document a later run restamped.
+		mt.AddMockResponses(count("bulkcsv.orders", 5), count(images, 2), count("bulkcsv.orders", 4))
+		result, err := rollbackRun(context.Background(), mt.DB, mt.Coll, "run1", true)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if result != (rollbackResult{Stamped: 5, Restored: 2, Deleted: 4}) {
+			t.Errorf("Expected 5 stamped, 2 restored and 4 deleted, got %+v", result)
+		}
+		for _, started := range mt.GetAllStartedEvents() {
+			if started.CommandName != "aggregate" {
+				t.Errorf("Expected a dry run to change nothing, got %s", started.CommandName)
+			}
+		}
+		events := mt.GetAllStartedEvents()
+		if from, err := events[len(events)-1].Command.LookupErr("pipeline", "1", "$lookup", "from"); err != nil || from.StringValue() != beforeImagesCollectionName {
+			t.Errorf("Expected inserted documents to be counted by looking up their before-images, got %s", events[len(events)-1].Command)
+		}
+	})
+
+	mt.Run("DryRunOnlyReplaced", func(mt *mtest.T) {
+		mt.AddMockResponses(count("bulkcsv.orders", 2), count(images, 2), mtest.CreateCursorResponse(0, "bulkcsv.orders", mtest.FirstBatch))
+		result, err := rollbackRun(context.Background(), mt.DB, mt.Coll, "run1", true)
+		if err != nil || result.Deleted != 0 {
+			t.Errorf("Expected nothing to be deleted, got %+v (%v)", result, err)
+		}
+	})
+
+	mt.Run("RestoreAndDelete", func(mt *mtest.T) {
+		before := bson.D{{Key: "_id", Value: "A-1"}, {Key: "qty", Value: int32(3)}}
+		mt.AddMockResponses(
+			count("bulkcsv.orders", 3),
+			mtest.CreateCursorResponse(0, images, mtest.FirstBatch,
+				bson.D{{Key: "runId", Value: "run1"}, {Key: "collection", Value: mt.Coll.Name()}, {Key: "docId", Value: "A-1"}, {Key: "before", Value: before}}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: int32(1)}, bson.E{Key: "nModified", Value: int32(1)}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: int32(2)}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: int32(1)}),
+		)
+		result, err := rollbackRun(context.Background(), mt.DB, mt.Coll, "run1", false)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if result != (rollbackResult{Stamped: 3, Restored: 1, Deleted: 2}) {
+			t.Errorf("Expected 3 stamped, 1 restored and 2 deleted, got %+v", result)
+		}
+		events := mt.GetAllStartedEvents()
+		if len(events) != 5 {
+			t.Fatalf("Expected 5 commands, got %d", len(events))
+		}
+		replace := events[2].Command.Lookup("updates", "0")
+		if id := replace.Document().Lookup("q", "_id").StringValue(); id != "A-1" || !replace.Document().Lookup("upsert").Boolean() {
+			t.Errorf("Expected A-1 to be restored with an upsert, got %s", replace)
+		}
+		if qty := replace.Document().Lookup("u", "qty").AsInt64(); qty != 3 {
+			t.Errorf("Expected the before-image to be restored, got %s", replace)
+		}
+		if filter := events[3].Command.Lookup("deletes", "0", "q"); events[3].Command.Lookup("delete").StringValue() != mt.Coll.Name() ||
+			filter.Document().Lookup(lineageField+".runId").StringValue() != "run1" {
+			t.Errorf("Expected the run's stamped documents to be deleted, got %s", events[3].Command)
+		}
+		if coll := events[4].Command.Lookup("delete").StringValue(); coll != beforeImagesCollectionName {
+			t.Errorf("Expected the applied before-images to be removed, got a delete from %s", coll)
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxNamespaceLength is the longest "database.collection" name MongoDB accepts.
+const maxNamespaceLength = 255
+
+// isCollectionTemplate reports whether a -collectionName is a template evaluated per row.
+func isCollectionTemplate(name string) bool {
+	return strings.Contains(name, "{{")
+}
+
+// collectionTemplate renders the destination collection of each row from a
+// -collectionName such as events_{{.region}}_{{date .ts "2006_01"}}.
+type collectionTemplate struct {
+	db   string
+	tmpl *template.Template
+}
+
+// templateFuncs are the functions available in a collection name template.
+var templateFuncs = template.FuncMap{
+	"date":  templateDate,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// parseCollectionTemplate parses a templated collection name for database db.
+// A row without a column the template refers to cannot be routed.
+func parseCollectionTemplate(db, text string) (*collectionTemplate, error) {
+	tmpl, err := template.New("collectionName").Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid collection name template: %w", err)
+	}
+	return &collectionTemplate{db: db, tmpl: tmpl}, nil
+}
+
+// columns returns the columns the template refers to as {{.column}}.
+func (t *collectionTemplate) columns() []string {
+	var columns []string
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, c := range n.Nodes {
+					walk(c)
+				}
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.PipeNode:
+			if n != nil {
+				for _, c := range n.Cmds {
+					walk(c)
+				}
+			}
+		case *parse.CommandNode:
+			for _, a := range n.Args {
+				walk(a)
+			}
+		case *parse.FieldNode:
+			if !slices.Contains(columns, n.Ident[0]) {
+				columns = append(columns, n.Ident[0])
+			}
+		}
+	}
+	walk(t.tmpl.Tree.Root)
+	return columns
+}
+
+// render returns the collection doc is routed to.
+func (t *collectionTemplate) render(doc bson.M) (string, error) {
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, map[string]any(doc)); err != nil {
+		return "", fmt.Errorf("could not route row: %w", err)
+	}
+	name := b.String()
+	if err := validCollectionName(t.db, name); err != nil {
+		return "", fmt.Errorf("could not route row: %w", err)
+	}
+	return name, nil
+}
+
+// validCollectionName checks name against MongoDB's collection naming rules.
+func validCollectionName(db, name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("collection name is empty")
+	case strings.ContainsAny(name, "$\x00"):
+		return fmt.Errorf("collection name %q contains $ or a null character", name)
+	case strings.HasPrefix(name, "system."):
+		return fmt.Errorf("collection name %q is reserved", name)
+	case len(db)+1+len(name) > maxNamespaceLength:
+		return fmt.Errorf("collection name %q is too long", name)
+	}
+	return nil
+}
+
+// templateDate formats a date value with layout, in UTC. Strings are parsed as
+// RFC 3339 or 2006-01-02; columns of other layouts need a date type in the schema.
+func templateDate(value any, layout string) (string, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v.UTC().Format(layout), nil
+	case primitive.DateTime:
+		return v.Time().UTC().Format(layout), nil
+	case string:
+		for _, l := range []string{time.RFC3339, dateOnlyLayout} {
+			if t, err := time.Parse(l, strings.TrimSpace(v)); err == nil {
+				return t.UTC().Format(layout), nil
+			}
+		}
+		return "", fmt.Errorf("%q is not an RFC 3339 or 2006-01-02 date", v)
+	}
+	return "", fmt.Errorf("%v is not a date", value)
+}
+
+// destination is a collection rows are routed to, with the batch waiting to be written to it.
+type destination struct {
+	writer       *batchWriter
+	beforeImages *beforeImageStore // nil unless replaced documents are kept
+	counts       *destinationCounts
+	batch        []pendingRow
+	err          error // why the collection could not be prepared; its rows are rejected
+}
+
+// destinationCache holds the destinations with a pending batch, at most max of them,
+// so routing to many collections keeps a bounded number of rows in memory.
+type destinationCache struct {
+	max    int
+	lru    *list.List // of *destination, most recently used first
+	byName map[string]*list.Element
+}
+
+// newDestinationCache returns a cache of at most max destinations.
+func newDestinationCache(max int) *destinationCache {
+	return &destinationCache{max: max, lru: list.New(), byName: map[string]*list.Element{}}
+}
+
+// get returns the cached destination for collection name, or nil.
+func (c *destinationCache) get(name string) *destination {
+	e, ok := c.byName[name]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*destination)
+}
+
+// add caches d. If the cache was full, the least recently used destination is
+// removed and returned so its batch can be written.
+func (c *destinationCache) add(d *destination) (evicted *destination) {
+	if c.lru.Len() >= c.max {
+		e := c.lru.Back()
+		evicted = c.lru.Remove(e).(*destination)
+		delete(c.byName, evicted.counts.Collection)
+	}
+	c.byName[d.counts.Collection] = c.lru.PushFront(d)
+	return evicted
+}
+
+// all returns the cached destinations, most recently used first.
+func (c *destinationCache) all() []*destination {
+	all := make([]*destination, 0, c.lru.Len())
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		all = append(all, e.Value.(*destination))
+	}
+	return all
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCollectionTemplate(t *testing.T) {
+	routes, err := parseCollectionTemplate("bulkcsv", `events_{{lower .region}}_{{date .ts "2006_01"}}`)
+	if err != nil {
+		t.Fatalf("Expected the template to parse, got %v", err)
+	}
+
+	t.Run("Columns", func(t *testing.T) {
+		if got, want := routes.columns(), []string{"region", "ts"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected columns %v, got %v", want, got)
+		}
+	})
+
+	t.Run("Render", func(t *testing.T) {
+		cases := []struct {
+			doc  bson.M
+			want string
+		}{
+			{bson.M{"region": "EU", "ts": "2024-07-31T23:30:00-02:00"}, "events_eu_2024_08"}, // dates are formatted in UTC
+			{bson.M{"region": "us", "ts": "2024-03-05"}, "events_us_2024_03"},
+			{bson.M{"region": "us", "ts": time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)}, "events_us_2023_12"},
+		}
+		for _, c := range cases {
+			if got, err := routes.render(c.doc); err != nil || got != c.want {
+				t.Errorf("Expected %s, got %q (%v)", c.want, got, err)
+			}
+		}
+	})
+
+	t.Run("Unroutable", func(t *testing.T) {
+		for _, doc := range []bson.M{
+			{"ts": "2024-03-05"},                                     // missing column
+			{"region": "us", "ts": "05/03/2024"},                     // not a date
+			{"region": "a$b", "ts": "2024-03-05"},                    // invalid name
+			{"region": strings.Repeat("x", 250), "ts": "2024-03-05"}, // namespace too long
+		} {
+			if name, err := routes.render(doc); err == nil {
+				t.Errorf("Expected an error routing %v, got %s", doc, name)
+			}
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		if _, err := parseCollectionTemplate("bulkcsv", "events_{{.region"); err == nil {
+			t.Errorf("Expected an error for an unterminated action")
+		}
+	})
+}
+
+func TestDestinationCache(t *testing.T) {
+	cache := newDestinationCache(2)
+	cache.add(&destination{counts: &destinationCounts{Collection: "a"}})
+	cache.add(&destination{counts: &destinationCounts{Collection: "b"}})
+	cache.get("a") // b is now the least recently used
+	evicted := cache.add(&destination{counts: &destinationCounts{Collection: "c"}})
+	if evicted == nil || evicted.counts.Collection != "b" {
+		t.Fatalf("Expected b to be evicted, got %v", evicted)
+	}
+	if cache.get("b") != nil {
+		t.Errorf("Expected b to be gone from the cache")
+	}
+	var names []string
+	for _, d := range cache.all() {
+		names = append(names, d.counts.Collection)
+	}
+	if want := []string{"c", "a"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected %v, got %v", want, names)
+	}
+}
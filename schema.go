@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Column types of a schema. Each is stored as the BSON type of the same name.
+const (
+	typeString   = "string"
+	typeInt      = "int"
+	typeLong     = "long"
+	typeDouble   = "double"
+	typeDecimal  = "decimal"
+	typeBool     = "bool"
+	typeDate     = "date"
+	typeObjectID = "objectId"
+)
+
+// dateOnlyLayout is the other date layout schema inference recognises besides RFC 3339.
+const dateOnlyLayout = "2006-01-02"
+
+// schemaConfig is the job config's schema section: the type of each column. Columns
+// it does not mention are loaded as strings.
+type schemaConfig struct {
+	Columns []columnSpec `yaml:"columns"`
+}
+
+// columnSpec declares the type of one CSV column.
+type columnSpec struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// Required rows must have a value; an empty value in an optional column leaves the field out.
+	Required bool `yaml:"required,omitempty"`
+	// Format is the time.Parse layout of a date column; RFC 3339 if empty.
+	Format string `yaml:"format,omitempty"`
+}
+
+// validate checks the declared types.
+func (s *schemaConfig) validate() error {
+	seen := map[string]bool{}
+	for _, c := range s.Columns {
+		if c.Name == "" {
+			return fmt.Errorf("schema column without a name")
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("schema column %s declared twice", c.Name)
+		}
+		seen[c.Name] = true
+		switch c.Type {
+		case typeString, typeInt, typeLong, typeDouble, typeDecimal, typeBool, typeDate, typeObjectID:
+		default:
+			return fmt.Errorf("schema column %s has unknown type %q", c.Name, c.Type)
+		}
+		if c.Format != "" && c.Type != typeDate {
+			return fmt.Errorf("schema column %s: format only applies to dates", c.Name)
+		}
+	}
+	return nil
+}
+
+// columnNames returns the names of the declared columns.
+func (s *schemaConfig) columnNames() []string {
+	names := make([]string, len(s.Columns))
+	for i, c := range s.Columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// rowConverter turns CSV fields into document values according to a schema.
+type rowConverter struct {
+	columns []*columnSpec // per header position; nil for undeclared columns
+}
+
+// newRowConverter matches the schema to the CSV header.
+func newRowConverter(s *schemaConfig, headers []string) *rowConverter {
+	byName := make(map[string]*columnSpec, len(s.Columns))
+	for i := range s.Columns {
+		byName[s.Columns[i].Name] = &s.Columns[i]
+	}
+	c := &rowConverter{columns: make([]*columnSpec, len(headers))}
+	for i, h := range headers {
+		c.columns[i] = byName[h]
+	}
+	return c
+}
+
+// document builds the document for a row, or returns why a value does not fit its column.
+func (c *rowConverter) document(headers, fields []string) (bson.M, error) {
+	doc := bson.M{}
+	for j, header := range headers {
+		col := c.columns[j]
+		if col == nil {
+			doc[header] = fields[j]
+			continue
+		}
+		if col.Type == typeString {
+			if fields[j] == "" && col.Required {
+				return nil, fmt.Errorf("column %s is required", header)
+			}
+			doc[header] = fields[j]
+			continue
+		}
+		value := strings.TrimSpace(fields[j])
+		if value == "" {
+			if col.Required {
+				return nil, fmt.Errorf("column %s is required", header)
+			}
+			continue
+		}
+		v, err := convertValue(value, col.Type, col.Format)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %q is not a valid %s", header, fields[j], col.Type)
+		}
+		doc[header] = v
+	}
+	return doc, nil
+}
+
+// convertValue parses a non-empty field as the given column type.
+func convertValue(value, typ, format string) (any, error) {
+	switch typ {
+	case typeInt:
+		n, err := strconv.ParseInt(value, 10, 32)
+		return int32(n), err
+	case typeLong:
+		return strconv.ParseInt(value, 10, 64)
+	case typeDouble:
+		return strconv.ParseFloat(value, 64)
+	case typeDecimal:
+		return primitive.ParseDecimal128(value)
+	case typeBool:
+		return strconv.ParseBool(value)
+	case typeDate:
+		if format == "" {
+			format = time.RFC3339
+		}
+		t, err := time.Parse(format, value)
+		return t.UTC(), err
+	case typeObjectID:
+		return primitive.ObjectIDFromHex(value)
+	}
+	return value, nil
+}
+
+// jsonSchema derives a $jsonSchema validator from the schema. Only declared columns
+// are constrained, so undeclared columns, _id and lineage stamps are still allowed.
+func (s *schemaConfig) jsonSchema() bson.M {
+	properties := bson.M{}
+	required := bson.A{}
+	for _, c := range s.Columns {
+		properties[c.Name] = bson.M{"bsonType": c.Type}
+		if c.Required {
+			required = append(required, c.Name)
+		}
+	}
+	schema := bson.M{"bsonType": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return bson.M{"$jsonSchema": schema}
+}
+
+// inferSchema derives a schema from the header and up to sampleRows rows of a CSV file.
+// Each column gets the narrowest type all its sampled values parse as (bool, int, long,
+// double, date, else string), and is required if no sampled value is empty. A number
+// with leading zeros, such as 00123, is taken for an identifier and keeps its column
+// a string, since a number would lose the zeros.
+func inferSchema(path string, sampleRows int) (*schemaConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open CSV file %s: %w", path, err)
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	headers, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read header from CSV %s: %w", path, err)
+	}
+
+	candidates := make([]map[string]bool, len(headers))
+	required := make([]bool, len(headers))
+	hasValue := make([]bool, len(headers))
+	for i := range headers {
+		candidates[i] = map[string]bool{typeBool: true, typeInt: true, typeLong: true, typeDouble: true, time.RFC3339: true, dateOnlyLayout: true}
+		required[i] = true
+	}
+	for n := 0; n < sampleRows; n++ {
+		fields, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			continue // Rows the importer would reject do not shape the schema
+		}
+		if len(fields) != len(headers) {
+			continue
+		}
+		for i, field := range fields {
+			value := strings.TrimSpace(field)
+			if value == "" {
+				required[i] = false
+				continue
+			}
+			hasValue[i] = true
+			if hasLeadingZeros(value) {
+				delete(candidates[i], typeInt)
+				delete(candidates[i], typeLong)
+				delete(candidates[i], typeDouble)
+			}
+			for candidate := range candidates[i] {
+				typ, format := candidate, ""
+				if candidate == time.RFC3339 || candidate == dateOnlyLayout {
+					typ, format = typeDate, candidate
+				}
+				if typ == typeBool && !strings.EqualFold(value, "true") && !strings.EqualFold(value, "false") {
+					delete(candidates[i], candidate) // "1" and "t" parse as bools, but are rarely meant as one
+					continue
+				}
+				if _, err := convertValue(value, typ, format); err != nil {
+					delete(candidates[i], candidate)
+				}
+			}
+		}
+	}
+
+	schema := &schemaConfig{}
+	for i, header := range headers {
+		col := columnSpec{Name: header, Type: typeString, Required: required[i]}
+		switch c := candidates[i]; {
+		case !hasValue[i]: // Nothing to go by, so it stays a string
+		case c[typeBool]:
+			col.Type = typeBool
+		case c[typeInt]:
+			col.Type = typeInt
+		case c[typeLong]:
+			col.Type = typeLong
+		case c[typeDouble]:
+			col.Type = typeDouble
+		case c[time.RFC3339]:
+			col.Type = typeDate
+		case c[dateOnlyLayout]:
+			col.Type, col.Format = typeDate, dateOnlyLayout
+		}
+		schema.Columns = append(schema.Columns, col)
+	}
+	return schema, nil
+}
+
+// hasLeadingZeros reports whether value is a number whose integer part has a zero
+// before other digits, as in 007 or 00.5.
+func hasLeadingZeros(value string) bool {
+	digits := strings.TrimLeft(value, "+-")
+	if end := strings.IndexAny(digits, ".eE"); end >= 0 {
+		digits = digits[:end]
+	}
+	if len(digits) < 2 || digits[0] != '0' {
+		return false
+	}
+	return strings.Trim(digits, "0123456789") == ""
+}
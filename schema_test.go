@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestRowConverter(t *testing.T) {
+	schema := &schemaConfig{Columns: []columnSpec{
+		{Name: "Age", Type: typeInt, Required: true},
+		{Name: "Score", Type: typeDouble},
+		{Name: "Joined", Type: typeDate, Format: dateOnlyLayout},
+		{Name: "Active", Type: typeBool},
+	}}
+	headers := []string{"Name", "Age", "Score", "Joined", "Active"}
+	c := newRowConverter(schema, headers)
+
+	t.Run("Converts", func(t *testing.T) {
+		doc, err := c.document(headers, []string{"John", " 30 ", "", "2024-03-01", "true"})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		want := bson.M{"Name": "John", "Age": int32(30), "Joined": time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), "Active": true}
+		if !reflect.DeepEqual(doc, want) {
+			t.Errorf("Expected %v, got %v", want, doc)
+		}
+	})
+
+	t.Run("Rejects", func(t *testing.T) {
+		rows := map[string][]string{
+			"MissingRequired": {"John", "", "1.5", "", ""},
+			"NotAnInt":        {"John", "thirty", "", "", ""},
+			"IntOverflow":     {"John", "3000000000", "", "", ""},
+			"BadDate":         {"John", "30", "", "01/03/2024", ""},
+		}
+		for name, fields := range rows {
+			if _, err := c.document(headers, fields); err == nil {
+				t.Errorf("%s: expected an error for %v", name, fields)
+			}
+		}
+	})
+}
+
+func TestSchemaValidate(t *testing.T) {
+	invalid := map[string]schemaConfig{
+		"NoName":       {Columns: []columnSpec{{Type: typeInt}}},
+		"Duplicate":    {Columns: []columnSpec{{Name: "a", Type: typeInt}, {Name: "a", Type: typeLong}}},
+		"UnknownType":  {Columns: []columnSpec{{Name: "a", Type: "integer"}}},
+		"FormatOnInts": {Columns: []columnSpec{{Name: "a", Type: typeInt, Format: "2006"}}},
+	}
+	for name, s := range invalid {
+		if err := s.validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	s := &schemaConfig{Columns: []columnSpec{{Name: "Age", Type: typeInt, Required: true}, {Name: "City", Type: typeString}}}
+	want := bson.M{"$jsonSchema": bson.M{
+		"bsonType": "object",
+		"properties": bson.M{
+			"Age":  bson.M{"bsonType": "int"},
+			"City": bson.M{"bsonType": "string"},
+		},
+		"required": bson.A{"Age"},
+	}}
+	if got := s.jsonSchema(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestInferSchema(t *testing.T) {
+	path := createTestCSVFile(t, "Name,Age,Big,Score,Active,Joined,When,Note,Code\n"+
+		"John,30,3000000000,1.5,true,2024-03-01,2024-03-01T10:00:00Z,,123\n"+
+		"Jane,25,1,2,FALSE,2024-03-02,2024-03-02T11:30:00+02:00,,00123\n"+
+		"Bob,,7,3e2,true,2024-03-03,2024-03-03T00:00:00Z,,0\n")
+	schema, err := inferSchema(path, 100)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := []columnSpec{
+		{Name: "Name", Type: typeString, Required: true},
+		{Name: "Age", Type: typeInt},
+		{Name: "Big", Type: typeLong, Required: true},
+		{Name: "Score", Type: typeDouble, Required: true},
+		{Name: "Active", Type: typeBool, Required: true},
+		{Name: "Joined", Type: typeDate, Required: true, Format: dateOnlyLayout},
+		{Name: "When", Type: typeDate, Required: true},
+		{Name: "Note", Type: typeString},
+		{Name: "Code", Type: typeString, Required: true}, // 00123 would lose its zeros as a number
+	}
+	if !reflect.DeepEqual(schema.Columns, want) {
+		t.Errorf("Expected %+v, got %+v", want, schema.Columns)
+	}
+}
+
+func TestHasLeadingZeros(t *testing.T) {
+	tests := map[string]bool{"00123": true, "-007": true, "00.5": true, "0": false, "0.5": false, "-0.25": false, "100": false, "0x1F": false, "2024-03-01": false}
+	for value, want := range tests {
+		if got := hasLeadingZeros(value); got != want {
+			t.Errorf("Expected hasLeadingZeros(%q) = %v, got %v", value, want, got)
+		}
+	}
+}
+
+func TestApplyValidator(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	validator := (&schemaConfig{Columns: []columnSpec{{Name: "Age", Type: typeInt}}}).jsonSchema()
+
+	mt.Run("Creates", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "bulkcsv.$cmd.listCollections", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(),
+		)
+		created, err := applyValidator(context.Background(), mt.DB, "people", validator, "error", "strict")
+		if err != nil || !created {
+			t.Fatalf("Expected the collection to be created, got %v (%v)", created, err)
+		}
+		events := mt.GetAllStartedEvents()
+		if last := events[len(events)-1]; last.CommandName != "create" || last.Command.Lookup("validationAction").StringValue() != "error" {
+			t.Errorf("Expected a create command with validationAction error, got %v", last.Command)
+		}
+	})
+
+	mt.Run("Updates", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "bulkcsv.$cmd.listCollections", mtest.FirstBatch, bson.D{{Key: "name", Value: "people"}, {Key: "type", Value: "collection"}}),
+			mtest.CreateSuccessResponse(),
+		)
+		created, err := applyValidator(context.Background(), mt.DB, "people", validator, "warn", "moderate")
+		if err != nil || created {
+			t.Fatalf("Expected the existing collection to be updated, got %v (%v)", created, err)
+		}
+		events := mt.GetAllStartedEvents()
+		if last := events[len(events)-1]; last.CommandName != "collMod" || last.Command.Lookup("validationAction").StringValue() != "warn" {
+			t.Errorf("Expected a collMod command with validationAction warn, got %v", last.Command)
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// redacted replaces secrets in logs, reports and run records.
+const redacted = "xxxxx"
+
+// secretURIOptions are connection string options whose values are credentials.
+var secretURIOptions = []string{"authMechanismProperties", "tlsCertificateKeyFilePassword"}
+
+// secrets holds every credential the process knows of, so that redact can remove
+// them from any text that is about to leave the process.
+var secrets secretSet
+
+type secretSet struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+// add registers a secret. Empty values are ignored.
+func (s *secretSet) add(values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range values {
+		if v != "" {
+			s.values = append(s.values, v)
+		}
+	}
+}
+
+// empty reports whether no secret has been registered.
+func (s *secretSet) empty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.values) == 0
+}
+
+// redact replaces every registered secret in text.
+func (s *secretSet) redact(text string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, v := range s.values {
+		text = strings.ReplaceAll(text, v, redacted)
+	}
+	return text
+}
+
+// redact replaces every registered secret in text.
+func redact(text string) string {
+	return secrets.redact(text)
+}
+
+// addURISecrets registers the password and credential options of a MongoDB URI as
+// secrets, both as written and percent-decoded.
+func addURISecrets(uri string) {
+	if _, password, ok := uriPassword(uri); ok {
+		secrets.add(password)
+		if decoded, err := url.PathUnescape(password); err == nil {
+			secrets.add(decoded)
+		}
+	}
+	for _, value := range secretQueryValues(uri) {
+		secrets.add(value)
+		if decoded, err := url.QueryUnescape(value); err == nil {
+			secrets.add(decoded)
+		}
+	}
+}
+
+// redactURI returns uri with its password and credential options replaced, for logging.
+// It works on the raw string because url.Parse rejects multi-host MongoDB URIs.
+func redactURI(uri string) string {
+	if start, password, ok := uriPassword(uri); ok {
+		uri = uri[:start] + redacted + uri[start+len(password):]
+	}
+	for _, value := range secretQueryValues(uri) {
+		uri = strings.Replace(uri, "="+value, "="+redacted, 1)
+	}
+	return uri
+}
+
+// uriPassword finds the password in uri's user info, returning its offset in uri.
+func uriPassword(uri string) (int, string, bool) {
+	scheme := strings.Index(uri, "://")
+	if scheme < 0 {
+		return 0, "", false
+	}
+	rest := uri[scheme+3:]
+	if end := strings.IndexAny(rest, "/?"); end >= 0 {
+		rest = rest[:end]
+	}
+	at := strings.LastIndex(rest, "@")
+	if at < 0 {
+		return 0, "", false
+	}
+	colon := strings.Index(rest[:at], ":")
+	if colon < 0 {
+		return 0, "", false
+	}
+	return scheme + 3 + colon + 1, rest[colon+1 : at], true
+}
+
+// secretQueryValues returns the raw values of uri's secretURIOptions.
+func secretQueryValues(uri string) []string {
+	q := strings.Index(uri, "?")
+	if q < 0 {
+		return nil
+	}
+	var values []string
+	for _, pair := range strings.FieldsFunc(uri[q+1:], func(r rune) bool { return r == '&' || r == ';' }) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || value == "" {
+			continue
+		}
+		for _, name := range secretURIOptions {
+			if strings.EqualFold(key, name) {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// statusCanceled marks an import job stopped through DELETE /imports/{id}.
+	statusCanceled = "canceled"
+	// maxFinishedJobs bounds how many finished jobs the server remembers.
+	maxFinishedJobs = 1000
+	// importCancelGrace is how long a stopped import gets to clean up (abort an atomic
+	// load, write its report) before it is killed.
+	importCancelGrace = 30 * time.Second
+	// maxOptionSize bounds a multipart form field holding an option.
+	maxOptionSize = 64 << 10
+	// uploadFileName names a file uploaded without a name, as a raw request body.
+	uploadFileName = "upload.csv"
+)
+
+// serveOptions are the import flags a client may set for a job, as query parameters
+// or multipart form fields. The rest (connection, config, logging) are the server's.
+var serveOptions = []string{
+	"dbName", "collectionName", "mode", "keyColumns", "syncScope", "syncMaxDeletePercent", "syncMaxDeleteCount",
+	"watermarkColumn", "watermarkSource", "resetWatermark", "atomic", "atomicMaxErrorRate",
+	"maxErrors", "maxErrorRate", "batchSize", "ordered", "lineage", "unflatten",
+}
+
+// importJob is an import submitted to the server, as GET /imports/{id} shows it.
+type importJob struct {
+	ID            string            `json:"id"`
+	Status        string            `json:"status"` // running, then the report's status or canceled
+	Options       map[string]string `json:"options"`
+	RunID         string            `json:"runId,omitempty"`
+	StartedAt     time.Time         `json:"startedAt"`
+	FinishedAt    *time.Time        `json:"finishedAt,omitempty"`
+	BytesReceived int64             `json:"bytesReceived"`
+	RowsRead      int64             `json:"rowsRead"` // updated every second while running
+	ExitCode      *int              `json:"exitCode,omitempty"`
+	Error         string            `json:"error,omitempty"`
+	Report        *runReport        `json:"report,omitempty"` // once finished
+
+	stop       context.CancelFunc // interrupts the import
+	stdin      io.Closer
+	stopStatus string // status and error to finish with once stopped
+	stopError  string
+	lastOutput string // last line the import wrote that was not a log record, e.g. a flag error
+	done       chan struct{}
+}
+
+// importServer runs the imports submitted over HTTP, each in a child process as the
+// watch subcommand does, with the file streamed into its standard input.
+type importServer struct {
+	exe       string
+	baseArgs  []string // the server's import flags, after a job's options so they take precedence
+	reportDir string
+	slots     chan struct{} // one per running import
+	// queue, if set, receives the submitted imports for the workers to run instead.
+	queue       *jobQueue
+	maxAttempts int
+
+	mu       sync.Mutex
+	jobs     map[string]*importJob
+	finished []string // IDs of finished jobs, oldest first
+	running  sync.WaitGroup
+}
+
+func newImportServer(exe string, baseArgs []string, reportDir string, maxConcurrent int) *importServer {
+	return &importServer{
+		exe:       exe,
+		baseArgs:  baseArgs,
+		reportDir: reportDir,
+		slots:     make(chan struct{}, maxConcurrent),
+		jobs:      map[string]*importJob{},
+	}
+}
+
+// handler routes the API's requests.
+func (s *importServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	if s.queue != nil {
+		mux.HandleFunc("POST /imports", s.enqueue)
+		mux.HandleFunc("GET /imports", s.listQueued)
+		mux.HandleFunc("GET /imports/{id}", s.getQueued)
+		mux.HandleFunc("DELETE /imports/{id}", s.cancelQueued)
+		return mux
+	}
+	mux.HandleFunc("POST /imports", s.create)
+	mux.HandleFunc("GET /imports", s.list)
+	mux.HandleFunc("GET /imports/{id}", s.get)
+	mux.HandleFunc("DELETE /imports/{id}", s.cancel)
+	return mux
+}
+
+// setOption records a job option, rejecting those a client may not set.
+func setOption(options map[string]string, name, value string) error {
+	if !slices.Contains(serveOptions, name) {
+		return fmt.Errorf("unknown option %q", name)
+	}
+	options[name] = value
+	return nil
+}
+
+// filePart returns the part of a multipart form holding the file, named file, and
+// records the form fields before it as options.
+func filePart(mr *multipart.Reader, options map[string]string) (*multipart.Part, error) {
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("the form has no file part")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read form: %w", err)
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxOptionSize))
+		if err != nil {
+			return nil, fmt.Errorf("could not read form field %s: %w", part.FormName(), err)
+		}
+		if err := setOption(options, part.FormName(), string(value)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// uploadReader counts the bytes of an upload into its job and keeps the error
+// reading it, to tell a failed upload from an import that stopped reading.
+type uploadReader struct {
+	r   io.Reader
+	s   *importServer
+	job *importJob
+	err error
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	u.s.mu.Lock()
+	u.job.BytesReceived += int64(n)
+	u.s.mu.Unlock()
+	if err != nil && !errors.Is(err, io.EOF) {
+		u.err = err
+	}
+	return n, err
+}
+
+// requestFile returns the file of a POST /imports request, the raw body or the file
+// part of a multipart form, with its name and the job's options.
+func requestFile(r *http.Request) (io.Reader, string, map[string]string, error) {
+	options := map[string]string{}
+	for name, values := range r.URL.Query() {
+		if err := setOption(options, name, values[len(values)-1]); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "multipart/form-data" {
+		return r.Body, uploadFileName, options, nil
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	part, err := filePart(mr, options)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	name := part.FileName()
+	if name == "" {
+		name = uploadFileName
+	}
+	return part, name, options, nil
+}
+
+// create handles POST /imports: it starts an import and streams the request's file
+// into it. It responds once the file has been passed on, while the import may still
+// be writing.
+func (s *importServer) create(w http.ResponseWriter, r *http.Request) {
+	body, _, options, err := requestFile(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		w.Header().Set("Retry-After", "10")
+		writeJSONError(w, http.StatusTooManyRequests, fmt.Errorf("%d imports are already running; try again later", cap(s.slots)))
+		return
+	}
+	job, stdin, err := s.start(options)
+	if err != nil {
+		<-s.slots
+		slog.Error("Could not start import", "stage", "serve", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	upload := &uploadReader{r: body, s: s, job: job}
+	_, err = io.Copy(stdin, upload)
+	if upload.err != nil {
+		// The import is interrupted before its input ends (stop closes it), as it would
+		// otherwise load whatever was received as if it were the whole file.
+		s.stop(job, statusFailed, "upload failed: "+upload.err.Error())
+		slog.Warn("Upload failed; import stopped", "stage", "serve", "job_id", job.ID, "error", upload.err)
+		<-job.done
+	} else {
+		stdin.Close()
+		if err != nil {
+			<-job.done // The import stopped reading: it failed, or was canceled
+		}
+	}
+
+	snapshot := s.snapshot(job)
+	if snapshot.ExitCode != nil && *snapshot.ExitCode == 2 {
+		writeJSON(w, http.StatusBadRequest, snapshot) // Invalid options; nothing was loaded
+		return
+	}
+	w.Header().Set("Location", "/imports/"+job.ID)
+	writeJSON(w, http.StatusAccepted, snapshot)
+}
+
+// importCommandArgs returns the arguments of an import reading its file from standard
+// input: the job's options, then baseArgs, which take precedence.
+func importCommandArgs(options map[string]string, reportPath string, baseArgs []string) []string {
+	args := []string{"-csvFile", "-", "-report", reportPath}
+	for _, name := range serveOptions {
+		if value, ok := options[name]; ok {
+			args = append(args, "-"+name+"="+value)
+		}
+	}
+	return append(args, baseArgs...)
+}
+
+// start runs the import of a job with options, returning the job and the import's
+// standard input.
+func (s *importServer) start(options map[string]string) (*importJob, io.WriteCloser, error) {
+	id := primitive.NewObjectID().Hex()
+	reportPath := filepath.Join(s.reportDir, id+".json")
+	args := importCommandArgs(options, reportPath, s.baseArgs)
+	// The server follows the import's progress through its log.
+	args = append(args, "-logFormat", "json", "-progress", "log", "-progressInterval", "1s")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, s.exe, args...)
+	// The import is signaled once, and by stop itself rather than after it returns, so
+	// a caller can be sure the interrupt was sent before it closes the import's input.
+	var interruptOnce sync.Once
+	interrupt := func() { interruptOnce.Do(func() { cmd.Process.Signal(os.Interrupt) }) }
+	cmd.Cancel = func() error { interrupt(); return nil }
+	stop := func() {
+		if cmd.Process != nil {
+			interrupt()
+		}
+		cancel() // Kills the import if it has not stopped after importCancelGrace
+	}
+	cmd.WaitDelay = importCancelGrace
+	cmd.Stdout = os.Stdout
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		stop()
+		return nil, nil, fmt.Errorf("could not start import: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		stop()
+		return nil, nil, fmt.Errorf("could not start import: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		stop()
+		return nil, nil, fmt.Errorf("could not start import: %w", err)
+	}
+
+	job := &importJob{ID: id, Status: statusRunning, Options: options, StartedAt: time.Now().UTC(), stop: stop, stdin: stdin, done: make(chan struct{})}
+	s.mu.Lock()
+	s.jobs[id] = job
+	s.mu.Unlock()
+	slog.Info("Import started", "stage", "serve", "job_id", id, "options", options)
+
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		defer func() { <-s.slots }()
+		s.follow(job, stderr)
+		cmd.Wait() // The exit code and report tell how it went
+		stop()
+		s.finish(job, cmd.ProcessState.ExitCode(), reportPath)
+	}()
+	return job, stdin, nil
+}
+
+// follow passes the import's log on to the server's and updates the job from it.
+func (s *importServer) follow(job *importJob, stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		os.Stderr.Write(append(line, '\n'))
+		var record struct {
+			Msg   string `json:"msg"`
+			RunID string `json:"run_id"`
+			Rows  int64  `json:"rows"`
+		}
+		s.mu.Lock()
+		if json.Unmarshal(line, &record) != nil {
+			job.lastOutput = string(line)
+		} else {
+			if record.RunID != "" {
+				job.RunID = record.RunID
+			}
+			if record.Msg == progressMessage {
+				job.RowsRead = record.Rows
+			}
+		}
+		s.mu.Unlock()
+	}
+	io.Copy(os.Stderr, stderr) // Keeps the import from blocking past an overlong line
+}
+
+// finish records how a job's import ended.
+func (s *importServer) finish(job *importJob, exitCode int, reportPath string) {
+	report, _ := readRunReport(reportPath)
+	os.Remove(reportPath)
+	finishedAt := time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.FinishedAt = &finishedAt
+	job.ExitCode = &exitCode
+	job.Report = report
+	job.Status = statusFailed
+	if report != nil {
+		job.Status, job.Error, job.RowsRead = report.Status, report.Error, report.Rows.Read
+	}
+	switch {
+	case job.stopStatus != "":
+		job.Status, job.Error = job.stopStatus, job.stopError
+	case job.Error == "" && exitCode != 0 && job.lastOutput != "":
+		job.Error = job.lastOutput
+	case job.Error == "" && exitCode != 0:
+		job.Error = "import exited with code " + strconv.Itoa(exitCode)
+	}
+	close(job.done)
+	slog.Info("Import finished", "stage", "serve", "job_id", job.ID, "status", job.Status, "exit_code", exitCode, "import_run_id", job.RunID)
+
+	s.finished = append(s.finished, job.ID)
+	if len(s.finished) > maxFinishedJobs {
+		delete(s.jobs, s.finished[0])
+		s.finished = s.finished[1:]
+	}
+}
+
+// stop interrupts a job's import, which then finishes with status and message.
+func (s *importServer) stop(job *importJob, status, message string) {
+	s.mu.Lock()
+	if job.stopStatus == "" {
+		job.stopStatus, job.stopError = status, message
+	}
+	s.mu.Unlock()
+	job.stop()
+	job.stdin.Close() // Ends the file for an import still waiting on the upload
+}
+
+// job returns the job with id, or nil.
+func (s *importServer) job(id string) *importJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[id]
+}
+
+// snapshot returns a copy of job that can be encoded without holding the lock.
+func (s *importServer) snapshot(job *importJob) importJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *job
+}
+
+// list handles GET /imports, returning the jobs the server knows, oldest first.
+func (s *importServer) list(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	jobs := make([]importJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+	s.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID }) // IDs are ObjectIDs, so ordered by time
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// get handles GET /imports/{id}.
+func (s *importServer) get(w http.ResponseWriter, r *http.Request) {
+	job := s.job(r.PathValue("id"))
+	if job == nil {
+		writeJSONError(w, http.StatusNotFound, errNoSuchJob)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.snapshot(job))
+}
+
+// cancel handles DELETE /imports/{id}. The import is interrupted, which fails it as
+// an aborted run would fail, and the job is shown as canceled once it has stopped.
+func (s *importServer) cancel(w http.ResponseWriter, r *http.Request) {
+	job := s.job(r.PathValue("id"))
+	if job == nil {
+		writeJSONError(w, http.StatusNotFound, errNoSuchJob)
+		return
+	}
+	if s.snapshot(job).FinishedAt != nil {
+		writeJSONError(w, http.StatusConflict, errJobFinished)
+		return
+	}
+	s.stop(job, statusCanceled, "canceled by request")
+	slog.Info("Import canceled", "stage", "serve", "job_id", job.ID)
+	writeJSON(w, http.StatusAccepted, s.snapshot(job))
+}
+
+// enqueue handles POST /imports with -queue: it stores the request's file and queues
+// its import for a worker.
+func (s *importServer) enqueue(w http.ResponseWriter, r *http.Request) {
+	body, name, options, err := requestFile(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	job, err := s.queue.enqueue(r.Context(), name, body, options, s.maxAttempts)
+	if err != nil {
+		slog.Error("Could not queue import", "stage", "serve", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	slog.Info("Import queued", "stage", "serve", "job_id", job.ID.Hex(), "file", name, "options", options)
+	w.Header().Set("Location", "/imports/"+job.ID.Hex())
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// listQueued handles GET /imports with -queue, returning the latest jobs.
+func (s *importServer) listQueued(w http.ResponseWriter, r *http.Request) {
+	jobs, err := s.queue.list(r.Context(), maxFinishedJobs)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// getQueued handles GET /imports/{id} with -queue.
+func (s *importServer) getQueued(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, errNoSuchJob)
+		return
+	}
+	job, err := s.queue.get(r.Context(), id)
+	switch {
+	case errors.Is(err, errNoSuchJob):
+		writeJSONError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, job)
+	}
+}
+
+// cancelQueued handles DELETE /imports/{id} with -queue.
+func (s *importServer) cancelQueued(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, errNoSuchJob)
+		return
+	}
+	job, err := s.queue.cancel(r.Context(), id)
+	switch {
+	case errors.Is(err, errNoSuchJob):
+		writeJSONError(w, http.StatusNotFound, err)
+	case errors.Is(err, errJobFinished):
+		writeJSONError(w, http.StatusConflict, err)
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, err)
+	default:
+		slog.Info("Import canceled", "stage", "serve", "job_id", job.ID.Hex(), "status", job.Status)
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+// writeJSON writes v as the response body.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Could not write response", "stage", "serve", "error", err)
+	}
+}
+
+// writeJSONError writes err as a JSON error response.
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// runServe implements the serve subcommand, an HTTP API for submitting imports, and
+// returns the process exit code. Flags after -- are passed to each import.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	listenPtr := fs.String("listen", ":8080", "Address the API listens on.")
+	maxConcurrentPtr := fs.Int("maxConcurrentImports", 2, "Imports run at once; further submissions are refused with 429 until one finishes.")
+	queuePtr := fs.Bool("queue", false, "Store submitted files and queue their imports in _import_jobs for worker replicas to run, instead of running them here.")
+	connFlags := registerConnFlags(fs)
+	dbNamePtr := fs.String("dbName", "bulkcsv", "With -queue, database holding the job queue.")
+	maxAttemptsPtr := fs.Int("maxAttempts", 3, "With -queue, times a job is claimed before it fails, when workers stop while running it. Jobs that would insert rows twice if run again get one attempt.")
+	logFlags := registerLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: bulk-csv-processor serve [serve flags] [-- import flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := checkImportArgs(fs.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "serve:", err)
+		return 2
+	}
+	if *maxConcurrentPtr < 1 {
+		fmt.Fprintln(os.Stderr, "serve: -maxConcurrentImports must be at least 1")
+		return 2
+	}
+	if *queuePtr && len(fs.Args()) > 0 {
+		fmt.Fprintln(os.Stderr, "serve: with -queue the imports run in the workers, so import flags go to the worker subcommand")
+		return 2
+	}
+	if *maxAttemptsPtr < 1 {
+		fmt.Fprintln(os.Stderr, "serve: -maxAttempts must be at least 1")
+		return 2
+	}
+	if _, err := connFlags.clientOptions(); err != nil {
+		fmt.Fprintln(os.Stderr, redact(err.Error()))
+		return 2
+	}
+	logger, _, err := logFlags.newLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	slog.SetDefault(logger)
+	exe, err := os.Executable()
+	if err != nil {
+		slog.Error("Cannot find the importer executable", "stage", "serve", "error", err)
+		return 1
+	}
+	reportDir, err := os.MkdirTemp("", "bulk-csv-serve")
+	if err != nil {
+		slog.Error("Cannot create report directory", "stage", "serve", "error", err)
+		return 1
+	}
+	defer os.RemoveAll(reportDir)
+
+	// Connection flags given to the server reach its imports too, as they do a worker's.
+	s := newImportServer(exe, append(connFlags.args(), fs.Args()...), reportDir, *maxConcurrentPtr)
+	if *queuePtr {
+		client, err := connectToDB(context.Background(), connFlags)
+		if err != nil {
+			slog.Error("MongoDB connection error", "stage", "connect", "error", err)
+			return 1
+		}
+		defer func() {
+			if err := client.Disconnect(context.TODO()); err != nil {
+				slog.Error("Error disconnecting from MongoDB", "stage", "finalize", "error", err)
+			}
+		}()
+		if s.queue, err = newJobQueue(context.Background(), client.Database(*dbNamePtr), 0); err != nil {
+			slog.Error("Job queue error", "stage", "serve", "error", err)
+			return 1
+		}
+		s.maxAttempts = *maxAttemptsPtr
+	}
+	// Uploads can take as long as they take, so only the headers are timed.
+	srv := &http.Server{Addr: *listenPtr, Handler: s.handler(), ReadHeaderTimeout: 10 * time.Second}
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ListenAndServe() }()
+	slog.Info("Serving import API", "stage", "serve", "listen", *listenPtr, "max_concurrent_imports", *maxConcurrentPtr, "queue", *queuePtr, "import_args", fs.Args())
+
+	select {
+	case err := <-serveErr:
+		slog.Error("Server error", "stage", "serve", "error", err)
+		return 1
+	case <-ctx.Done():
+	}
+	slog.Info("Shutting down; waiting for running imports", "stage", "serve")
+	if err := srv.Shutdown(context.Background()); err != nil {
+		slog.Error("Server shutdown error", "stage", "serve", "error", err)
+	}
+	s.running.Wait()
+	slog.Info("Server stopped", "stage", "serve")
+	return 0
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeImporter stands in for the importer: it records its arguments, logs a progress
+// line, reads the file and writes a report to the path after -report.
+const fakeImporter = `#!/bin/sh
+echo "$*" > "$(dirname "$4")/args"
+echo '{"msg":"Progress","run_id":"r1","rows":2}' >&2
+cat > /dev/null
+printf '{"runId":"r1","status":"succeeded","rows":{"read":2}}' > "$4"
+`
+
+func newTestImportServer(t *testing.T, maxConcurrent int) (*importServer, *httptest.Server) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake importer is a shell script")
+	}
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "importer")
+	if err := os.WriteFile(exe, []byte(fakeImporter), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s := newImportServer(exe, []string{"-dbName", "server"}, dir, maxConcurrent)
+	srv := httptest.NewServer(s.handler())
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func decodeJob(t *testing.T, resp *http.Response) importJob {
+	t.Helper()
+	defer resp.Body.Close()
+	var job importJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// waitForJob polls a job until it has finished.
+func waitForJob(t *testing.T, url, id string) importJob {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		resp, err := http.Get(url + "/imports/" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job := decodeJob(t, resp); job.FinishedAt != nil {
+			return job
+		}
+	}
+	t.Fatalf("Expected import %s to finish", id)
+	return importJob{}
+}
+
+func TestImportServer(t *testing.T) {
+	t.Run("RawBody", func(t *testing.T) {
+		s, srv := newTestImportServer(t, 1)
+		resp, err := http.Post(srv.URL+"/imports?collectionName=orders", "text/csv", strings.NewReader("a,b\n1,2\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusAccepted || resp.Header.Get("Location") == "" {
+			t.Fatalf("Expected 202 with a Location, got %d", resp.StatusCode)
+		}
+		job := waitForJob(t, srv.URL, decodeJob(t, resp).ID)
+		if job.Status != statusSucceeded || job.RunID != "r1" || job.RowsRead != 2 || job.BytesReceived != 8 {
+			t.Errorf("Expected a succeeded job with run r1, 2 rows and 8 bytes, got %+v", job)
+		}
+		args, _ := os.ReadFile(filepath.Join(s.reportDir, "args"))
+		if !strings.Contains(string(args), "-csvFile - -report") || !strings.Contains(string(args), "-collectionName=orders -dbName server") {
+			t.Errorf("Expected the job's options before the server's, got %s", args)
+		}
+	})
+
+	t.Run("Multipart", func(t *testing.T) {
+		s, srv := newTestImportServer(t, 1)
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("mode", "upsert")
+		form.WriteField("keyColumns", "a")
+		part, _ := form.CreateFormFile("file", "orders.csv")
+		part.Write([]byte("a,b\n1,2\n"))
+		form.Close()
+		resp, err := http.Post(srv.URL+"/imports", form.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job := waitForJob(t, srv.URL, decodeJob(t, resp).ID)
+		if job.Options["mode"] != "upsert" || job.Options["keyColumns"] != "a" {
+			t.Errorf("Expected the form fields as options, got %v", job.Options)
+		}
+		if args, _ := os.ReadFile(filepath.Join(s.reportDir, "args")); !strings.Contains(string(args), "-mode=upsert") {
+			t.Errorf("Expected -mode=upsert to be passed, got %s", args)
+		}
+	})
+
+	t.Run("UnknownOption", func(t *testing.T) {
+		_, srv := newTestImportServer(t, 1)
+		resp, err := http.Post(srv.URL+"/imports?mongoURI=x", "text/csv", strings.NewReader("a\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("ConcurrencyLimit", func(t *testing.T) {
+		s, srv := newTestImportServer(t, 1)
+		s.slots <- struct{}{} // An import is running
+		resp, err := http.Post(srv.URL+"/imports", "text/csv", strings.NewReader("a\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+			t.Errorf("Expected 429 with Retry-After, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		s, srv := newTestImportServer(t, 1)
+		upload, uploading := io.Pipe()
+		posted := make(chan *http.Response)
+		go func() {
+			resp, err := http.Post(srv.URL+"/imports", "text/csv", upload)
+			if err != nil {
+				t.Error(err)
+			}
+			posted <- resp
+		}()
+		uploading.Write([]byte("a,b\n"))
+		var id string
+		for id == "" {
+			s.mu.Lock()
+			for jobID := range s.jobs {
+				id = jobID
+			}
+			s.mu.Unlock()
+		}
+		req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/imports/"+id, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("Expected 202, got %d", resp.StatusCode)
+		}
+		uploading.Close()
+		if resp := <-posted; resp != nil {
+			resp.Body.Close()
+		}
+		if job := waitForJob(t, srv.URL, id); job.Status != statusCanceled {
+			t.Errorf("Expected a canceled job, got %+v", job)
+		}
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("Expected 409 for a finished import, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, srv := newTestImportServer(t, 1)
+		resp, err := http.Get(srv.URL + "/imports/nope")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected 404, got %d", resp.StatusCode)
+		}
+	})
+}
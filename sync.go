@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// syncDeletion removes, at the end of a -mode sync run, the documents in scope whose
+// key no row of the file had, so the collection mirrors the file.
+type syncDeletion struct {
+	coll       *mongo.Collection
+	keyColumns []string
+	scope      bson.D  // only documents matching it are considered; all if empty
+	maxPercent float64 // refuse to delete more than this share of the documents in scope
+	maxCount   int64   // but allow deleting up to this many, whatever their share
+	seen       map[string]bool
+}
+
+// newSyncDeletion returns a deletion of the documents of coll that match scope.
+func newSyncDeletion(coll *mongo.Collection, keyColumns []string, scope bson.D, maxPercent float64, maxCount int64) *syncDeletion {
+	if scope == nil {
+		scope = bson.D{}
+	}
+	return &syncDeletion{coll: coll, keyColumns: keyColumns, scope: scope, maxPercent: maxPercent, maxCount: maxCount, seen: map[string]bool{}}
+}
+
+// see records the key of a row, whose document is then kept.
+func (s *syncDeletion) see(doc bson.M) error {
+	key, err := keyString(s.keyColumns, doc)
+	if err != nil {
+		return err
+	}
+	s.seen[key] = true
+	return nil
+}
+
+// findUnseen returns the documents in scope with a key no row had. With full they
+// are returned whole, otherwise only their _id and key. It fails without returning
+// any once there are more than the threshold allows.
+func (s *syncDeletion) findUnseen(ctx context.Context, full bool) ([]bson.Raw, error) {
+	total, err := s.coll.CountDocuments(ctx, s.scope)
+	if err != nil {
+		return nil, fmt.Errorf("could not count documents in %s: %w", s.coll.Name(), err)
+	}
+	allowed := max(int64(float64(total)*s.maxPercent/100), s.maxCount)
+
+	opts := options.Find()
+	if !full {
+		projection := bson.M{"_id": 1}
+		for _, c := range s.keyColumns {
+			projection[c] = 1
+		}
+		opts.SetProjection(projection)
+	}
+	cursor, err := s.coll.Find(ctx, s.scope, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not read keys of %s: %w", s.coll.Name(), err)
+	}
+	defer cursor.Close(ctx)
+	var unseen []bson.Raw
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("could not decode document: %w", err)
+		}
+		flat := bson.D{}
+		flattenDocument("", doc, &flat)
+		key, err := keyString(s.keyColumns, flatMap(flat))
+		if err != nil {
+			return nil, err
+		}
+		if s.seen[key] {
+			continue
+		}
+		if int64(len(unseen)) >= allowed {
+			return nil, fmt.Errorf("sync would delete more than %d of the %d documents in scope (-syncMaxDeletePercent %g, -syncMaxDeleteCount %d); nothing was deleted",
+				allowed, total, s.maxPercent, s.maxCount)
+		}
+		unseen = append(unseen, append(bson.Raw(nil), cursor.Current...))
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("could not read keys of %s: %w", s.coll.Name(), err)
+	}
+	return unseen, nil
+}
+
+// deleteDocuments deletes docs by _id, batchSize at a time, calling before (if not
+// nil) with each batch first. It returns how many were deleted.
+func (s *syncDeletion) deleteDocuments(ctx context.Context, docs []bson.Raw, batchSize int, retry retryPolicy, before func([]bson.Raw) error) (int64, int, error) {
+	var deleted int64
+	var retries int
+	for start := 0; start < len(docs); start += batchSize {
+		batch := docs[start:min(start+batchSize, len(docs))]
+		if before != nil {
+			if err := before(batch); err != nil {
+				return deleted, retries, err
+			}
+		}
+		ids := make(bson.A, len(batch))
+		for i, doc := range batch {
+			ids[i] = doc.Lookup("_id")
+		}
+		var result *mongo.DeleteResult
+		n, err := retry.do(ctx, func() error {
+			var err error
+			result, err = s.coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+			return err
+		})
+		retries += n
+		if err != nil {
+			return deleted, retries, fmt.Errorf("could not delete documents from %s: %w", s.coll.Name(), err)
+		}
+		deleted += result.DeletedCount
+	}
+	return deleted, retries, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestSyncDeletion(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	count := func(n int32) bson.D {
+		return mtest.CreateCursorResponse(0, "bulkcsv.codes", mtest.FirstBatch, bson.D{{Key: "n", Value: n}})
+	}
+	stored := mtest.CreateCursorResponse(0, "bulkcsv.codes", mtest.FirstBatch,
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "code", Value: "A"}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "code", Value: "B"}},
+		bson.D{{Key: "_id", Value: int32(3)}, {Key: "code", Value: "C"}},
+	)
+
+	mt.Run("Deletes", func(mt *mtest.T) {
+		s := newSyncDeletion(mt.Coll, []string{"code"}, nil, 50, 0)
+		for _, code := range []string{"A", "C", "D"} {
+			if err := s.see(bson.M{"code": code}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mt.AddMockResponses(count(3), stored, mtest.CreateSuccessResponse(bson.E{Key: "n", Value: int32(1)}))
+		unseen, err := s.findUnseen(context.Background(), false)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(unseen) != 1 || unseen[0].Lookup("code").StringValue() != "B" {
+			t.Fatalf("Expected B to be unseen, got %v", unseen)
+		}
+		deleted, _, err := s.deleteDocuments(context.Background(), unseen, 100, retryPolicy{}, nil)
+		if err != nil || deleted != 1 {
+			t.Errorf("Expected 1 document deleted, got %d (%v)", deleted, err)
+		}
+		events := mt.GetAllStartedEvents()
+		if started := events[len(events)-1]; started.CommandName != "delete" {
+			t.Errorf("Expected a delete command, got %s", started.CommandName)
+		}
+	})
+
+	mt.Run("SmallCollection", func(mt *mtest.T) {
+		var docs []bson.D
+		for i, code := range []string{"A", "B", "C", "D", "E"} {
+			docs = append(docs, bson.D{{Key: "_id", Value: int32(i)}, {Key: "code", Value: code}})
+		}
+		stored := mtest.CreateCursorResponse(0, "bulkcsv.codes", mtest.FirstBatch, docs...)
+		see := func(s *syncDeletion) {
+			for _, code := range []string{"A", "B", "D", "E"} {
+				if err := s.see(bson.M{"code": code}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		// 10% of 5 documents allows none, so even one stale document is refused.
+		s := newSyncDeletion(mt.Coll, []string{"code"}, nil, 10, 0)
+		see(s)
+		mt.AddMockResponses(count(5), stored)
+		if _, err := s.findUnseen(context.Background(), false); err == nil || !strings.Contains(err.Error(), "nothing was deleted") {
+			t.Errorf("Expected the threshold to refuse the deletion, got %v", err)
+		}
+
+		// -syncMaxDeleteCount lets it go.
+		s = newSyncDeletion(mt.Coll, []string{"code"}, nil, 10, 1)
+		see(s)
+		mt.AddMockResponses(count(5), stored)
+		unseen, err := s.findUnseen(context.Background(), false)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(unseen) != 1 || unseen[0].Lookup("code").StringValue() != "C" {
+			t.Errorf("Expected C to be unseen, got %v", unseen)
+		}
+	})
+
+	mt.Run("Threshold", func(mt *mtest.T) {
+		s := newSyncDeletion(mt.Coll, []string{"code"}, bson.D{{Key: "active", Value: true}}, 50, 0)
+		if err := s.see(bson.M{"code": "A"}); err != nil {
+			t.Fatal(err)
+		}
+		mt.AddMockResponses(count(3), stored)
+		// B and C are unseen, and 2 of 3 is above 50%.
+		if _, err := s.findUnseen(context.Background(), false); err == nil || !strings.Contains(err.Error(), "nothing was deleted") {
+			t.Errorf("Expected the threshold to refuse the deletion, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "bulk-csv-processor"
+
+// tracer is the tracer used for all spans emitted by the importer. It delegates
+// to whatever provider setupTelemetry installs, or to a no-op one if telemetry is off.
+var tracer = otel.Tracer(instrumentationName)
+
+// importMetrics holds the metric instruments recorded during a run.
+type importMetrics struct {
+	rows          metric.Int64Counter
+	writeDuration metric.Float64Histogram
+	writeRetries  metric.Int64Counter
+}
+
+// newImportMetrics creates the importer's instruments from the global meter provider.
+func newImportMetrics() (*importMetrics, error) {
+	meter := otel.Meter(instrumentationName)
+	rows, err := meter.Int64Counter("csv.rows",
+		metric.WithDescription("CSV data rows handled, by outcome."),
+		metric.WithUnit("{row}"))
+	if err != nil {
+		return nil, fmt.Errorf("could not create csv.rows counter: %w", err)
+	}
+	writeDuration, err := meter.Float64Histogram("mongo.write.duration",
+		metric.WithDescription("Duration of MongoDB write calls."),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, fmt.Errorf("could not create mongo.write.duration histogram: %w", err)
+	}
+	writeRetries, err := meter.Int64Counter("mongo.write.retries",
+		metric.WithDescription("MongoDB writes retried after a transient error."),
+		metric.WithUnit("{retry}"))
+	if err != nil {
+		return nil, fmt.Errorf("could not create mongo.write.retries counter: %w", err)
+	}
+	return &importMetrics{rows: rows, writeDuration: writeDuration, writeRetries: writeRetries}, nil
+}
+
+// recordRow counts one data row with the given outcome ("inserted", "failed", ...).
+func (m *importMetrics) recordRow(ctx context.Context, outcome string) {
+	m.rows.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)))
+}
+
+// setupTelemetry installs OTLP trace and metric providers configured from the
+// standard OTEL_* environment variables. Exporting is only enabled when an OTLP
+// endpoint or exporter is configured, so plain runs stay quiet. The returned
+// function flushes and shuts down whatever was installed.
+func setupTelemetry(ctx context.Context) (func(context.Context) error, error) {
+	var shutdowns []func(context.Context) error
+	shutdown := func(ctx context.Context) error {
+		var errs []error
+		for _, fn := range shutdowns {
+			errs = append(errs, fn(ctx))
+		}
+		return errors.Join(errs...)
+	}
+
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return shutdown, nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(instrumentationName)))
+	if err != nil {
+		return shutdown, fmt.Errorf("could not build telemetry resource: %w", err)
+	}
+	// Environment (OTEL_SERVICE_NAME, OTEL_RESOURCE_ATTRIBUTES) wins over our defaults.
+	envRes, err := resource.New(ctx, resource.WithFromEnv())
+	if err != nil {
+		return shutdown, fmt.Errorf("could not read telemetry resource from environment: %w", err)
+	}
+	if res, err = resource.Merge(res, envRes); err != nil {
+		return shutdown, fmt.Errorf("could not build telemetry resource: %w", err)
+	}
+
+	if otlpEnabled("TRACES") {
+		exporter, err := newTraceExporter(ctx, otlpProtocol("TRACES"))
+		if err != nil {
+			return shutdown, err
+		}
+		tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+		otel.SetTracerProvider(tp)
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+		shutdowns = append(shutdowns, tp.Shutdown)
+	}
+
+	if otlpEnabled("METRICS") {
+		exporter, err := newMetricExporter(ctx, otlpProtocol("METRICS"))
+		if err != nil {
+			return shutdown, err
+		}
+		mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)), sdkmetric.WithResource(res))
+		otel.SetMeterProvider(mp)
+		shutdowns = append(shutdowns, mp.Shutdown)
+	}
+
+	return shutdown, nil
+}
+
+// otlpEnabled reports whether OTLP export is configured for a signal ("TRACES" or "METRICS").
+// OTEL_<SIGNAL>_EXPORTER=none disables it; otherwise an OTLP endpoint or an explicit
+// OTEL_<SIGNAL>_EXPORTER=otlp enables it.
+func otlpEnabled(signal string) bool {
+	switch strings.ToLower(os.Getenv("OTEL_" + signal + "_EXPORTER")) {
+	case "none":
+		return false
+	case "otlp":
+		return true
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_"+signal+"_ENDPOINT") != ""
+}
+
+// otlpProtocol returns the OTLP protocol for a signal, defaulting to http/protobuf as the spec requires.
+func otlpProtocol(signal string) string {
+	if p := os.Getenv("OTEL_EXPORTER_OTLP_" + signal + "_PROTOCOL"); p != "" {
+		return p
+	}
+	if p := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); p != "" {
+		return p
+	}
+	return "http/protobuf"
+}
+
+// newTraceExporter creates an OTLP span exporter. Endpoint, headers, TLS and timeouts
+// are read from the environment by the exporter itself.
+func newTraceExporter(ctx context.Context, protocol string) (sdktrace.SpanExporter, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch protocol {
+	case "grpc":
+		exporter, err = otlptracegrpc.New(ctx)
+	case "http/protobuf":
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP traces protocol %q (want grpc or http/protobuf)", protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create OTLP trace exporter: %w", err)
+	}
+	return exporter, nil
+}
+
+// newMetricExporter creates an OTLP metric exporter, configured from the environment like newTraceExporter.
+func newMetricExporter(ctx context.Context, protocol string) (sdkmetric.Exporter, error) {
+	var (
+		exporter sdkmetric.Exporter
+		err      error
+	)
+	switch protocol {
+	case "grpc":
+		exporter, err = otlpmetricgrpc.New(ctx)
+	case "http/protobuf":
+		exporter, err = otlpmetrichttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP metrics protocol %q (want grpc or http/protobuf)", protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create OTLP metric exporter: %w", err)
+	}
+	return exporter, nil
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		if msg := redact(err.Error()); msg != err.Error() {
+			err = errors.New(msg) // Credentials must not be exported with the span
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
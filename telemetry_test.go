@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeCollector is a minimal in-process OTLP/HTTP receiver that records span and metric names.
+type fakeCollector struct {
+	mu      sync.Mutex
+	spans   []string
+	metrics []string
+}
+
+func (c *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch r.URL.Path {
+	case "/v1/traces":
+		var req collectortrace.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					c.spans = append(c.spans, span.Name)
+				}
+			}
+		}
+		out, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+		_, _ = w.Write(out)
+	case "/v1/metrics":
+		var req collectormetrics.ExportMetricsServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, rm := range req.ResourceMetrics {
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					c.metrics = append(c.metrics, m.Name)
+				}
+			}
+		}
+		out, _ := proto.Marshal(&collectormetrics.ExportMetricsServiceResponse{})
+		_, _ = w.Write(out)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestSetupTelemetryExportsToCollector(t *testing.T) {
+	collector := &fakeCollector{}
+	srv := httptest.NewServer(collector)
+	defer srv.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", srv.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "http/protobuf")
+
+	ctx := context.Background()
+	shutdown, err := setupTelemetry(ctx)
+	if err != nil {
+		t.Fatalf("setupTelemetry failed: %v", err)
+	}
+	metrics, err := newImportMetrics()
+	if err != nil {
+		t.Fatalf("newImportMetrics failed: %v", err)
+	}
+
+	runCtx, runSpan := tracer.Start(ctx, "import")
+	_, writeSpan := tracer.Start(runCtx, "write")
+	metrics.recordRow(runCtx, "inserted")
+	metrics.writeDuration.Record(runCtx, 0.01)
+	endSpan(writeSpan, nil)
+	endSpan(runSpan, nil)
+
+	if err := shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	sort.Strings(collector.spans)
+	if len(collector.spans) != 2 || collector.spans[0] != "import" || collector.spans[1] != "write" {
+		t.Errorf("Expected spans [import write], got %v", collector.spans)
+	}
+	sort.Strings(collector.metrics)
+	if len(collector.metrics) != 2 || collector.metrics[0] != "csv.rows" || collector.metrics[1] != "mongo.write.duration" {
+		t.Errorf("Expected metrics [csv.rows mongo.write.duration], got %v", collector.metrics)
+	}
+}
+
+func TestOTLPEnabled(t *testing.T) {
+	t.Run("NoEndpoint", func(t *testing.T) {
+		t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+		t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+		t.Setenv("OTEL_TRACES_EXPORTER", "")
+		if otlpEnabled("TRACES") {
+			t.Errorf("Expected traces export to be disabled without an endpoint")
+		}
+	})
+
+	t.Run("SignalEndpoint", func(t *testing.T) {
+		t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+		t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "http://collector:4318/v1/traces")
+		if !otlpEnabled("TRACES") {
+			t.Errorf("Expected traces export to be enabled by OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+		}
+		if otlpEnabled("METRICS") {
+			t.Errorf("Expected metrics export to stay disabled")
+		}
+	})
+
+	t.Run("ExporterNone", func(t *testing.T) {
+		t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318")
+		t.Setenv("OTEL_TRACES_EXPORTER", "none")
+		if otlpEnabled("TRACES") {
+			t.Errorf("Expected OTEL_TRACES_EXPORTER=none to disable traces export")
+		}
+	})
+
+	t.Run("Protocol", func(t *testing.T) {
+		t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc")
+		t.Setenv("OTEL_EXPORTER_OTLP_METRICS_PROTOCOL", "http/protobuf")
+		if got := otlpProtocol("TRACES"); got != "grpc" {
+			t.Errorf("Expected traces protocol grpc, got %s", got)
+		}
+		if got := otlpProtocol("METRICS"); got != "http/protobuf" {
+			t.Errorf("Expected metrics protocol http/protobuf, got %s", got)
+		}
+	})
+}
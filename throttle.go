@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// adaptiveMinBatchSize is the smallest batch -adaptive shrinks to.
+	adaptiveMinBatchSize = 10
+	// adaptiveMaxBatchGrowth caps the batch size -adaptive grows to, as a multiple of -batchSize.
+	adaptiveMaxBatchGrowth = 10
+)
+
+// tokenBucket hands out tokens at a steady rate. It holds at most a second's worth,
+// so an idle period allows a burst of no more than that.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+// reserve takes n tokens and returns how long to wait before using them. Taking
+// more than the bucket holds borrows from the tokens to come, so n may exceed the
+// rate and later reservations wait for the debt to be repaid.
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(b.rate, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// writeLimiter caps the rows and CSV bytes written per second.
+type writeLimiter struct {
+	rows  *tokenBucket // nil if rows are not limited
+	bytes *tokenBucket // nil if bytes are not limited
+}
+
+// newWriteLimiter returns a limiter for the rates set above zero, or nil if neither is.
+func newWriteLimiter(rowsPerSec, bytesPerSec float64) *writeLimiter {
+	if rowsPerSec <= 0 && bytesPerSec <= 0 {
+		return nil
+	}
+	l := &writeLimiter{}
+	now := time.Now()
+	if rowsPerSec > 0 {
+		l.rows = newTokenBucket(rowsPerSec, now)
+	}
+	if bytesPerSec > 0 {
+		l.bytes = newTokenBucket(bytesPerSec, now)
+	}
+	return l
+}
+
+// wait blocks until rows rows of bytes bytes may be written, or ctx is done.
+func (l *writeLimiter) wait(ctx context.Context, rows, bytes int) error {
+	now := time.Now()
+	var delay time.Duration
+	if l.rows != nil {
+		delay = l.rows.reserve(float64(rows), now)
+	}
+	if l.bytes != nil {
+		delay = max(delay, l.bytes.reserve(float64(bytes), now))
+	}
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// adaptiveSummary records how -adaptive sized the writes, for the run report.
+type adaptiveSummary struct {
+	TargetLatency string `json:"targetLatency"`
+	BatchSize     int    `json:"batchSize"` // at the end of the run
+	Writers       int    `json:"writers"`   // at the end of the run
+	PeakBatchSize int    `json:"peakBatchSize"`
+	PeakWriters   int    `json:"peakWriters"`
+	Slowdowns     int    `json:"slowdowns"`
+}
+
+// adaptiveWrites sizes write rounds to the cluster's response: it grows the batch
+// size, then the number of concurrent writers, while writes finish well within the
+// target latency, and backs off when they take longer or the server pushes back.
+type adaptiveWrites struct {
+	target       time.Duration
+	batchSize    int
+	writers      int
+	maxBatchSize int
+	maxWriters   int
+	peakBatch    int // largest batch size used
+	peakWriters  int // most writers used
+	slowdowns    int
+}
+
+// newAdaptiveWrites starts from batchSize rows and one writer, and grows to at most
+// adaptiveMaxBatchGrowth times batchSize rows and maxWriters writers.
+func newAdaptiveWrites(batchSize, maxWriters int, target time.Duration) *adaptiveWrites {
+	return &adaptiveWrites{
+		target:       target,
+		batchSize:    batchSize,
+		writers:      1,
+		maxBatchSize: batchSize * adaptiveMaxBatchGrowth,
+		maxWriters:   maxWriters,
+		peakBatch:    batchSize,
+		peakWriters:  1,
+	}
+}
+
+// observe adjusts the sizing to a round of writes whose slowest write took latency.
+// backpressure means the server failed a write for a transient reason, such as a
+// timeout or being overloaded. It reports whether the sizing changed.
+func (a *adaptiveWrites) observe(latency time.Duration, backpressure bool) bool {
+	batchSize, writers := a.batchSize, a.writers
+	switch {
+	case backpressure || latency > a.target:
+		// Drop concurrency first, the quickest way to take load off the cluster.
+		if a.writers > 1 {
+			a.writers /= 2
+		} else {
+			a.batchSize = max(adaptiveMinBatchSize, a.batchSize/2)
+		}
+		a.slowdowns++
+	case latency < a.target/2:
+		if a.batchSize < a.maxBatchSize {
+			a.batchSize = min(a.maxBatchSize, a.batchSize+max(a.batchSize/4, 1))
+		} else if a.writers < a.maxWriters {
+			a.writers++
+		}
+	}
+	a.peakBatch = max(a.peakBatch, a.batchSize)
+	a.peakWriters = max(a.peakWriters, a.writers)
+	return a.batchSize != batchSize || a.writers != writers
+}
+
+// summary returns the sizing for the run report.
+func (a *adaptiveWrites) summary() *adaptiveSummary {
+	return &adaptiveSummary{
+		TargetLatency: a.target.String(),
+		BatchSize:     a.batchSize,
+		Writers:       a.writers,
+		PeakBatchSize: a.peakBatch,
+		PeakWriters:   a.peakWriters,
+		Slowdowns:     a.slowdowns,
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(100, start)
+	if wait := b.reserve(100, start); wait != 0 {
+		t.Errorf("Expected a second's worth to be available at once, got a wait of %s", wait)
+	}
+	if wait := b.reserve(50, start); wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms for 50 more, got %s", wait)
+	}
+	// The 50 borrowed are repaid after 500ms; a second later the bucket is full again, but no fuller.
+	if wait := b.reserve(100, start.Add(10*time.Second)); wait != 0 {
+		t.Errorf("Expected a full bucket after a long pause, got a wait of %s", wait)
+	}
+	if wait := b.reserve(1, start.Add(10*time.Second)); wait != 10*time.Millisecond {
+		t.Errorf("Expected an idle bucket to hold no more than a second's worth, got a wait of %s", wait)
+	}
+}
+
+func TestNewWriteLimiter(t *testing.T) {
+	if l := newWriteLimiter(0, 0); l != nil {
+		t.Errorf("Expected no limiter without caps, got %+v", l)
+	}
+	if l := newWriteLimiter(0, 1e6); l == nil || l.rows != nil || l.bytes == nil {
+		t.Errorf("Expected only bytes to be limited, got %+v", l)
+	}
+}
+
+func TestAdaptiveWrites(t *testing.T) {
+	a := newAdaptiveWrites(100, 3, time.Second)
+	for a.batchSize < a.maxBatchSize {
+		if !a.observe(100*time.Millisecond, false) {
+			t.Fatalf("Expected fast writes to grow the batch, stuck at %d", a.batchSize)
+		}
+	}
+	if a.batchSize != 1000 || a.writers != 1 {
+		t.Fatalf("Expected the batch to grow to 1000 rows before adding writers, got %d rows and %d writers", a.batchSize, a.writers)
+	}
+	a.observe(100*time.Millisecond, false)
+	a.observe(100*time.Millisecond, false)
+	if a.observe(100*time.Millisecond, false) || a.writers != 3 {
+		t.Errorf("Expected to stop at 3 writers, got %d", a.writers)
+	}
+	if a.observe(700*time.Millisecond, false) {
+		t.Errorf("Expected no change between half the target and the target")
+	}
+
+	a.observe(100*time.Millisecond, true)
+	if a.writers != 1 || a.batchSize != 1000 {
+		t.Errorf("Expected backpressure to shed writers first, got %d rows and %d writers", a.batchSize, a.writers)
+	}
+	a.observe(2*time.Second, false)
+	if a.batchSize != 500 {
+		t.Errorf("Expected slow writes with one writer to halve the batch, got %d", a.batchSize)
+	}
+	for range 20 {
+		a.observe(2*time.Second, false)
+	}
+	if s := a.summary(); s.BatchSize != adaptiveMinBatchSize || s.PeakBatchSize != 1000 || s.PeakWriters != 3 || s.Slowdowns != 22 {
+		t.Errorf("Expected the batch to bottom out at %d after 22 slowdowns, got %+v", adaptiveMinBatchSize, s)
+	}
+}
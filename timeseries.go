@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultMetaField names the meta field of a time-series collection when the job config does not.
+const defaultMetaField = "meta"
+
+// timeSeriesConfig is the job config's timeSeries section, which loads into a
+// time-series collection.
+type timeSeriesConfig struct {
+	// TimeField is the CSV column holding each row's timestamp; the field keeps its name.
+	TimeField string `yaml:"timeField"`
+	// Layout is the time.Parse layout of the timestamps; RFC 3339 if empty.
+	Layout string `yaml:"layout"`
+	// Timezone is the IANA zone of timestamps without an offset; UTC if empty.
+	Timezone string `yaml:"timezone"`
+	// MetaColumns are moved into a subdocument named MetaField, which identifies a series.
+	MetaColumns []string `yaml:"metaColumns"`
+	MetaField   string   `yaml:"metaField"`
+	// Granularity is seconds, minutes or hours, and should match the interval between readings of a series.
+	Granularity        string `yaml:"granularity"`
+	ExpireAfterSeconds *int64 `yaml:"expireAfterSeconds"`
+
+	location *time.Location
+}
+
+// validate checks the section and loads its time zone.
+func (c *timeSeriesConfig) validate() error {
+	if c.TimeField == "" {
+		return fmt.Errorf("timeField is required")
+	}
+	switch c.Granularity {
+	case "", "seconds", "minutes", "hours":
+	default:
+		return fmt.Errorf("granularity must be seconds, minutes or hours, not %q", c.Granularity)
+	}
+	if c.Layout == "" {
+		c.Layout = time.RFC3339
+	}
+	loc, err := time.LoadLocation(c.Timezone) // "" is UTC
+	if err != nil {
+		return fmt.Errorf("invalid timezone %q: %w", c.Timezone, err)
+	}
+	c.location = loc
+	if len(c.MetaColumns) > 0 && c.MetaField == "" {
+		c.MetaField = defaultMetaField
+	}
+	if c.MetaField != "" && len(c.MetaColumns) == 0 {
+		return fmt.Errorf("metaField %s needs metaColumns to build it from", c.MetaField)
+	}
+	if c.MetaField == c.TimeField {
+		return fmt.Errorf("metaField and timeField must differ")
+	}
+	for _, col := range c.MetaColumns {
+		if col == c.TimeField {
+			return fmt.Errorf("timeField %s cannot also be a meta column", col)
+		}
+	}
+	if c.ExpireAfterSeconds != nil && *c.ExpireAfterSeconds < 0 {
+		return fmt.Errorf("expireAfterSeconds must not be negative")
+	}
+	return nil
+}
+
+// columns returns the CSV columns the section refers to.
+func (c *timeSeriesConfig) columns() []string {
+	return append([]string{c.TimeField}, c.MetaColumns...)
+}
+
+// apply turns doc into a measurement: the time field is parsed (unless the schema
+// already made it a date) and the meta columns are moved into the meta field.
+func (c *timeSeriesConfig) apply(doc bson.M) error {
+	switch v := doc[c.TimeField].(type) {
+	case time.Time:
+	case string:
+		t, err := time.ParseInLocation(c.Layout, v, c.location)
+		if err != nil {
+			return fmt.Errorf("column %s: %q does not match layout %q", c.TimeField, v, c.Layout)
+		}
+		doc[c.TimeField] = t.UTC()
+	case nil:
+		return fmt.Errorf("column %s is required in a time-series collection", c.TimeField)
+	default:
+		return fmt.Errorf("column %s: %v is not a timestamp", c.TimeField, v)
+	}
+	if len(c.MetaColumns) > 0 {
+		meta := bson.M{}
+		for _, col := range c.MetaColumns {
+			if v, ok := doc[col]; ok {
+				meta[col] = v
+				delete(doc, col)
+			}
+		}
+		doc[c.MetaField] = meta
+	}
+	return nil
+}
+
+// createOptions returns the options creating a time-series collection for c.
+func (c *timeSeriesConfig) createOptions() *options.CreateCollectionOptions {
+	ts := options.TimeSeries().SetTimeField(c.TimeField)
+	if c.MetaField != "" {
+		ts.SetMetaField(c.MetaField)
+	}
+	if c.Granularity != "" {
+		ts.SetGranularity(c.Granularity)
+	}
+	opts := options.CreateCollection().SetTimeSeriesOptions(ts)
+	if c.ExpireAfterSeconds != nil {
+		opts.SetExpireAfterSeconds(*c.ExpireAfterSeconds)
+	}
+	return opts
+}
+
+// ensureTimeSeriesCollection creates db.name as a time-series collection, or checks
+// that an existing collection of that name is one. It reports whether it was created.
+func ensureTimeSeriesCollection(ctx context.Context, db *mongo.Database, name string, c *timeSeriesConfig) (bool, error) {
+	specs, err := db.ListCollectionSpecifications(ctx, bson.M{"name": name})
+	if err != nil {
+		return false, fmt.Errorf("could not list collections: %w", err)
+	}
+	if len(specs) > 0 {
+		if specs[0].Type != "timeseries" {
+			return false, fmt.Errorf("collection %s already exists and is not a time-series collection", name)
+		}
+		return false, nil
+	}
+	if err := db.CreateCollection(ctx, name, c.createOptions()); err != nil {
+		return false, fmt.Errorf("could not create time-series collection %s: %w", name, err)
+	}
+	return true, nil
+}
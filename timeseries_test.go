@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestTimeSeriesConfig(t *testing.T) {
+	t.Run("Apply", func(t *testing.T) {
+		c := &timeSeriesConfig{TimeField: "ts", Layout: "2006-01-02 15:04:05", Timezone: "Europe/Berlin", MetaColumns: []string{"sensor", "site"}}
+		if err := c.validate(); err != nil {
+			t.Fatalf("Expected a valid config, got %v", err)
+		}
+		doc := bson.M{"ts": "2024-07-01 12:00:00", "sensor": "s1", "site": "north", "temp": "21.5"}
+		if err := c.apply(doc); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		want := bson.M{
+			"ts":   time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC), // CEST is UTC+2
+			"meta": bson.M{"sensor": "s1", "site": "north"},
+			"temp": "21.5",
+		}
+		if !reflect.DeepEqual(doc, want) {
+			t.Errorf("Expected %v, got %v", want, doc)
+		}
+	})
+
+	t.Run("BadTimestamp", func(t *testing.T) {
+		c := &timeSeriesConfig{TimeField: "ts"}
+		if err := c.validate(); err != nil {
+			t.Fatalf("Expected a valid config, got %v", err)
+		}
+		if err := c.apply(bson.M{"ts": "yesterday"}); err == nil {
+			t.Errorf("Expected an error for a timestamp not in RFC 3339")
+		}
+		if err := c.apply(bson.M{"temp": "1"}); err == nil {
+			t.Errorf("Expected an error for a missing timestamp")
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		invalid := map[string]timeSeriesConfig{
+			"NoTimeField":    {},
+			"BadGranularity": {TimeField: "ts", Granularity: "days"},
+			"BadTimezone":    {TimeField: "ts", Timezone: "Mars/Olympus"},
+			"MetaWithout":    {TimeField: "ts", MetaField: "meta"},
+			"TimeIsMeta":     {TimeField: "ts", MetaColumns: []string{"ts"}},
+		}
+		for name, c := range invalid {
+			if err := c.validate(); err == nil {
+				t.Errorf("%s: expected an error", name)
+			}
+		}
+	})
+}
+
+func TestEnsureTimeSeriesCollection(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	c := &timeSeriesConfig{TimeField: "ts", MetaColumns: []string{"sensor"}, Granularity: "minutes"}
+	if err := c.validate(); err != nil {
+		t.Fatalf("Expected a valid config, got %v", err)
+	}
+
+	mt.Run("Creates", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "bulkcsv.$cmd.listCollections", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(),
+		)
+		created, err := ensureTimeSeriesCollection(context.Background(), mt.DB, "readings", c)
+		if err != nil || !created {
+			t.Fatalf("Expected the collection to be created, got %v (%v)", created, err)
+		}
+		events := mt.GetAllStartedEvents()
+		ts := events[len(events)-1].Command.Lookup("timeseries").Document()
+		if ts.Lookup("timeField").StringValue() != "ts" || ts.Lookup("metaField").StringValue() != "meta" || ts.Lookup("granularity").StringValue() != "minutes" {
+			t.Errorf("Unexpected timeseries options %v", ts)
+		}
+	})
+
+	mt.Run("RejectsRegularCollection", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "bulkcsv.$cmd.listCollections", mtest.FirstBatch,
+			bson.D{{Key: "name", Value: "readings"}, {Key: "type", Value: "collection"}}))
+		if _, err := ensureTimeSeriesCollection(context.Background(), mt.DB, "readings", c); err == nil {
+			t.Errorf("Expected an error for an existing regular collection")
+		}
+	})
+}
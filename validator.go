@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/yaml.v3"
+)
+
+// applyValidator sets validator on db.name, creating the collection if it does not
+// exist and running collMod if it does. It reports whether the collection was created.
+func applyValidator(ctx context.Context, db *mongo.Database, name string, validator bson.M, action, level string) (bool, error) {
+	names, err := db.ListCollectionNames(ctx, bson.M{"name": name})
+	if err != nil {
+		return false, fmt.Errorf("could not list collections: %w", err)
+	}
+	if len(names) == 0 {
+		opts := options.CreateCollection().SetValidator(validator).SetValidationAction(action).SetValidationLevel(level)
+		if err := db.CreateCollection(ctx, name, opts); err != nil {
+			return false, fmt.Errorf("could not create collection %s: %w", name, err)
+		}
+		return true, nil
+	}
+	cmd := bson.D{
+		{Key: "collMod", Value: name},
+		{Key: "validator", Value: validator},
+		{Key: "validationAction", Value: action},
+		{Key: "validationLevel", Value: level},
+	}
+	if err := db.RunCommand(ctx, cmd).Err(); err != nil {
+		return false, fmt.Errorf("could not update validator of %s: %w", name, err)
+	}
+	return false, nil
+}
+
+// runValidator implements the validator subcommand and returns the process exit code.
+func runValidator(args []string) int {
+	fs := flag.NewFlagSet("validator", flag.ContinueOnError)
+	connFlags := registerConnFlags(fs)
+	dbNamePtr := fs.String("dbName", "bulkcsv", "MongoDB database name.")
+	collectionNamePtr := fs.String("collectionName", "processed_data", "Collection to validate.")
+	configPtr := fs.String("config", "", "Job config whose schema section declares the column types.")
+	csvFilePtr := fs.String("csvFile", "", "CSV file to infer the column types from when -config has no schema.")
+	sampleRowsPtr := fs.Int("sampleRows", 1000, "Rows of -csvFile sampled to infer the column types.")
+	actionPtr := fs.String("validationAction", "error", "What the server does with an invalid document: error rejects it, warn only logs it.")
+	levelPtr := fs.String("validationLevel", "strict", "strict validates every insert and update; moderate skips updates to documents that are already invalid.")
+	dryRunPtr := fs.Bool("dryRun", false, "Print the validator instead of applying it.")
+	logFlags := registerLogFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *actionPtr != "error" && *actionPtr != "warn" {
+		fmt.Fprintf(os.Stderr, "validator: invalid -validationAction %q (want error or warn)\n", *actionPtr)
+		return 2
+	}
+	if *levelPtr != "strict" && *levelPtr != "moderate" {
+		fmt.Fprintf(os.Stderr, "validator: invalid -validationLevel %q (want strict or moderate)\n", *levelPtr)
+		return 2
+	}
+	if _, err := connFlags.clientOptions(); err != nil {
+		fmt.Fprintln(os.Stderr, redact(err.Error()))
+		return 2
+	}
+	logger, _, err := logFlags.newLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	slog.SetDefault(logger)
+
+	var schema *schemaConfig
+	if *configPtr != "" {
+		cfg, err := loadJobConfig(*configPtr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		schema = cfg.Schema
+	}
+	if schema == nil {
+		if *csvFilePtr == "" {
+			fmt.Fprintln(os.Stderr, "validator: a -config with a schema section or a -csvFile to infer one from is required")
+			fs.Usage()
+			return 2
+		}
+		if schema, err = inferSchema(*csvFilePtr, *sampleRowsPtr); err != nil {
+			slog.Error("Schema inference failed", "stage", "read", "file", *csvFilePtr, "error", err)
+			return 1
+		}
+		// The import only loads typed values when it is given the same schema, so print it for the job config.
+		out, err := yaml.Marshal(struct {
+			Schema *schemaConfig `yaml:"schema"`
+		}{schema})
+		if err != nil {
+			slog.Error("Could not encode inferred schema", "error", err)
+			return 1
+		}
+		slog.Info("Inferred schema; add it to the job config so imports load these types", "stage", "read", "file", *csvFilePtr, "rows_sampled", *sampleRowsPtr)
+		fmt.Print(string(out))
+	}
+	validator := schema.jsonSchema()
+
+	if *dryRunPtr {
+		out, err := bson.MarshalExtJSONIndent(validator, false, false, "", "  ")
+		if err != nil {
+			slog.Error("Could not encode validator", "error", err)
+			return 1
+		}
+		fmt.Println(string(out))
+		return 0
+	}
+
+	ctx := context.Background()
+	client, err := connectToDB(ctx, connFlags)
+	if err != nil {
+		slog.Error("MongoDB connection error", "stage", "connect", "error", err)
+		return 1
+	}
+	defer func() {
+		if err := client.Disconnect(context.TODO()); err != nil {
+			slog.Error("Error disconnecting from MongoDB", "stage", "finalize", "error", err)
+		}
+	}()
+
+	created, err := applyValidator(ctx, client.Database(*dbNamePtr), *collectionNamePtr, validator, *actionPtr, *levelPtr)
+	if err != nil {
+		slog.Error("Could not apply validator", "stage", "write", "collection", *collectionNamePtr, "error", err)
+		return 1
+	}
+	slog.Info("Validator applied", "stage", "write", "db", *dbNamePtr, "collection", *collectionNamePtr,
+		"created", created, "columns", len(schema.Columns), "validation_action", *actionPtr, "validation_level", *levelPtr)
+	return 0
+}
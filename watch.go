@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// doneMarkerSuffix names the marker a producer creates next to a file it has
+	// finished writing: orders.csv is ready once orders.csv.done exists.
+	doneMarkerSuffix = ".done"
+	// watchReportSuffix is appended to a file's name to name its run report.
+	watchReportSuffix = ".report.json"
+)
+
+// fileState is what a watcher last saw of a file in the inbox.
+type fileState struct {
+	size    int64
+	modTime time.Time
+	since   time.Time // when the size and modification time were first seen
+}
+
+// fileTracker decides when a file in the inbox has stopped changing.
+type fileTracker struct {
+	stableFor time.Duration
+	files     map[string]fileState
+}
+
+func newFileTracker(stableFor time.Duration) *fileTracker {
+	return &fileTracker{stableFor: stableFor, files: map[string]fileState{}}
+}
+
+// stable reports whether a file's size and modification time have not changed for
+// stableFor, as of now.
+func (t *fileTracker) stable(name string, info fs.FileInfo, now time.Time) bool {
+	s, ok := t.files[name]
+	if !ok || s.size != info.Size() || !s.modTime.Equal(info.ModTime()) {
+		s = fileState{size: info.Size(), modTime: info.ModTime(), since: now}
+		t.files[name] = s
+	}
+	return now.Sub(s.since) >= t.stableFor
+}
+
+// forget drops the files not in names, so a file that reappears starts over.
+func (t *fileTracker) forget(names map[string]bool) {
+	for name := range t.files {
+		if !names[name] {
+			delete(t.files, name)
+		}
+	}
+}
+
+// readyFiles returns, in name order, the files in dir matching pattern that are ready
+// to import: those with a done marker, and unless requireMarker those that have been
+// stable long enough. Hidden files, directories and markers are never imported.
+func readyFiles(dir, pattern string, tracker *fileTracker, requireMarker bool, now time.Time) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read inbox %s: %w", dir, err)
+	}
+	names := map[string]bool{}
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	var ready []string
+	seen := map[string]bool{}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, doneMarkerSuffix) {
+			continue
+		}
+		if ok, err := filepath.Match(pattern, name); err != nil || !ok {
+			continue
+		}
+		seen[name] = true
+		if names[name+doneMarkerSuffix] {
+			ready = append(ready, name)
+			continue
+		}
+		if requireMarker {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // Removed since the directory was read
+		}
+		if tracker.stable(name, info, now) {
+			ready = append(ready, name)
+		}
+	}
+	tracker.forget(seen)
+	return ready, nil
+}
+
+// uniquePath returns the path of name in dir, numbered (orders.1.csv) if a file of
+// that name is already there.
+func uniquePath(dir, name string) string {
+	path := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+			return path
+		}
+		path = filepath.Join(dir, strings.TrimSuffix(name, ext)+"."+strconv.Itoa(i)+ext)
+	}
+}
+
+// moveImported moves an imported file and its run report, if there is one, to dir
+// and removes its done marker. It returns the file's new path.
+func moveImported(path, reportPath, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("could not create %s: %w", dir, err)
+	}
+	dest := uniquePath(dir, filepath.Base(path))
+	if err := os.Rename(path, dest); err != nil {
+		return "", fmt.Errorf("could not move %s to %s: %w", path, dir, err)
+	}
+	if err := os.Rename(reportPath, dest+watchReportSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return dest, fmt.Errorf("could not move run report of %s: %w", path, err)
+	}
+	if err := os.Remove(path + doneMarkerSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return dest, fmt.Errorf("could not remove done marker of %s: %w", path, err)
+	}
+	return dest, nil
+}
+
+// checkImportArgs rejects the import flags set for every file by the subcommands that
+// run imports (watch, serve and worker).
+func checkImportArgs(args []string) error {
+	for _, arg := range args {
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && (name == "csvFile" || name == "report") {
+			return fmt.Errorf("-%s is set for each import", name)
+		}
+	}
+	return nil
+}
+
+// importFile runs the import of path in a child process, so each file gets a fresh
+// run with the same flags, and returns its exit code.
+func importFile(exe string, importArgs []string, path, reportPath string) (int, error) {
+	args := append([]string{"-csvFile", path, "-report", reportPath}, importArgs...)
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not run import of %s: %w", path, err)
+	}
+	return 0, nil
+}
+
+// reportOutcome returns the run ID and status recorded in a run report, if it was written.
+func reportOutcome(path string) (runID, status string) {
+	r, err := readRunReport(path)
+	if err != nil {
+		return "", ""
+	}
+	return r.RunID, r.Status
+}
+
+// runWatch implements the watch subcommand, which imports every file dropped into
+// an inbox directory until it is interrupted, and returns the process exit code.
+// Flags after -- are passed to each import.
+func runWatch(args []string) int {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	inboxPtr := fs.String("inbox", "", "Directory watched for CSV files (required).")
+	patternPtr := fs.String("pattern", "*.csv", "Shell pattern a file name must match to be imported.")
+	processedDirPtr := fs.String("processedDir", "", "Where imported files and their run reports are moved. Defaults to processed/ in the inbox.")
+	failedDirPtr := fs.String("failedDir", "", "Where files whose import failed are moved with their run reports. Defaults to failed/ in the inbox.")
+	stableForPtr := fs.Duration("stableFor", 10*time.Second, "A file without a done marker is imported once its size and modification time have not changed for this long.")
+	requireDoneMarkerPtr := fs.Bool("requireDoneMarker", false, "Only import a file once a marker named after it with a .done suffix appears.")
+	pollIntervalPtr := fs.Duration("pollInterval", 5*time.Second, "How often the inbox is scanned. Changes are also picked up at once through inotify where available.")
+	pollOnlyPtr := fs.Bool("pollOnly", false, "Do not use inotify, e.g. for network file systems that do not report changes.")
+	logFlags := registerLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: bulk-csv-processor watch -inbox DIR [watch flags] [-- import flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	importArgs := fs.Args()
+	if *inboxPtr == "" {
+		fmt.Fprintln(os.Stderr, "watch: -inbox is required")
+		fs.Usage()
+		return 2
+	}
+	if err := checkImportArgs(importArgs); err != nil {
+		fmt.Fprintln(os.Stderr, "watch:", err)
+		return 2
+	}
+	if *pollIntervalPtr <= 0 {
+		fmt.Fprintln(os.Stderr, "watch: -pollInterval must be positive")
+		return 2
+	}
+	if _, err := filepath.Match(*patternPtr, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "watch: invalid -pattern %q\n", *patternPtr)
+		return 2
+	}
+	logger, _, err := logFlags.newLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	slog.SetDefault(logger)
+	processedDir, failedDir := *processedDirPtr, *failedDirPtr
+	if processedDir == "" {
+		processedDir = filepath.Join(*inboxPtr, "processed")
+	}
+	if failedDir == "" {
+		failedDir = filepath.Join(*inboxPtr, "failed")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		slog.Error("Cannot find the importer executable", "stage", "watch", "error", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var changes <-chan struct{} // Stays nil, and the inbox is only polled, without inotify
+	if !*pollOnlyPtr {
+		events, closeWatch, err := watchDirectory(*inboxPtr)
+		if err != nil {
+			slog.Warn("Falling back to polling the inbox", "stage", "watch", "inbox", *inboxPtr, "error", err)
+		} else {
+			defer closeWatch()
+			changes = events
+		}
+	}
+	slog.Info("Watching inbox", "stage", "watch", "inbox", *inboxPtr, "pattern", *patternPtr,
+		"processed_dir", processedDir, "failed_dir", failedDir, "inotify", changes != nil, "import_args", importArgs)
+
+	ticker := time.NewTicker(*pollIntervalPtr)
+	defer ticker.Stop()
+	tracker := newFileTracker(*stableForPtr)
+	for {
+		ready, err := readyFiles(*inboxPtr, *patternPtr, tracker, *requireDoneMarkerPtr, time.Now())
+		if err != nil {
+			slog.Error("Inbox error", "stage", "watch", "error", err)
+			return 1
+		}
+		for _, name := range ready {
+			if ctx.Err() != nil {
+				break // Files not started yet are left for the next start
+			}
+			path := filepath.Join(*inboxPtr, name)
+			reportPath := filepath.Join(*inboxPtr, "."+name+watchReportSuffix)
+			slog.Info("Importing file", "stage", "watch", "file", path)
+			started := time.Now()
+			code, err := importFile(exe, importArgs, path, reportPath)
+			if err != nil {
+				slog.Error("Import error", "stage", "watch", "file", path, "error", err)
+				return 1
+			}
+			runID, status := reportOutcome(reportPath)
+			switch {
+			case code == 2:
+				// The import flags are invalid, so every file would fail the same way.
+				slog.Error("Import rejected its flags; stopping", "stage", "watch", "file", path, "import_args", importArgs)
+				os.Remove(reportPath)
+				return 2
+			case code != 0 && ctx.Err() != nil:
+				// Interrupted along with the watcher rather than failed; imported again on the next start.
+				slog.Warn("Import interrupted; file left in the inbox", "stage", "watch", "file", path, "import_run_id", runID)
+				os.Remove(reportPath)
+				continue
+			}
+			dir := processedDir
+			if code != 0 {
+				dir = failedDir
+			}
+			dest, err := moveImported(path, reportPath, dir)
+			if err != nil {
+				// A file left in the inbox would be imported again and again.
+				slog.Error("Could not move imported file", "stage", "watch", "file", path, "error", err)
+				return 1
+			}
+			slog.Info("Imported file", "stage", "watch", "file", path, "moved_to", dest, "exit_code", code,
+				"import_run_id", runID, "status", status, "elapsed", time.Since(started).Round(time.Millisecond).String())
+		}
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopped watching inbox", "stage", "watch", "inbox", *inboxPtr)
+			return 0
+		case <-ticker.C:
+		case _, ok := <-changes:
+			if !ok {
+				slog.Warn("inotify stopped; falling back to polling the inbox", "stage", "watch", "inbox", *inboxPtr)
+				changes = nil
+			}
+		}
+	}
+}
@@ -0,0 +1,41 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// watchDirectory reports changes to the files in dir through inotify: the returned
+// channel receives a value whenever a file is created, finished writing or moved in,
+// and is closed if the watch breaks. The returned function stops watching.
+func watchDirectory(dir string) (<-chan struct{}, func(), error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not start inotify: %w", err)
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CREATE|syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); err != nil {
+		syscall.Close(fd)
+		return nil, nil, fmt.Errorf("could not watch %s: %w", dir, err)
+	}
+	// A non-blocking descriptor goes through the runtime poller, so Close unblocks Read.
+	f := os.NewFile(uintptr(fd), "inotify")
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			// The inbox is scanned again on every change, so the events themselves are not needed.
+			if _, err := f.Read(buf); err != nil {
+				return
+			}
+			select {
+			case changes <- struct{}{}:
+			default: // A scan is already due
+			}
+		}
+	}()
+	return changes, func() { f.Close() }, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// watchDirectory is only implemented with inotify, so elsewhere the inbox is polled.
+func watchDirectory(dir string) (<-chan struct{}, func(), error) {
+	return nil, nil, errors.New("inotify is only available on Linux")
+}
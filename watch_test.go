@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReadyFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.csv", "b.csv", "b.csv.done", ".hidden.csv", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "processed.csv"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	t.Run("StableOrMarked", func(t *testing.T) {
+		tracker := newFileTracker(time.Minute)
+		ready, err := readyFiles(dir, "*.csv", tracker, false, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(ready, []string{"b.csv"}) {
+			t.Errorf("Expected only the marked file at first sight, got %v", ready)
+		}
+		ready, _ = readyFiles(dir, "*.csv", tracker, false, now.Add(2*time.Minute))
+		if !slices.Equal(ready, []string{"a.csv", "b.csv"}) {
+			t.Errorf("Expected both files once stable, got %v", ready)
+		}
+	})
+
+	t.Run("ChangedFile", func(t *testing.T) {
+		tracker := newFileTracker(time.Minute)
+		readyFiles(dir, "a.csv", tracker, false, now)
+		if err := os.WriteFile(filepath.Join(dir, "a.csv"), []byte("x\ny\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		ready, _ := readyFiles(dir, "a.csv", tracker, false, now.Add(2*time.Minute))
+		if len(ready) != 0 {
+			t.Errorf("Expected a file that grew to wait again, got %v", ready)
+		}
+	})
+
+	t.Run("RequireMarker", func(t *testing.T) {
+		ready, _ := readyFiles(dir, "*", newFileTracker(0), true, now)
+		if !slices.Equal(ready, []string{"b.csv"}) {
+			t.Errorf("Expected only the marked file, got %v", ready)
+		}
+	})
+}
+
+func TestMoveImported(t *testing.T) {
+	inbox := t.TempDir()
+	processed := filepath.Join(inbox, "processed")
+	write := func(name string) string {
+		path := filepath.Join(inbox, name)
+		if err := os.WriteFile(path, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	path, report := write("orders.csv"), write(".orders.csv"+watchReportSuffix)
+	write("orders.csv" + doneMarkerSuffix)
+	dest, err := moveImported(path, report, processed)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if dest != filepath.Join(processed, "orders.csv") {
+		t.Errorf("Expected orders.csv in processed/, got %s", dest)
+	}
+	if data, err := os.ReadFile(dest + watchReportSuffix); err != nil || string(data) != ".orders.csv"+watchReportSuffix {
+		t.Errorf("Expected the report next to the file, got %q (%v)", data, err)
+	}
+	if _, err := os.Stat(path + doneMarkerSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected the done marker to be removed, got %v", err)
+	}
+
+	// A second file of the same name, without a report, gets a numbered name.
+	dest, err = moveImported(write("orders.csv"), filepath.Join(inbox, ".missing"), processed)
+	if err != nil || dest != filepath.Join(processed, "orders.1.csv") {
+		t.Errorf("Expected orders.1.csv, got %s (%v)", dest, err)
+	}
+}
+
+func TestCheckImportArgs(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr bool
+	}{
+		{[]string{"-collectionName", "orders", "-mode=upsert"}, false},
+		{[]string{"-csvFile", "x.csv"}, true},
+		{[]string{"--report=r.json"}, true},
+	}
+	for _, tt := range tests {
+		if err := checkImportArgs(tt.args); (err != nil) != tt.wantErr {
+			t.Errorf("Expected error %v for %v, got %v", tt.wantErr, tt.args, err)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// watermarksCollectionName holds the highest watermark value loaded from each source,
+// in the target database.
+const watermarksCollectionName = "_import_watermarks"
+
+// watermarkState is a source's document in the watermarks collection.
+type watermarkState struct {
+	Source    string    `bson:"_id"`
+	Column    string    `bson:"column"`
+	Value     any       `bson:"value"`
+	RunID     string    `bson:"runId"`
+	File      string    `bson:"file"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+}
+
+// watermarkSummary records a run's watermark in the run report.
+type watermarkSummary struct {
+	Source   string `json:"source"`
+	Column   string `json:"column"`
+	Previous string `json:"previous,omitempty"` // empty for a first or reset load
+	Current  string `json:"current,omitempty"`  // empty unless the run advanced it
+}
+
+// watermark skips rows already loaded by an earlier run, judged by a column whose
+// values only grow (a timestamp or sequence), and tracks how far this run got.
+type watermark struct {
+	column string
+	typ    string // typeString, typeInt, typeLong, typeDouble or typeDate
+	format string // layout of a date column
+	// current is the value loaded up to by earlier runs; nil loads every row.
+	current any
+	// passed counts rows above current; each of them is then written or rejected.
+	passed, written, rejected int64
+	highest                   any // highest value written, nil if none
+	lowestRejected            any // lowest value of a passed row that was rejected, nil if none
+	// below holds the values written below lowestRejected, or every value written
+	// while no row has been rejected, as the watermark may only move to one of them.
+	below []any
+}
+
+// newWatermark returns a watermark on column, typed by its schema entry if any.
+// Columns without one are compared as text, which suits ISO timestamps and
+// zero-padded sequences but not plain numbers, as "10" sorts below "9".
+func newWatermark(column string, schema *schemaConfig) (*watermark, error) {
+	w := &watermark{column: column, typ: typeString}
+	if schema != nil {
+		for _, c := range schema.Columns {
+			if c.Name == column {
+				w.typ, w.format = c.Type, c.Format
+			}
+		}
+	}
+	switch w.typ {
+	case typeString, typeInt, typeLong, typeDouble, typeDate:
+		return w, nil
+	}
+	return nil, fmt.Errorf("watermark column %s is a %s; it must be a string, int, long, double or date", column, w.typ)
+}
+
+// value parses a row's watermark field.
+func (w *watermark) value(field string) (any, error) {
+	value := strings.TrimSpace(field)
+	if value == "" {
+		return nil, fmt.Errorf("watermark column %s is empty", w.column)
+	}
+	if w.typ == typeString {
+		return value, nil
+	}
+	v, err := convertValue(value, w.typ, w.format)
+	if err != nil {
+		return nil, fmt.Errorf("watermark column %s: %q is not a valid %s", w.column, field, w.typ)
+	}
+	return normalizeWatermark(v), nil
+}
+
+// normalizeWatermark maps the Go types a watermark value can have, parsed or read
+// back from the database, to int64, float64, time.Time or string.
+func normalizeWatermark(v any) any {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case primitive.DateTime:
+		return n.Time().UTC()
+	}
+	return v
+}
+
+// formatWatermark renders a normalized value for the run report.
+func formatWatermark(v any) string {
+	if t, ok := v.(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+// matches reports whether a normalized value has the column's type.
+func (w *watermark) matches(v any) bool {
+	switch v.(type) {
+	case string:
+		return w.typ == typeString
+	case int64:
+		return w.typ == typeInt || w.typ == typeLong
+	case float64:
+		return w.typ == typeDouble
+	case time.Time:
+		return w.typ == typeDate
+	}
+	return false
+}
+
+// compareWatermarks compares two normalized values of the same type.
+func compareWatermarks(a, b any) (int, error) {
+	switch x := a.(type) {
+	case int64:
+		if y, ok := b.(int64); ok {
+			return cmpOrdered(x, y), nil
+		}
+	case float64:
+		if y, ok := b.(float64); ok {
+			return cmpOrdered(x, y), nil
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), nil
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare watermark %v (%T) with %v (%T)", a, a, b, b)
+}
+
+// cmpOrdered compares two numbers.
+func cmpOrdered[T int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// skip reports whether a row with watermark value v was loaded by an earlier run.
+// Rows it does not skip are counted as passed.
+func (w *watermark) skip(v any) bool {
+	if w.current != nil {
+		if c, _ := compareWatermarks(v, w.current); c <= 0 {
+			return true
+		}
+	}
+	w.passed++
+	return false
+}
+
+// wrote records that a row with watermark value v was written.
+func (w *watermark) wrote(v any) {
+	w.written++
+	if w.highest == nil {
+		w.highest = v
+	} else if c, _ := compareWatermarks(v, w.highest); c > 0 {
+		w.highest = v
+	}
+	if w.lowestRejected == nil {
+		w.below = append(w.below, v)
+	} else if c, _ := compareWatermarks(v, w.lowestRejected); c < 0 {
+		w.below = append(w.below, v)
+	}
+}
+
+// reject records that a row with watermark value v passed but was not written.
+func (w *watermark) reject(v any) {
+	w.rejected++
+	if w.lowestRejected != nil {
+		if c, _ := compareWatermarks(v, w.lowestRejected); c >= 0 {
+			return
+		}
+	}
+	w.lowestRejected = v
+	w.below = slices.DeleteFunc(w.below, func(b any) bool {
+		c, _ := compareWatermarks(b, v)
+		return c >= 0
+	})
+}
+
+// next returns the value to load from on the next run, or nil if the watermark does
+// not move. It stops short of the lowest rejected row, at the highest value written
+// below it, so the next run loads that row again rather than skipping it; every row
+// below it was written. It does not move unless every row above it was written or
+// rejected.
+func (w *watermark) next() any {
+	if w.written+w.rejected < w.passed {
+		return nil
+	}
+	if w.lowestRejected == nil {
+		return w.highest
+	}
+	var next any
+	for _, v := range w.below {
+		if next == nil {
+			next = v
+		} else if c, _ := compareWatermarks(v, next); c > 0 {
+			next = v
+		}
+	}
+	return next
+}
+
+// loadWatermark reads the watermark of source from db. It returns nil if the source
+// has none yet.
+func loadWatermark(ctx context.Context, db *mongo.Database, source string, w *watermark) (any, error) {
+	var state watermarkState
+	err := db.Collection(watermarksCollectionName).FindOne(ctx, bson.M{"_id": source}).Decode(&state)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read watermark of %s: %w", source, err)
+	}
+	if state.Column != w.column {
+		return nil, fmt.Errorf("watermark of %s is on column %s, not %s; use -resetWatermark to start over", source, state.Column, w.column)
+	}
+	value := normalizeWatermark(state.Value)
+	if !w.matches(value) {
+		return nil, fmt.Errorf("watermark of %s is %v, not a %s; use -resetWatermark to start over", source, state.Value, w.typ)
+	}
+	return value, nil
+}
+
+// saveWatermark records value as the watermark of source.
+func saveWatermark(ctx context.Context, db *mongo.Database, state watermarkState) error {
+	_, err := db.Collection(watermarksCollectionName).ReplaceOne(ctx, bson.M{"_id": state.Source}, state, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("could not save watermark of %s: %w", state.Source, err)
+	}
+	return nil
+}
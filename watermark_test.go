@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestWatermark(t *testing.T) {
+	t.Run("SkipAndAdvance", func(t *testing.T) {
+		w, err := newWatermark("seq", &schemaConfig{Columns: []columnSpec{{Name: "seq", Type: typeLong}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.current = int64(10)
+		var kept []any
+		for _, field := range []string{"9", "10", "12", "11"} {
+			v, err := w.value(field)
+			if err != nil {
+				t.Fatalf("Expected no error for %q, got %v", field, err)
+			}
+			if !w.skip(v) {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) != 2 || w.passed != 2 {
+			t.Fatalf("Expected rows 12 and 11 to pass, got %v", kept)
+		}
+		w.wrote(kept[0])
+		if next := w.next(); next != nil {
+			t.Errorf("Expected no next watermark while a passed row is unwritten, got %v", next)
+		}
+		w.wrote(kept[1])
+		if next := w.next(); next != int64(12) {
+			t.Errorf("Expected next watermark 12, got %v", next)
+		}
+	})
+
+	t.Run("StopsBelowRejected", func(t *testing.T) {
+		w := &watermark{column: "seq", typ: typeLong, current: int64(10)}
+		for _, v := range []int64{11, 12, 13, 14, 15} {
+			w.skip(v)
+		}
+		w.wrote(int64(11))
+		w.reject(int64(14))
+		w.wrote(int64(15))
+		w.wrote(int64(12))
+		if next := w.next(); next != nil {
+			t.Errorf("Expected no next watermark while a passed row is neither written nor rejected, got %v", next)
+		}
+		w.reject(int64(13))
+		if next := w.next(); next != int64(12) {
+			t.Errorf("Expected next watermark 12, below the lowest rejected row, got %v", next)
+		}
+	})
+
+	t.Run("FirstRowRejected", func(t *testing.T) {
+		w := &watermark{column: "seq", typ: typeLong}
+		w.skip(int64(1))
+		w.skip(int64(2))
+		w.reject(int64(1))
+		w.wrote(int64(2))
+		if next := w.next(); next != nil {
+			t.Errorf("Expected no next watermark when the lowest row was rejected, got %v", next)
+		}
+	})
+
+	t.Run("Dates", func(t *testing.T) {
+		w, err := newWatermark("at", &schemaConfig{Columns: []columnSpec{{Name: "at", Type: typeDate, Format: "2006-01-02"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.current = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+		v, err := w.value("2024-03-02")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.skip(v) {
+			t.Errorf("Expected a later date to pass")
+		}
+		if _, err := w.value("yesterday"); err == nil {
+			t.Errorf("Expected an error for an unparsable date")
+		}
+	})
+
+	t.Run("Text", func(t *testing.T) {
+		w, err := newWatermark("at", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.current = "2024-03-01T10:00:00Z"
+		for field, want := range map[string]bool{"2024-03-01T09:59:59Z": true, "2024-03-01T10:00:00Z": true, "2024-03-01T10:00:01Z": false} {
+			if got := w.skip(field); got != want {
+				t.Errorf("Expected skip(%s) = %v, got %v", field, want, got)
+			}
+		}
+		if _, err := w.value(" "); err == nil {
+			t.Errorf("Expected an error for an empty value")
+		}
+		if v, err := w.value(" 2024-03-01T10:00:01Z "); err != nil || v != "2024-03-01T10:00:01Z" {
+			t.Errorf("Expected the value without surrounding spaces, got %q (%v)", v, err)
+		}
+	})
+
+	t.Run("UnsupportedType", func(t *testing.T) {
+		if _, err := newWatermark("ok", &schemaConfig{Columns: []columnSpec{{Name: "ok", Type: typeBool}}}); err == nil {
+			t.Errorf("Expected an error for a bool watermark column")
+		}
+	})
+}
+
+func TestLoadWatermark(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	stored := func(column string, value any) bson.D {
+		return mtest.CreateCursorResponse(0, "bulkcsv."+watermarksCollectionName, mtest.FirstBatch,
+			bson.D{{Key: "_id", Value: "orders"}, {Key: "column", Value: column}, {Key: "value", Value: value}})
+	}
+	seq := &watermark{column: "seq", typ: typeLong}
+
+	mt.Run("Found", func(mt *mtest.T) {
+		mt.AddMockResponses(stored("seq", int32(42)))
+		v, err := loadWatermark(context.Background(), mt.DB, "orders", seq)
+		if err != nil || v != int64(42) {
+			t.Errorf("Expected 42, got %v (%v)", v, err)
+		}
+	})
+
+	mt.Run("None", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "bulkcsv."+watermarksCollectionName, mtest.FirstBatch))
+		v, err := loadWatermark(context.Background(), mt.DB, "orders", seq)
+		if err != nil || v != nil {
+			t.Errorf("Expected no watermark, got %v (%v)", v, err)
+		}
+	})
+
+	mt.Run("OtherColumn", func(mt *mtest.T) {
+		mt.AddMockResponses(stored("id", int32(42)))
+		if _, err := loadWatermark(context.Background(), mt.DB, "orders", seq); err == nil || !strings.Contains(err.Error(), "-resetWatermark") {
+			t.Errorf("Expected a column mismatch error, got %v", err)
+		}
+	})
+
+	mt.Run("OtherType", func(mt *mtest.T) {
+		mt.AddMockResponses(stored("seq", "42"))
+		if _, err := loadWatermark(context.Background(), mt.DB, "orders", seq); err == nil {
+			t.Errorf("Expected a type mismatch error")
+		}
+	})
+
+	mt.Run("Save", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: int32(1)}))
+		err := saveWatermark(context.Background(), mt.DB, watermarkState{Source: "orders", Column: "seq", Value: int64(43)})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		started := mt.GetStartedEvent()
+		if started.CommandName != "update" || started.Command.Lookup("updates", "0", "upsert").Boolean() != true {
+			t.Errorf("Expected an upserting update, got %s", started.Command)
+		}
+	})
+}